@@ -0,0 +1,98 @@
+/*
+Copyright 2020 easystack.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	vmv1 "easystack.io/vm-operator/pkg/api/v1"
+)
+
+func runReboot(g *globals, args []string) error {
+	fs := g.newFlagSet("reboot")
+	servers := fs.String("server", "", "Comma separated names of the servers to reboot, all servers if empty.")
+	hard := fs.Bool("hard", false, "Power cycle the servers instead of rebooting their OS.")
+	positional, err := parseArgs(fs, args, 1)
+	if err != nil {
+		return err
+	}
+
+	action := vmv1.ActionReboot
+	if *hard {
+		action = vmv1.ActionHardReboot
+	}
+	return g.requestAction(positional[0], action, *servers)
+}
+
+func runRebuild(g *globals, args []string) error {
+	fs := g.newFlagSet("rebuild")
+	servers := fs.String("server", "", "Comma separated names of the servers to rebuild, all servers if empty.")
+	positional, err := parseArgs(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	return g.requestAction(positional[0], vmv1.ActionRebuild, *servers)
+}
+
+// runResize changes the flavor in the spec, heat resizes the servers when
+// the operator updates the stack
+func runResize(g *globals, args []string) error {
+	positional, err := parseArgs(g.newFlagSet("resize"), args, 2)
+	if err != nil {
+		return err
+	}
+
+	vm, err := g.getVM(positional[0])
+	if err != nil {
+		return err
+	}
+	patch := client.MergeFrom(vm.DeepCopy())
+	vm.Spec.Server.Flavor = positional[1]
+	if err := g.client.Patch(g.ctx, vm, patch); err != nil {
+		return fmt.Errorf("failed to resize %s: %v", vm.Name, err)
+	}
+	fmt.Fprintf(g.out, "virtualmachine %s/%s resizing to %s\n", vm.Namespace, vm.Name, positional[1])
+	return nil
+}
+
+// requestAction annotates the VirtualMachine name with action, the operator
+// runs it and reports the result in the ActionCompleted condition
+func (g *globals) requestAction(name string, action string, servers string) error {
+	vm, err := g.getVM(name)
+	if err != nil {
+		return err
+	}
+	if pending, ok := vm.Annotations[vmv1.ActionAnnotation]; ok {
+		return fmt.Errorf("%s of %s is pending", pending, name)
+	}
+
+	patch := client.MergeFrom(vm.DeepCopy())
+	if vm.Annotations == nil {
+		vm.Annotations = make(map[string]string)
+	}
+	vm.Annotations[vmv1.ActionAnnotation] = action
+	if servers != "" {
+		vm.Annotations[vmv1.ActionServersAnnotation] = servers
+	}
+	if err := g.client.Patch(g.ctx, vm, patch); err != nil {
+		return fmt.Errorf("failed to request %s of %s: %v", action, name, err)
+	}
+	fmt.Fprintf(g.out, "virtualmachine %s/%s %s requested\n", vm.Namespace, vm.Name, action)
+	return nil
+}
@@ -0,0 +1,210 @@
+/*
+Copyright 2020 easystack.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+	"k8s.io/apimachinery/pkg/types"
+
+	vmv1 "easystack.io/vm-operator/pkg/api/v1"
+	vmtpl "easystack.io/vm-operator/pkg/templates"
+)
+
+// diffContext is the number of unchanged lines shown around a change
+const diffContext = 3
+
+func runDiff(g *globals, args []string) error {
+	fs := g.newFlagSet("diff")
+	configDir := fs.String("config-dir", "", "Dir whose *.tpl files override the embedded heat templates, the --config-dir of the operator.")
+	positional, err := parseArgs(fs, args, 1)
+	if err != nil {
+		return err
+	}
+
+	vm, err := g.getVM(positional[0])
+	if err != nil {
+		return err
+	}
+	var vmt *vmv1.VirtualMachineTemplate
+	if ref := vm.Spec.Template; ref != nil {
+		vmt = &vmv1.VirtualMachineTemplate{}
+		key := types.NamespacedName{Namespace: vm.Namespace, Name: ref.Name}
+		if err := g.client.Get(g.ctx, key, vmt); err != nil {
+			return fmt.Errorf("failed to get template %s: %v", key, err)
+		}
+	}
+	set, err := vmtpl.Load(*configDir)
+	if err != nil {
+		return err
+	}
+	rendered, params, err := renderVM(vm, set, vmt)
+	if err != nil {
+		return err
+	}
+	preview, err := vmtpl.NewPreview(rendered, params)
+	if err != nil {
+		return err
+	}
+
+	heat, err := g.heat(vm)
+	if err != nil {
+		return err
+	}
+	projectID := vm.Spec.Project.ProjectID
+	current, err := heat.StackTemplate(g.ctx, projectID, vm.StackName(), vm.Status.StackID)
+	if err != nil {
+		return err
+	}
+	stack, err := heat.StackGet(g.ctx, projectID, vm.StackName(), vm.Status.StackID)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(g.out, "# stack %s/%s, heat doesn't return child templates, only %s is compared\n",
+		vm.StackName(), vm.Status.StackID, vmtpl.RootTemplate)
+	return writeStackDiff(g.out, current, rendered[vmtpl.RootTemplate], stack.Parameters, preview.Parameters)
+}
+
+// writeStackDiff writes the differences of the root template and the
+// parameters of a stack to the desired ones. The templates are compared
+// after normalizing them, heat returns its own serialization. Parameters heat
+// adds itself and hidden ones, which heat masks, are skipped.
+func writeStackDiff(w io.Writer, current []byte, desired string, currentParams map[string]string, desiredParams map[string]interface{}) error {
+	a, err := normalizeTemplate(current)
+	if err != nil {
+		return fmt.Errorf("failed to parse template of stack: %v", err)
+	}
+	b, err := normalizeTemplate([]byte(desired))
+	if err != nil {
+		return fmt.Errorf("failed to parse desired template: %v", err)
+	}
+	writeDiff(w, "stack/"+vmtpl.RootTemplate, "desired/"+vmtpl.RootTemplate, a, b)
+
+	var oldParams, newParams []string
+	for k, v := range currentParams {
+		if desiredParams[k] == vmtpl.Redacted || strings.HasPrefix(k, "OS::") {
+			continue
+		}
+		oldParams = append(oldParams, fmt.Sprintf("%s: %s", k, v))
+	}
+	for k, v := range desiredParams {
+		if v == vmtpl.Redacted {
+			continue
+		}
+		newParams = append(newParams, fmt.Sprintf("%s: %v", k, v))
+	}
+	sort.Strings(oldParams)
+	sort.Strings(newParams)
+	writeDiff(w, "stack/parameters", "desired/parameters", oldParams, newParams)
+	return nil
+}
+
+// normalizeTemplate returns the lines of template marshaled again as YAML,
+// with sorted keys
+func normalizeTemplate(template []byte) ([]string, error) {
+	var parsed interface{}
+	if err := yaml.Unmarshal(template, &parsed); err != nil {
+		return nil, err
+	}
+	out, err := yaml.Marshal(parsed)
+	if err != nil {
+		return nil, err
+	}
+	return strings.Split(strings.TrimSuffix(string(out), "\n"), "\n"), nil
+}
+
+// writeDiff writes the differences of the lines a to b in the unified format,
+// nothing if they're equal
+func writeDiff(w io.Writer, nameA string, nameB string, a []string, b []string) {
+	lines := diffLines(a, b)
+	changed := make([]bool, len(lines))
+	differs := false
+	for i, line := range lines {
+		if line[0] != ' ' {
+			for j := i - diffContext; j <= i+diffContext; j++ {
+				if j >= 0 && j < len(lines) {
+					changed[j] = true
+				}
+			}
+			differs = true
+		}
+	}
+	if !differs {
+		return
+	}
+
+	fmt.Fprintf(w, "--- %s\n+++ %s\n", nameA, nameB)
+	for i, line := range lines {
+		if !changed[i] {
+			continue
+		}
+		if i == 0 || !changed[i-1] {
+			fmt.Fprintln(w, "@@")
+		}
+		fmt.Fprintln(w, line)
+	}
+}
+
+// diffLines returns the lines of a and b in order, prefixed by "-" if only in
+// a, "+" if only in b and " " if in both, from their longest common subsequence
+func diffLines(a []string, b []string) []string {
+	// lcs[i][j] is the length of the longest common subsequence of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var lines []string
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			lines = append(lines, " "+a[i])
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			lines = append(lines, "-"+a[i])
+			i++
+		default:
+			lines = append(lines, "+"+b[j])
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		lines = append(lines, "-"+a[i])
+	}
+	for ; j < len(b); j++ {
+		lines = append(lines, "+"+b[j])
+	}
+	return lines
+}
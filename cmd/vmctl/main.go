@@ -0,0 +1,214 @@
+/*
+Copyright 2020 easystack.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// vmctl renders, inspects and manages VirtualMachines. Rendering works
+// offline, the other commands talk to the cluster of the kubeconfig, and diff
+// and status also to heat with the credentials of the VirtualMachine.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	_ "k8s.io/client-go/plugin/pkg/client/auth/gcp"
+	"k8s.io/client-go/tools/clientcmd"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	vmv1 "easystack.io/vm-operator/pkg/api/v1"
+	"easystack.io/vm-operator/pkg/openstack"
+	"easystack.io/vm-operator/pkg/utils"
+)
+
+// command is a subcommand of vmctl
+type command struct {
+	name    string
+	args    string
+	summary string
+	run     func(g *globals, args []string) error
+}
+
+var commands = []command{
+	{"render", "-f vm.yaml [-config-dir dir] [-template vmt.yaml] [-o dir]", "render the heat templates of a VirtualMachine offline", runRender},
+	{"diff", "name", "diff the desired templates of a VirtualMachine against its stack", runDiff},
+	{"status", "name [-events n]", "show the servers and the heat events of a VirtualMachine", runStatus},
+	{"reboot", "name [-server a,b] [-hard]", "reboot the servers of a VirtualMachine", runReboot},
+	{"rebuild", "name [-server a,b]", "rebuild the servers of a VirtualMachine from its image", runRebuild},
+	{"resize", "name flavor", "change the flavor of the servers of a VirtualMachine", runResize},
+}
+
+// globals are the flags shared by all commands, given before the command
+type globals struct {
+	kubeconfig string
+	namespace  string
+	authURL    string
+
+	out    io.Writer
+	ctx    context.Context
+	client client.Client
+}
+
+func main() {
+	g := &globals{out: os.Stdout}
+	fs := flag.NewFlagSet("vmctl", flag.ExitOnError)
+	fs.StringVar(&g.kubeconfig, "kubeconfig", "", "Path of the kubeconfig, defaults to $KUBECONFIG or ~/.kube/config.")
+	fs.StringVar(&g.namespace, "n", "", "Namespace of the VirtualMachine, defaults to the one of the kubeconfig context.")
+	fs.StringVar(&g.authURL, "os-auth-url", os.Getenv("OS_AUTH_URL"), "Identity endpoint of credentials without auth url.")
+	fs.Usage = func() { usage(fs) }
+	fs.Parse(os.Args[1:])
+
+	if fs.NArg() == 0 {
+		usage(fs)
+		os.Exit(2)
+	}
+	name := fs.Arg(0)
+	for _, cmd := range commands {
+		if cmd.name != name {
+			continue
+		}
+		g.ctx = utils.WithLogger(context.Background(), log.NullLogger{})
+		if err := cmd.run(g, fs.Args()[1:]); err != nil {
+			fmt.Fprintf(os.Stderr, "vmctl %s: %v\n", name, err)
+			os.Exit(1)
+		}
+		return
+	}
+	fmt.Fprintf(os.Stderr, "vmctl: unknown command %q\n", name)
+	usage(fs)
+	os.Exit(2)
+}
+
+func usage(fs *flag.FlagSet) {
+	fmt.Fprintf(os.Stderr, "Usage: vmctl [flags] command [args]\n\nCommands:\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-8s %s\n", cmd.name, cmd.summary)
+		fmt.Fprintf(os.Stderr, "           vmctl %s %s\n", cmd.name, cmd.args)
+	}
+	fmt.Fprintf(os.Stderr, "\nFlags:\n")
+	fs.PrintDefaults()
+}
+
+// newFlagSet returns the flag set of the command, whose flags may be given
+// before or after its positional arguments. The namespace may be given to the
+// command too.
+func (g *globals) newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet("vmctl "+name, flag.ContinueOnError)
+	fs.StringVar(&g.namespace, "n", g.namespace, "Namespace of the VirtualMachine.")
+	return fs
+}
+
+// parseArgs parses args into fs and returns the n positional arguments
+func parseArgs(fs *flag.FlagSet, args []string, n int) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		args = fs.Args()
+		if len(args) == 0 {
+			break
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+	if len(positional) != n {
+		return nil, fmt.Errorf("expected %d arguments, got %d", n, len(positional))
+	}
+	return positional, nil
+}
+
+// kubeClient returns the client of the cluster of the kubeconfig, it also
+// resolves the namespace of the commands
+func (g *globals) kubeClient() (client.Client, error) {
+	if g.client != nil {
+		return g.client, nil
+	}
+
+	rules := clientcmd.NewDefaultClientConfigLoadingRules()
+	rules.ExplicitPath = g.kubeconfig
+	config := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(rules, &clientcmd.ConfigOverrides{})
+	if g.namespace == "" {
+		ns, _, err := config.Namespace()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get namespace of kubeconfig: %v", err)
+		}
+		g.namespace = ns
+	}
+	restConfig, err := config.ClientConfig()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load kubeconfig: %v", err)
+	}
+
+	scheme := runtime.NewScheme()
+	_ = corev1.AddToScheme(scheme)
+	_ = vmv1.AddToScheme(scheme)
+	c, err := client.New(restConfig, client.Options{Scheme: scheme})
+	if err != nil {
+		return nil, err
+	}
+	g.client = c
+	return c, nil
+}
+
+// getVM returns the VirtualMachine name of the namespace of the commands
+func (g *globals) getVM(name string) (*vmv1.VirtualMachine, error) {
+	c, err := g.kubeClient()
+	if err != nil {
+		return nil, err
+	}
+	vm := &vmv1.VirtualMachine{}
+	key := types.NamespacedName{Namespace: g.namespace, Name: name}
+	if err := c.Get(g.ctx, key, vm); err != nil {
+		return nil, fmt.Errorf("failed to get VirtualMachine %s: %v", key, err)
+	}
+	return vm, nil
+}
+
+// heat returns an OSService authenticated to the project of vm with the
+// credential the operator uses for it
+func (g *globals) heat(vm *vmv1.VirtualMachine) (openstack.Service, error) {
+	if vm.Status.StackID == "" {
+		return nil, fmt.Errorf("VirtualMachine %s/%s has no stack yet", vm.Namespace, vm.Name)
+	}
+
+	cred := &openstack.UserCredential{Token: vm.Spec.Project.Token}
+	if ref := vm.Spec.Project.CredentialsSecretRef; ref != nil {
+		var secret corev1.Secret
+		key := types.NamespacedName{Namespace: vm.Namespace, Name: ref.Name}
+		if err := g.client.Get(g.ctx, key, &secret); err != nil {
+			return nil, fmt.Errorf("failed to get credentials secret %s: %v", key, err)
+		}
+		var err error
+		if cred, err = openstack.CredentialFromSecretData(secret.Data, ref.Cloud); err != nil {
+			return nil, err
+		}
+	}
+	if cred.AuthURL == "" && g.authURL == "" {
+		return nil, fmt.Errorf("the credential of VirtualMachine %s/%s has no auth url, set -os-auth-url or OS_AUTH_URL", vm.Namespace, vm.Name)
+	}
+
+	oss := openstack.NewProjectOSService(g.authURL)
+	if err := oss.Authenticate(g.ctx, vm.Spec.Project.ProjectID, cred); err != nil {
+		return nil, err
+	}
+	return oss, nil
+}
@@ -0,0 +1,249 @@
+/*
+Copyright 2020 easystack.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8syaml "k8s.io/apimachinery/pkg/util/yaml"
+
+	vmv1 "easystack.io/vm-operator/pkg/api/v1"
+	vmtpl "easystack.io/vm-operator/pkg/templates"
+)
+
+// parametersFile is the file the parameters of the stack are written to by
+// render -o, next to the templates
+const parametersFile = "parameters.yaml"
+
+func runRender(g *globals, args []string) error {
+	fs := g.newFlagSet("render")
+	file := fs.String("f", "", "File of the VirtualMachine, - for stdin. VirtualMachineTemplates in the file are used too.")
+	configDir := fs.String("config-dir", "", "Dir whose *.tpl files override the embedded heat templates, like the --config-dir of the operator.")
+	templateFile := fs.String("template", "", "File of the VirtualMachineTemplate the VirtualMachine references.")
+	outDir := fs.String("o", "", "Dir to write the templates and "+parametersFile+" to instead of stdout.")
+	if _, err := parseArgs(fs, args, 0); err != nil {
+		return err
+	}
+	if *file == "" {
+		return fmt.Errorf("-f is required")
+	}
+
+	vms, vmts, err := readObjects(*file)
+	if err != nil {
+		return err
+	}
+	if *templateFile != "" {
+		_, more, err := readObjects(*templateFile)
+		if err != nil {
+			return err
+		}
+		vmts = append(vmts, more...)
+	}
+	if len(vms) != 1 {
+		return fmt.Errorf("expected one VirtualMachine in %s, found %d", *file, len(vms))
+	}
+	vm := &vms[0]
+
+	var vmt *vmv1.VirtualMachineTemplate
+	if ref := vm.Spec.Template; ref != nil {
+		for i := range vmts {
+			if vmts[i].Name == ref.Name {
+				vmt = &vmts[i]
+			}
+		}
+	}
+	set, err := vmtpl.Load(*configDir)
+	if err != nil {
+		return err
+	}
+
+	rendered, params, err := renderVM(vm, set, vmt)
+	if err != nil {
+		return err
+	}
+	preview, err := vmtpl.NewPreview(rendered, params)
+	if err != nil {
+		return err
+	}
+	if *outDir != "" {
+		return writePreview(*outDir, preview)
+	}
+	return printPreview(g.out, preview)
+}
+
+// renderVM renders the templates of vm like the operator does, from set or
+// from vmt if vm references a template, and returns them with the parameters
+// of the stack. The rendered templates are linted.
+func renderVM(vm *vmv1.VirtualMachine, set *vmtpl.Set, vmt *vmv1.VirtualMachineTemplate) (map[string]string, map[string]interface{}, error) {
+	params, err := vmtpl.BuildParameters(&vm.Spec)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if ref := vm.Spec.Template; ref != nil {
+		if vmt == nil {
+			return nil, nil, fmt.Errorf("template %s referenced by %s is not given", ref.Name, vm.Name)
+		}
+		if !vmt.Matches(ref) {
+			return nil, nil, fmt.Errorf("template %s is at version %s, not %s", vmt.Name, vmt.Spec.Version, ref.Version)
+		}
+		tplParams, err := vmt.ResolveParameters(ref.Parameters)
+		if err != nil {
+			return nil, nil, err
+		}
+		source := fmt.Sprintf("VirtualMachineTemplate %s/%s", vmt.Namespace, vmt.Name)
+		if set, err = vmtpl.NewSet(source, vmt.Spec.Version, vmt.Spec.Templates); err != nil {
+			return nil, nil, err
+		}
+		for k, v := range tplParams {
+			if _, ok := params.Context[k]; ok {
+				return nil, nil, fmt.Errorf("parameter %s of template %s is set from the spec", k, set.Source)
+			}
+			params.Heat[k] = v
+			params.Context[k] = v
+		}
+	}
+
+	rendered, err := vmtpl.New(set, params.Context).Render()
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := vmtpl.Lint(rendered, params.Heat); err != nil {
+		return nil, nil, fmt.Errorf("templates of %s are invalid: %v", set.Source, err)
+	}
+	return rendered, params.Heat, nil
+}
+
+// readObjects reads the VirtualMachines and VirtualMachineTemplates of the
+// YAML or JSON stream of path, other kinds are skipped
+func readObjects(path string) ([]vmv1.VirtualMachine, []vmv1.VirtualMachineTemplate, error) {
+	var r io.Reader = os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	var vms []vmv1.VirtualMachine
+	var vmts []vmv1.VirtualMachineTemplate
+	decoder := k8syaml.NewYAMLOrJSONDecoder(r, 4096)
+	for {
+		var raw json.RawMessage
+		if err := decoder.Decode(&raw); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, nil, fmt.Errorf("failed to parse %s: %v", path, err)
+		}
+		if len(raw) == 0 || string(raw) == "null" {
+			continue
+		}
+		var meta metav1.TypeMeta
+		if err := json.Unmarshal(raw, &meta); err != nil {
+			return nil, nil, fmt.Errorf("failed to parse %s: %v", path, err)
+		}
+		if meta.APIVersion != vmv1.GroupVersion.String() {
+			continue
+		}
+
+		var err error
+		switch meta.Kind {
+		case "VirtualMachine":
+			var vm vmv1.VirtualMachine
+			if err = json.Unmarshal(raw, &vm); err == nil {
+				vms = append(vms, vm)
+			}
+		case "VirtualMachineTemplate":
+			var vmt vmv1.VirtualMachineTemplate
+			if err = json.Unmarshal(raw, &vmt); err == nil {
+				vmts = append(vmts, vmt)
+			}
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to parse %s %s: %v", meta.Kind, path, err)
+		}
+	}
+	return vms, vmts, nil
+}
+
+// printPreview prints the templates and the parameters of preview as one
+// YAML stream, each document is preceded by a comment naming it
+func printPreview(w io.Writer, preview *vmtpl.Preview) error {
+	params, err := yaml.Marshal(preview.Parameters)
+	if err != nil {
+		return fmt.Errorf("failed to marshal parameters: %v", err)
+	}
+
+	fmt.Fprintf(w, "# digest: %s\n", preview.Digest)
+	for _, name := range templateNames(preview.Templates) {
+		content := preview.Templates[name]
+		if !strings.HasSuffix(content, "\n") {
+			content += "\n"
+		}
+		fmt.Fprintf(w, "---\n# %s\n%s", name, content)
+	}
+	fmt.Fprintf(w, "---\n# %s\n%s", parametersFile, params)
+	return nil
+}
+
+// writePreview writes the templates and the parameters of preview to dir
+func writePreview(dir string, preview *vmtpl.Preview) error {
+	params, err := yaml.Marshal(preview.Parameters)
+	if err != nil {
+		return fmt.Errorf("failed to marshal parameters: %v", err)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	files := map[string][]byte{parametersFile: params}
+	for name, content := range preview.Templates {
+		files[name] = []byte(content)
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), content, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// templateNames returns the names of templates, the root template first
+func templateNames(templates map[string]string) []string {
+	names := make([]string, 0, len(templates))
+	for name := range templates {
+		if name != vmtpl.RootTemplate {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	if _, ok := templates[vmtpl.RootTemplate]; ok {
+		names = append([]string{vmtpl.RootTemplate}, names...)
+	}
+	return names
+}
@@ -0,0 +1,126 @@
+/*
+Copyright 2020 easystack.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/gophercloud/gophercloud/openstack/orchestration/v1/stackevents"
+
+	vmv1 "easystack.io/vm-operator/pkg/api/v1"
+)
+
+func runStatus(g *globals, args []string) error {
+	fs := g.newFlagSet("status")
+	events := fs.Int("events", 10, "Number of the latest heat events of the stack to show, 0 to not ask heat.")
+	positional, err := parseArgs(fs, args, 1)
+	if err != nil {
+		return err
+	}
+
+	vm, err := g.getVM(positional[0])
+	if err != nil {
+		return err
+	}
+	writeStatus(g.out, vm)
+	if *events <= 0 || vm.Status.StackID == "" {
+		return nil
+	}
+
+	heat, err := g.heat(vm)
+	if err != nil {
+		return err
+	}
+	list, err := heat.StackEvents(g.ctx, vm.Spec.Project.ProjectID, vm.StackName(), vm.Status.StackID)
+	if err != nil {
+		return err
+	}
+	if len(list) > *events {
+		list = list[len(list)-*events:]
+	}
+	fmt.Fprintln(g.out)
+	writeEvents(g.out, list)
+	return nil
+}
+
+// writeStatus writes the status of vm, its conditions, its servers and the
+// failures of its resources
+func writeStatus(w io.Writer, vm *vmv1.VirtualMachine) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "Name:\t%s/%s\n", vm.Namespace, vm.Name)
+	fmt.Fprintf(tw, "Phase:\t%s\n", vm.Status.Phase)
+	fmt.Fprintf(tw, "Stack:\t%s\t%s\n", vm.Status.StackID, vm.Status.VmStatus)
+	if vm.Status.LastError != "" {
+		fmt.Fprintf(tw, "Last Error:\t%s\n", vm.Status.LastError)
+	}
+	if vm.Status.Network != "" {
+		fmt.Fprintf(tw, "Network:\t%s\t%s\n", vm.Status.Network, vm.Status.Subnet)
+	}
+	tw.Flush()
+
+	if len(vm.Status.Conditions) > 0 {
+		fmt.Fprintln(w, "\nConditions:")
+		tw = tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "  TYPE\tSTATUS\tREASON\tMESSAGE")
+		for _, c := range vm.Status.Conditions {
+			fmt.Fprintf(tw, "  %s\t%s\t%s\t%s\n", c.Type, c.Status, c.Reason, c.Message)
+		}
+		tw.Flush()
+	}
+
+	if len(vm.Status.Servers) > 0 {
+		fmt.Fprintln(w, "\nServers:")
+		tw = tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "  NAME\tID\tFIXED IP\tFLOATING IP\tVOLUMES")
+		for _, s := range vm.Status.Servers {
+			volumes := append([]string{s.BootVolumeID}, s.DataVolumeIDs...)
+			fmt.Fprintf(tw, "  %s\t%s\t%s\t%s\t%s\n", s.Name, s.ID, orNone(s.FixedIP), orNone(s.FloatingIP), strings.Join(volumes, ","))
+		}
+		tw.Flush()
+	}
+
+	if len(vm.Status.HeatEvents) > 0 {
+		fmt.Fprintln(w, "\nFailed Resources:")
+		tw = tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "  TIME\tRESOURCE\tSTATUS\tREASON")
+		for _, e := range vm.Status.HeatEvents {
+			fmt.Fprintf(tw, "  %s\t%s\t%s\t%s\n", e.Time.Format("2006-01-02 15:04:05"), e.Resource, e.Status, e.Reason)
+		}
+		tw.Flush()
+	}
+}
+
+// writeEvents writes the heat events, oldest first
+func writeEvents(w io.Writer, events []stackevents.Event) {
+	fmt.Fprintln(w, "Events:")
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "  TIME\tRESOURCE\tSTATUS\tREASON")
+	for _, e := range events {
+		fmt.Fprintf(tw, "  %s\t%s\t%s\t%s\n", e.Time.Format("2006-01-02 15:04:05"), e.ResourceName, e.ResourceStatus, e.ResourceStatusReason)
+	}
+	tw.Flush()
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "<none>"
+	}
+	return s
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gophercloud/gophercloud/openstack/orchestration/v1/stacks"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	fakecli "sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	vmv1 "easystack.io/vm-operator/pkg/api/v1"
+	"easystack.io/vm-operator/pkg/openstack"
+	"easystack.io/vm-operator/pkg/openstack/fake"
+	vmtpl "easystack.io/vm-operator/pkg/templates"
+	"easystack.io/vm-operator/pkg/utils"
+)
+
+const (
+	sampleVM  = "../../config/samples/mixapp_v1_virtualmachine.yaml"
+	projectID = "8e5eda4cac9f460ea2b471a357c42dd0"
+)
+
+func newGlobals(objs ...runtime.Object) (*globals, *bytes.Buffer) {
+	scheme := runtime.NewScheme()
+	_ = corev1.AddToScheme(scheme)
+	_ = vmv1.AddToScheme(scheme)
+	out := &bytes.Buffer{}
+	return &globals{
+		namespace: "default",
+		out:       out,
+		ctx:       utils.WithLogger(context.Background(), log.NullLogger{}),
+		client:    fakecli.NewFakeClientWithScheme(scheme, objs...),
+	}, out
+}
+
+func TestRender(t *testing.T) {
+	g, out := newGlobals()
+	if err := runRender(g, []string{"-f", sampleVM}); err != nil {
+		t.Fatalf("render failed: %v", err)
+	}
+	for _, want := range []string{"# digest: sha256:", "# " + vmtpl.RootTemplate + "\nheat_template_version", "admin_pass: " + vmtpl.Redacted} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("expected output to contain %q", want)
+		}
+	}
+
+	dir, err := ioutil.TempDir("", "vmctl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := runRender(g, []string{"-f", sampleVM, "-o", dir}); err != nil {
+		t.Fatalf("render -o failed: %v", err)
+	}
+	for _, name := range []string{vmtpl.RootTemplate, parametersFile} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("expected %s to be written: %v", name, err)
+		}
+	}
+}
+
+func TestRenderTemplate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "vmctl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	vm, err := ioutil.ReadFile(sampleVM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vm = bytes.Replace(vm, []byte("spec:\n"), []byte("spec:\n  template:\n    name: web\n    parameters:\n      http_port: \"8080\"\n"), 1)
+	vmFile := filepath.Join(dir, "vm.yaml")
+	if err := ioutil.WriteFile(vmFile, vm, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	g, out := newGlobals()
+	if err := runRender(g, []string{"-f", vmFile}); err == nil || !strings.Contains(err.Error(), "not given") {
+		t.Fatalf("expected the missing template to be reported, got %v", err)
+	}
+
+	params, err := vmtpl.BuildParameters(&vmv1.VirtualMachineSpec{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := "heat_template_version: 2016-10-14\nparameters:\n  http_port: {type: number}\n"
+	for name := range params.Heat {
+		root += "  " + name + ": {type: string}\n"
+	}
+	vmt := "apiVersion: mixapp.easystack.io/v1\nkind: VirtualMachineTemplate\nmetadata:\n  name: web\nspec:\n" +
+		"  version: \"1.0\"\n  parameters:\n  - name: http_port\n    type: number\n  templates:\n    vm_group.yaml: |\n" +
+		"      " + strings.Replace(strings.TrimSuffix(root, "\n"), "\n", "\n      ", -1) + "\n"
+	vmtFile := filepath.Join(dir, "vmt.yaml")
+	if err := ioutil.WriteFile(vmtFile, []byte(vmt), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := runRender(g, []string{"-f", vmFile, "-template", vmtFile}); err != nil {
+		t.Fatalf("render failed: %v", err)
+	}
+	if !strings.Contains(out.String(), "http_port: 8080") {
+		t.Errorf("expected the parameter of the template in the output:\n%s", out)
+	}
+}
+
+func TestDiffLines(t *testing.T) {
+	cases := []struct {
+		name string
+		a    []string
+		b    []string
+		want []string
+	}{
+		{
+			name: "equal",
+			a:    []string{"a", "b"},
+			b:    []string{"a", "b"},
+			want: []string{" a", " b"},
+		},
+		{
+			name: "changed",
+			a:    []string{"a", "b", "c"},
+			b:    []string{"a", "x", "c"},
+			want: []string{" a", "-b", "+x", " c"},
+		},
+		{
+			name: "added and removed",
+			a:    []string{"a", "b"},
+			b:    []string{"b", "c"},
+			want: []string{"-a", " b", "+c"},
+		},
+		{
+			name: "empty",
+			b:    []string{"a"},
+			want: []string{"+a"},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got := diffLines(c.a, c.b)
+			if strings.Join(got, "\n") != strings.Join(c.want, "\n") {
+				t.Errorf("expected %q, got %q", c.want, got)
+			}
+		})
+	}
+}
+
+// createStack creates the stack of vm in the fake heat from the embedded
+// templates, like the operator does, and sets its stack ID
+func createStack(t *testing.T, server *fake.Server, vm *vmv1.VirtualMachine) {
+	set, err := vmtpl.Load("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rendered, params, err := renderVM(vm, set, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := rendered[vmtpl.RootTemplate]
+	delete(rendered, vmtpl.RootTemplate)
+
+	oss := openstack.NewProjectOSService(server.IdentityEndpoint())
+	ctx := utils.WithLogger(context.Background(), log.NullLogger{})
+	if err := oss.Authenticate(ctx, projectID, &openstack.UserCredential{Token: vm.Spec.Project.Token}); err != nil {
+		t.Fatal(err)
+	}
+	vm.Status.StackID, err = oss.StackCreate(ctx, projectID, &stacks.CreateOpts{
+		Name:         vm.Name,
+		TemplateOpts: &stacks.Template{TE: stacks.TE{Bin: []byte(root), Files: rendered}},
+		Parameters:   params,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func sampleVirtualMachine(t *testing.T) *vmv1.VirtualMachine {
+	vms, _, err := readObjects(sampleVM)
+	if err != nil || len(vms) != 1 {
+		t.Fatalf("failed to read %s: %v", sampleVM, err)
+	}
+	vm := &vms[0]
+	vm.Namespace = "default"
+	vm.Spec.Project.CredentialsSecretRef = nil
+	vm.Spec.Project.Token = "token-a"
+	return vm
+}
+
+func TestDiffAndStatus(t *testing.T) {
+	server := fake.NewServer(fake.NewHeat(0))
+	defer server.Close()
+	server.AddToken("token-a", projectID)
+
+	vm := sampleVirtualMachine(t)
+	createStack(t, server, vm)
+	g, out := newGlobals(vm)
+	g.authURL = server.IdentityEndpoint()
+
+	if err := runDiff(g, []string{vm.Name}); err != nil {
+		t.Fatalf("diff failed: %v", err)
+	}
+	if strings.Contains(out.String(), "+++") {
+		t.Errorf("expected no differences:\n%s", out)
+	}
+
+	vm.Spec.Server.Flavor = "2-1024-20"
+	if err := g.client.Update(g.ctx, vm); err != nil {
+		t.Fatal(err)
+	}
+	out.Reset()
+	if err := runDiff(g, []string{vm.Name}); err != nil {
+		t.Fatalf("diff failed: %v", err)
+	}
+	for _, want := range []string{"-flavor: 1-512-20\n", "+flavor: 2-1024-20\n"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("expected diff to contain %q:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out.String(), "admin_pass") {
+		t.Errorf("expected the hidden admin_pass to be skipped:\n%s", out)
+	}
+
+	out.Reset()
+	if err := runStatus(g, []string{vm.Name, "-events", "1"}); err != nil {
+		t.Fatalf("status failed: %v", err)
+	}
+	if !strings.Contains(out.String(), openstack.S_CREATE_COMPLETE) {
+		t.Errorf("expected the last event in status:\n%s", out)
+	}
+}
+
+func TestRequestAction(t *testing.T) {
+	vm := sampleVirtualMachine(t)
+	g, _ := newGlobals(vm)
+
+	if err := runReboot(g, []string{vm.Name, "-hard", "-server", "test-app-0"}); err != nil {
+		t.Fatalf("reboot failed: %v", err)
+	}
+	if err := runRebuild(g, []string{vm.Name}); err == nil {
+		t.Error("expected a second action to be rejected while the first is pending")
+	}
+
+	latest := &vmv1.VirtualMachine{}
+	if err := g.client.Get(g.ctx, types.NamespacedName{Namespace: vm.Namespace, Name: vm.Name}, latest); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		vmv1.ActionAnnotation:        vmv1.ActionHardReboot,
+		vmv1.ActionServersAnnotation: "test-app-0",
+	}
+	for k, v := range want {
+		if latest.Annotations[k] != v {
+			t.Errorf("expected annotation %s=%s, got %q", k, v, latest.Annotations[k])
+		}
+	}
+
+	if err := runResize(g, []string{vm.Name, "2-1024-20"}); err != nil {
+		t.Fatalf("resize failed: %v", err)
+	}
+	if err := g.client.Get(g.ctx, types.NamespacedName{Namespace: vm.Namespace, Name: vm.Name}, latest); err != nil {
+		t.Fatal(err)
+	}
+	if latest.Spec.Server.Flavor != "2-1024-20" {
+		t.Errorf("expected flavor 2-1024-20, got %s", latest.Spec.Server.Flavor)
+	}
+}
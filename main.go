@@ -17,8 +17,10 @@ limitations under the License.
 package main
 
 import (
+	"errors"
 	"flag"
 	"os"
+	"time"
 
 	"k8s.io/apimachinery/pkg/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
@@ -29,6 +31,7 @@ import (
 	mixappv1 "easystack.io/vm-operator/pkg/api/v1"
 	"easystack.io/vm-operator/pkg/controllers"
 	osservice "easystack.io/vm-operator/pkg/openstack"
+	vmtpl "easystack.io/vm-operator/pkg/templates"
 )
 
 var (
@@ -48,27 +51,49 @@ func main() {
 	var enableLeaderElection bool
 	var configDir string
 	var pollingPeriod int
+	var resyncPeriod int
+	var enableWebhooks bool
+	var defaultsConfig string
+	var orphanPeriod int
+	var orphanGracePeriod int
+	var deleteOrphans bool
+	var clusterID string
 
 	flag.BoolVar(&enableLeaderElection, "enable-leader-election", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
 	flag.StringVar(&metricsAddr, "metrics-addr", "127.0.0.1:9446", "The address the metric endpoint binds to.")
-	flag.StringVar(&configDir, "config-dir", "/etc/vm-operator", "Operator config dir")
-	flag.IntVar(&pollingPeriod, "polling-period", 5, "Polling period of vm status.")
+	flag.StringVar(&configDir, "config-dir", "/etc/vm-operator", "Operator config dir, its *.tpl files override the embedded heat templates of the same name.")
+	flag.IntVar(&pollingPeriod, "polling-period", 5, "Initial polling period in seconds of vm in progress, doubled on each poll.")
+	flag.IntVar(&resyncPeriod, "resync-period", 600, "Period in seconds of resyncing all vm status in one batch, 0 to disable.")
+	flag.BoolVar(&enableWebhooks, "enable-webhooks", true, "Serve the admission webhooks, disable when running out of cluster without serving certs.")
+	flag.StringVar(&defaultsConfig, "defaults-config", "", "Path of the config of VirtualMachine spec defaults, per cluster and per namespace.")
+	flag.IntVar(&orphanPeriod, "orphan-period", 600, "Period in seconds of looking for tagged stacks without VirtualMachine, 0 to disable.")
+	flag.IntVar(&orphanGracePeriod, "orphan-grace-period", 3600, "Seconds a stack stays orphaned before it's deleted.")
+	flag.BoolVar(&deleteOrphans, "delete-orphans", false, "Delete orphan stacks after the grace period, they're only reported otherwise. Requires -cluster-id.")
+	flag.StringVar(&clusterID, "cluster-id", "", "Id of this cluster recorded in the tags of its stacks, only the stacks of this cluster are collected as orphans.")
 	flag.Parse()
 
 	ctrl.SetLogger(zap.New(zap.UseDevMode(true)))
 
-	oss, err := osservice.NewOSService(configDir, ctrl.Log.WithName("VM"))
+	// without cluster id the stacks of other clusters sharing the cloud can't
+	// be told apart
+	if deleteOrphans && clusterID == "" {
+		setupLog.Error(errors.New("-cluster-id is not set"), "unable to delete orphan stacks")
+		os.Exit(1)
+	}
+
+	svc, err := osservice.NewOSService(configDir, ctrl.Log.WithName("VM"))
 	if err != nil {
 		setupLog.Error(err, "unable to init openstack service")
 		os.Exit(1)
 	}
+	oss := osservice.WithMetrics(svc)
 
 	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
 		Scheme:             scheme,
 		MetricsBindAddress: metricsAddr,
-		Port:               9446,
+		Port:               9443,
 		LeaderElection:     enableLeaderElection,
 	})
 	if err != nil {
@@ -76,7 +101,15 @@ func main() {
 		os.Exit(1)
 	}
 
-	vm := controllers.NewVirtualMachine(mgr.GetClient(), mgr.GetAPIReader(), ctrl.Log.WithName("VM"), oss, pollingPeriod)
+	templates, err := vmtpl.Load(configDir)
+	if err != nil {
+		setupLog.Error(err, "unable to load heat templates")
+		os.Exit(1)
+	}
+	setupLog.Info("loaded heat templates", "source", templates.Source, "version", templates.Version, "overridden", templates.Overridden)
+
+	vm := controllers.NewVirtualMachine(mgr.GetClient(), mgr.GetAPIReader(), mgr.GetEventRecorderFor("vm-operator"), ctrl.Log.WithName("VM"), oss, templates, pollingPeriod)
+	vm.ClusterID = clusterID
 	// init vm cache from crd info
 	err = vm.InitVmCacheFromCRD()
 	if err != nil {
@@ -84,14 +117,40 @@ func main() {
 		os.Exit(1)
 	}
 
-	// periodically polling
-	go vm.PollingVmInfo()
+	// periodically resync as safety net of the per vm polling
+	if resyncPeriod > 0 {
+		if err = mgr.Add(controllers.NewVmResync(vm, time.Duration(resyncPeriod)*time.Second)); err != nil {
+			setupLog.Error(err, "unable to add vm resync")
+			os.Exit(1)
+		}
+	}
 
 	if err = vm.SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "VirtualMachine")
 		os.Exit(1)
 	}
 
+	// stacks are only deleted by the leader
+	if orphanPeriod > 0 {
+		gc := controllers.NewOrphanCollector(mgr.GetAPIReader(), mgr.GetEventRecorderFor("vm-operator"), ctrl.Log.WithName("OrphanStacks"), oss,
+			time.Duration(orphanPeriod)*time.Second, time.Duration(orphanGracePeriod)*time.Second, !deleteOrphans, clusterID)
+		if err = mgr.Add(gc); err != nil {
+			setupLog.Error(err, "unable to add orphan stack collector")
+			os.Exit(1)
+		}
+	}
+
+	if enableWebhooks {
+		defaults, err := mixappv1.LoadDefaultsConfig(defaultsConfig)
+		if err != nil {
+			setupLog.Error(err, "unable to load defaults config")
+			os.Exit(1)
+		}
+		if err = (&mixappv1.VirtualMachine{}).SetupWebhookWithManager(mgr, defaults); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "VirtualMachine")
+			os.Exit(1)
+		}
+	}
 	// +kubebuilder:scaffold:builder
 
 	setupLog.Info("starting manager")
@@ -0,0 +1,165 @@
+/*
+Copyright 2020 easystack.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"gopkg.in/yaml.v2"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+// SpecDefaults are the values filled into the empty fields of a VirtualMachine spec
+// +kubebuilder:object:generate=false
+type SpecDefaults struct {
+	Server  ServerDefaults  `yaml:"server,omitempty"`
+	Network NetworkDefaults `yaml:"network,omitempty"`
+	Volume  VolumeDefaults  `yaml:"volume,omitempty"`
+}
+
+// +kubebuilder:object:generate=false
+type ServerDefaults struct {
+	AvailableZone  string `yaml:"availability_zone,omitempty"`
+	KeyName        string `yaml:"key_name,omitempty"`
+	SecurityGroup  string `yaml:"security_group,omitempty"`
+	BootVolumeType string `yaml:"boot_volume_type,omitempty"`
+}
+
+// +kubebuilder:object:generate=false
+type NetworkDefaults struct {
+	// ExternalNetwork is only filled when floating ip is enabled
+	ExternalNetwork string `yaml:"external_network,omitempty"`
+}
+
+// +kubebuilder:object:generate=false
+type VolumeDefaults struct {
+	VolumeType string `yaml:"volume_type,omitempty"`
+}
+
+// DefaultsConfig is the operator config of spec defaults, the defaults of a
+// namespace override the cluster ones field by field.
+// +kubebuilder:object:generate=false
+type DefaultsConfig struct {
+	SpecDefaults `yaml:",inline"`
+	Namespaces   map[string]SpecDefaults `yaml:"namespaces,omitempty"`
+}
+
+// LoadDefaultsConfig reads the defaults config from path, an empty path means
+// no defaults
+func LoadDefaultsConfig(path string) (*DefaultsConfig, error) {
+	config := &DefaultsConfig{}
+	if path == "" {
+		return config, nil
+	}
+
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := yaml.UnmarshalStrict(raw, config); err != nil {
+		return nil, fmt.Errorf("failed to parse defaults config %s: %v", path, err)
+	}
+	return config, nil
+}
+
+// For returns the defaults of namespace
+func (c *DefaultsConfig) For(namespace string) SpecDefaults {
+	d := c.SpecDefaults
+	ns, ok := c.Namespaces[namespace]
+	if !ok {
+		return d
+	}
+
+	override(&d.Server.AvailableZone, ns.Server.AvailableZone)
+	override(&d.Server.KeyName, ns.Server.KeyName)
+	override(&d.Server.SecurityGroup, ns.Server.SecurityGroup)
+	override(&d.Server.BootVolumeType, ns.Server.BootVolumeType)
+	override(&d.Network.ExternalNetwork, ns.Network.ExternalNetwork)
+	override(&d.Volume.VolumeType, ns.Volume.VolumeType)
+	return d
+}
+
+// Apply fills the empty fields of spec with the defaults
+func (d *SpecDefaults) Apply(spec *VirtualMachineSpec) {
+	fill(&spec.Server.AvailableZone, d.Server.AvailableZone)
+	fill(&spec.Server.KeyName, d.Server.KeyName)
+	fill(&spec.Server.SecurityGroup, d.Server.SecurityGroup)
+	fill(&spec.Server.BootVolumeType, d.Server.BootVolumeType)
+	if spec.Network.FloatingIp == FloatingIpEnable {
+		fill(&spec.Network.ExternalNetwork, d.Network.ExternalNetwork)
+	}
+	for i := range spec.Volume {
+		fill(&spec.Volume[i].VolumeType, d.Volume.VolumeType)
+	}
+}
+
+func override(dst *string, src string) {
+	if src != "" {
+		*dst = src
+	}
+}
+
+func fill(dst *string, src string) {
+	if *dst == "" {
+		*dst = src
+	}
+}
+
+// +kubebuilder:webhook:verbs=create,path=/mutate-mixapp-easystack-io-v1-virtualmachine,mutating=true,failurePolicy=fail,groups=mixapp.easystack.io,resources=virtualmachines,versions=v1,name=mvirtualmachine.kb.io
+
+const mutatePath = "/mutate-mixapp-easystack-io-v1-virtualmachine"
+
+// virtualMachineDefaulter records the defaults of its namespace in a
+// VirtualMachine, so the spec holds the effective values passed to heat. It
+// only applies to creations, a changed default never updates existing stacks.
+// +kubebuilder:object:generate=false
+type virtualMachineDefaulter struct {
+	config  *DefaultsConfig
+	decoder *admission.Decoder
+}
+
+var _ admission.DecoderInjector = &virtualMachineDefaulter{}
+
+func (d *virtualMachineDefaulter) Handle(ctx context.Context, req admission.Request) admission.Response {
+	if req.Operation != admissionv1beta1.Create {
+		return admission.Allowed("defaults are only applied on creation")
+	}
+	vm := &VirtualMachine{}
+	if err := d.decoder.Decode(req, vm); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+	virtualmachinelog.Info("default", "name", vm.Name)
+
+	defaults := d.config.For(req.Namespace)
+	defaults.Apply(&vm.Spec)
+
+	marshaled, err := json.Marshal(vm)
+	if err != nil {
+		return admission.Errored(http.StatusInternalServerError, err)
+	}
+	return admission.PatchResponseFromRaw(req.Object.Raw, marshaled)
+}
+
+func (d *virtualMachineDefaulter) InjectDecoder(decoder *admission.Decoder) error {
+	d.decoder = decoder
+	return nil
+}
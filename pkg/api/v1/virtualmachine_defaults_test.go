@@ -0,0 +1,187 @@
+/*
+Copyright 2020 easystack.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+const defaultsYaml = `
+server:
+  availability_zone: nova
+  key_name: ops
+  security_group: default
+  boot_volume_type: hdd
+network:
+  external_network: public_net
+volume:
+  volume_type: hdd
+namespaces:
+  team-a:
+    server:
+      availability_zone: az-a
+    volume:
+      volume_type: ssd
+`
+
+func loadDefaults(t *testing.T, content string) (*DefaultsConfig, error) {
+	dir, err := ioutil.TempDir("", "defaults")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "defaults.yaml")
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return LoadDefaultsConfig(path)
+}
+
+func TestLoadDefaultsConfig(t *testing.T) {
+	config, err := loadDefaults(t, defaultsYaml)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	cluster := config.For("default")
+	if cluster.Server.AvailableZone != "nova" || cluster.Volume.VolumeType != "hdd" {
+		t.Errorf("expected cluster defaults, got %+v", cluster)
+	}
+	teamA := config.For("team-a")
+	if teamA.Server.AvailableZone != "az-a" || teamA.Volume.VolumeType != "ssd" {
+		t.Errorf("expected namespace overrides, got %+v", teamA)
+	}
+	if teamA.Server.KeyName != "ops" || teamA.Network.ExternalNetwork != "public_net" {
+		t.Errorf("expected cluster defaults for fields not overridden, got %+v", teamA)
+	}
+
+	if _, err := loadDefaults(t, "server:\n  flavor: large\n"); err == nil {
+		t.Error("expected unknown fields to be rejected")
+	}
+	if config, err := LoadDefaultsConfig(""); err != nil || config.For("default") != (SpecDefaults{}) {
+		t.Errorf("expected no defaults without a config, got %+v, %v", config, err)
+	}
+}
+
+func TestApplyDefaults(t *testing.T) {
+	config, err := loadDefaults(t, defaultsYaml)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defaults := config.For("default")
+
+	vm := validVM()
+	vm.Spec.Server.KeyName = "mine"
+	vm.Spec.Volume = append(vm.Spec.Volume, VolumeSpec{VolumeName: "log", VolumeType: "ssd"})
+	defaults.Apply(&vm.Spec)
+
+	server := vm.Spec.Server
+	if server.AvailableZone != "nova" || server.SecurityGroup != "default" || server.BootVolumeType != "hdd" {
+		t.Errorf("expected empty server fields to be defaulted, got %+v", server)
+	}
+	if server.KeyName != "mine" {
+		t.Errorf("expected key_name set by user to be kept, got %s", server.KeyName)
+	}
+	if vm.Spec.Network.ExternalNetwork != "public_net" {
+		t.Errorf("expected external_network to be defaulted, got %q", vm.Spec.Network.ExternalNetwork)
+	}
+	if vm.Spec.Volume[0].VolumeType != "hdd" || vm.Spec.Volume[1].VolumeType != "ssd" {
+		t.Errorf("expected only empty volume types to be defaulted, got %+v", vm.Spec.Volume)
+	}
+
+	vm = validVM()
+	vm.Spec.Network.FloatingIp = ""
+	defaults.Apply(&vm.Spec)
+	if vm.Spec.Network.ExternalNetwork != "" {
+		t.Errorf("expected no external_network without floating ip, got %q", vm.Spec.Network.ExternalNetwork)
+	}
+}
+
+func TestDefaulterHandle(t *testing.T) {
+	config, err := loadDefaults(t, defaultsYaml)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	scheme := runtime.NewScheme()
+	if err := AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+	decoder, err := admission.NewDecoder(scheme)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defaulter := &virtualMachineDefaulter{config: config}
+	if err := defaulter.InjectDecoder(decoder); err != nil {
+		t.Fatal(err)
+	}
+
+	vm := validVM()
+	vm.Namespace = "team-a"
+	raw, err := json.Marshal(vm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := defaulter.Handle(context.Background(), admission.Request{
+		AdmissionRequest: admissionv1beta1.AdmissionRequest{
+			Namespace: "team-a",
+			Operation: admissionv1beta1.Create,
+			Object:    runtime.RawExtension{Raw: raw},
+		},
+	})
+	if !resp.Allowed {
+		t.Fatalf("expected the request to be allowed, got %+v", resp.Result)
+	}
+
+	patched := make(map[string]string)
+	for _, p := range resp.Patches {
+		if s, ok := p.Value.(string); ok {
+			patched[p.Path] = s
+		}
+	}
+	want := map[string]string{
+		"/spec/server/availability_zone": "az-a",
+		"/spec/server/key_name":          "ops",
+		"/spec/volume/0/volume_type":     "ssd",
+	}
+	for path, value := range want {
+		if patched[path] != value {
+			t.Errorf("expected %s to be patched to %s, got patches %+v", path, value, resp.Patches)
+		}
+	}
+
+	// an update keeps the spec as it is
+	resp = defaulter.Handle(context.Background(), admission.Request{
+		AdmissionRequest: admissionv1beta1.AdmissionRequest{
+			Namespace: "team-a",
+			Operation: admissionv1beta1.Update,
+			Object:    runtime.RawExtension{Raw: raw},
+		},
+	})
+	if !resp.Allowed || len(resp.Patches) != 0 {
+		t.Errorf("expected an update to be allowed unchanged, got %+v", resp)
+	}
+}
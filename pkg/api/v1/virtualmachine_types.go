@@ -30,62 +30,204 @@ const (
 	Failed                      = "Failed"
 )
 
-// VirtualMachineSpec defines the desired state of VirtualMachine
+// Server actions are requested by annotating a VirtualMachine, the controller
+// runs the action once its stack is complete and removes the annotations.
+const (
+	// ActionAnnotation is the action to run on the servers of the stack
+	ActionAnnotation = "mixapp.easystack.io/action"
+	// ActionServersAnnotation restricts the action to the comma separated
+	// names of servers, all servers of the stack are acted on without it
+	ActionServersAnnotation = "mixapp.easystack.io/action-servers"
+
+	// ActionReboot asks the OS of the servers to restart
+	ActionReboot = "reboot"
+	// ActionHardReboot cuts the power of the servers
+	ActionHardReboot = "hard-reboot"
+	// ActionRebuild reinstalls the servers from spec.server.image, which
+	// must be the id of an image. The boot volume of servers booting from a
+	// volume is reimaged, which needs nova 2.93 (Zed).
+	ActionRebuild = "rebuild"
+)
+
+// AdoptAnnotation binds a new VirtualMachine to the existing stack with this
+// name or id of its project instead of creating one, like spec.stackID
+const AdoptAnnotation = "mixapp.easystack.io/adopt-stack"
+
+// VirtualMachineSpec defines the desired state of VirtualMachine. The heat tags
+// map its fields to the parameters of the stack, see templates.BuildParameters.
 type VirtualMachineSpec struct {
-	Project        ProjectSpec       `json:"project,omitempty"`
-	Server         ServerSpec        `json:"server,omitempty"`
-	Network        NetworkSpec       `json:"network,omitempty"`
-	Volume         []VolumeSpec      `json:"volume,omitempty"`
-	SoftwareConfig []byte            `json:"softwareConfig,omitempty"`
-	AssemblyPhase  AssemblyPhaseType `json:"assemblyPhase,omitempty"`
-	StackID        string            `json:"stackID,omitempty"`
-	HeatEvent      []string          `json:"heatEvent,omitempty"`
+	Project        ProjectSpec  `json:"project,omitempty" heat:"-"`
+	Server         ServerSpec   `json:"server,omitempty" heat:",inline"`
+	Network        NetworkSpec  `json:"network,omitempty" heat:",inline"`
+	Volume         []VolumeSpec `json:"volume,omitempty" heat:"volume,list"`
+	SoftwareConfig []byte       `json:"softwareConfig,omitempty" heat:"softwareConfig,context"`
+	// StackID adopts the existing stack with this id of the project instead
+	// of creating one, the stack is managed and deleted like a created one
+	StackID string `json:"stackID,omitempty" heat:"-"`
+	// HeatEvent is not used, the failures of the stack are in
+	// Status.HeatEvents
+	HeatEvent []string `json:"heatEvent,omitempty" heat:"-"`
+	// Template selects the templates of the stack, the templates of the
+	// operator are used when it's not set
+	Template *TemplateReference `json:"template,omitempty" heat:"-"`
+	// DryRun renders the stack into a ConfigMap for review instead of
+	// creating or updating it
+	DryRun *DryRunSpec `json:"dryRun,omitempty" heat:"-"`
+}
+
+// DryRunSpec configures the dry run of a VirtualMachine
+type DryRunSpec struct {
+	// Preview asks heat to validate the stack and list its resources, it
+	// requires the credential of the project
+	Preview bool `json:"preview,omitempty"`
+}
+
+// TemplateReference selects a VirtualMachineTemplate in the namespace of the
+// VirtualMachine
+type TemplateReference struct {
+	Name string `json:"name"`
+	// Version must match the version of the template, any version matches
+	// when it's not set
+	Version string `json:"version,omitempty"`
+	// Parameters are the values of the parameters declared by the template
+	Parameters map[string]string `json:"parameters,omitempty"`
 }
 
 type ProjectSpec struct {
 	ProjectID string `json:"projectID,omitempty"`
-	Token     string `json:"token,omitempty"`
+	// Deprecated: keystone token expires, use CredentialsSecretRef instead
+	Token                string     `json:"token,omitempty"`
+	CredentialsSecretRef *SecretRef `json:"credentialsSecretRef,omitempty"`
+}
+
+// SecretRef references a secret in the namespace of the VirtualMachine, holding
+// an application credential, a username/password or a clouds.yaml
+type SecretRef struct {
+	Name string `json:"name"`
+	// Cloud selects the entry of clouds.yaml in the secret
+	Cloud string `json:"cloud,omitempty"`
 }
 
 type ServerSpec struct {
-	Replicas       int32  `json:"replicas,omitempty"`
-	NamePrefix     string `json:"name_prefix,omitempty"`
-	Image          string `json:"image,omitempty"`
-	Flavor         string `json:"flavor,omitempty"`
-	AvailableZone  string `json:"availability_zone,omitempty"`
-	KeyName        string `json:"key_name,omitempty"`
-	AdminPass      string `json:"admin_pass,omitempty"`
-	BootVolumeType string `json:"boot_volume_type,omitempty"`
-	BootVolumeSize string `json:"boot_volume_size,omitempty"`
-	SecurityGroup  string `json:"security_group,omitempty"`
+	Replicas       int32  `json:"replicas,omitempty" heat:"replicas"`
+	NamePrefix     string `json:"name_prefix,omitempty" heat:"name_prefix"`
+	Image          string `json:"image,omitempty" heat:"image"`
+	Flavor         string `json:"flavor,omitempty" heat:"flavor"`
+	AvailableZone  string `json:"availability_zone,omitempty" heat:"availability_zone"`
+	KeyName        string `json:"key_name,omitempty" heat:"key_name"`
+	AdminPass      string `json:"admin_pass,omitempty" heat:"admin_pass"`
+	BootVolumeType string `json:"boot_volume_type,omitempty" heat:"boot_volume_type"`
+	BootVolumeSize string `json:"boot_volume_size,omitempty" heat:"boot_volume_size"`
+	SecurityGroup  string `json:"security_group,omitempty" heat:"security_group"`
 }
 
 type NetworkSpec struct {
-	ExternalNetwork     string `json:"external_network,omitempty"`
-	ExistingNetwork     string `json:"existing_network,omitempty"`
-	ExistingSubnet      string `json:"existing_subnet,omitempty"`
-	PrivateNetworkCidr  string `json:"private_network_cidr,omitempty"`
-	PrivateNetworkName  string `json:"private_network_name,omitempty"`
-	NeutronAz           string `json:"neutron_az,omitempty"`
-	FloatingIp          string `json:"floating_ip,omitempty"`
-	FloatingIpBandwidth string `json:"floating_ip_bandwidth,omitempty"`
+	ExternalNetwork     string `json:"external_network,omitempty" heat:"external_network"`
+	ExistingNetwork     string `json:"existing_network,omitempty" heat:"existing_network"`
+	ExistingSubnet      string `json:"existing_subnet,omitempty" heat:"existing_subnet"`
+	PrivateNetworkCidr  string `json:"private_network_cidr,omitempty" heat:"private_network_cidr"`
+	PrivateNetworkName  string `json:"private_network_name,omitempty" heat:"private_network_name"`
+	NeutronAz           string `json:"neutron_az,omitempty" heat:"neutron_az"`
+	FloatingIp          string `json:"floating_ip,omitempty" heat:"floating_ip"`
+	FloatingIpBandwidth string `json:"floating_ip_bandwidth,omitempty" heat:"floating_ip_bandwidth"`
 }
 
 type VolumeSpec struct {
-	VolumeName string `json:"volume_name,omitempty"`
-	VolumeType string `json:"volume_type,omitempty"`
-	VolumeSize string `json:"volume_size,omitempty"`
+	VolumeName string `json:"volume_name,omitempty" heat:"name"`
+	VolumeType string `json:"volume_type,omitempty" heat:"type"`
+	VolumeSize string `json:"volume_size,omitempty" heat:"size"`
+}
+
+type ConditionType string
+
+const (
+	// StackReady means the heat stack reached a *_COMPLETE status
+	StackReady ConditionType = "StackReady"
+	// NetworkReady means the network of the stack is available
+	NetworkReady ConditionType = "NetworkReady"
+	// ServersReady means all servers of the stack are available
+	ServersReady ConditionType = "ServersReady"
+	// AuthExpired means keystone rejects the credential of the project, it's
+	// unknown while the credential can't be read or keystone can't be reached
+	AuthExpired ConditionType = "AuthExpired"
+	// TemplateReady means the templates of the stack have been rendered
+	TemplateReady ConditionType = "TemplateReady"
+	// ActionCompleted means the last server action requested by annotation
+	// has been triggered on all its servers
+	ActionCompleted ConditionType = "ActionCompleted"
+	// StackAdopted means the VirtualMachine was bound to an existing stack
+	StackAdopted ConditionType = "StackAdopted"
+)
+
+// Condition follows the shape of the upstream metav1.Condition
+type Condition struct {
+	Type               ConditionType          `json:"type"`
+	Status             metav1.ConditionStatus `json:"status"`
+	ObservedGeneration int64                  `json:"observedGeneration,omitempty"`
+	LastTransitionTime metav1.Time            `json:"lastTransitionTime,omitempty"`
+	Reason             string                 `json:"reason,omitempty"`
+	Message            string                 `json:"message,omitempty"`
+}
+
+// ServerStatus is the detail of one server of the stack
+type ServerStatus struct {
+	ID            string   `json:"id,omitempty"`
+	Name          string   `json:"name,omitempty"`
+	FixedIP       string   `json:"fixedIP,omitempty"`
+	FloatingIP    string   `json:"floatingIP,omitempty"`
+	BootVolumeID  string   `json:"bootVolumeID,omitempty"`
+	DataVolumeIDs []string `json:"dataVolumeIDs,omitempty"`
+}
+
+// HeatEvent is the failure of a resource of the stack reported by heat
+type HeatEvent struct {
+	// ID is the id of the heat event
+	ID       string      `json:"id"`
+	Time     metav1.Time `json:"time,omitempty"`
+	Resource string      `json:"resource,omitempty"`
+	Status   string      `json:"status,omitempty"`
+	Reason   string      `json:"reason,omitempty"`
+}
+
+// DryRunStatus tells where the rendered stack of a dry run is
+type DryRunStatus struct {
+	// ConfigMap holds the rendered templates, the parameters and the preview
+	// of heat, in the namespace of the VirtualMachine
+	ConfigMap string `json:"configMap,omitempty"`
+	// Digest is the sha256 of what heat would receive, secrets excluded
+	Digest             string `json:"digest,omitempty"`
+	ObservedGeneration int64  `json:"observedGeneration,omitempty"`
 }
 
 // VirtualMachineStatus defines the observed state of VirtualMachine
 type VirtualMachineStatus struct {
-	// INSERT ADDITIONAL STATUS FIELD - define observed state of cluster
-	// Important: Run "make" to regenerate code after modifying this file
-	StackID  string `json:"stackID,omitempty"`
-	VmStatus string `json:"vmStatus,omitempty"`
+	Phase              AssemblyPhaseType `json:"phase,omitempty"`
+	ObservedGeneration int64             `json:"observedGeneration,omitempty"`
+	StackID            string            `json:"stackID,omitempty"`
+	// StackName is the name of the stack, see VirtualMachine.StackName
+	StackName  string      `json:"stackName,omitempty"`
+	VmStatus   string      `json:"vmStatus,omitempty"`
+	LastError  string      `json:"lastError,omitempty"`
+	Conditions []Condition `json:"conditions,omitempty"`
+	// outputs of the heat stack
+	Network string         `json:"network,omitempty"`
+	Subnet  string         `json:"subnet,omitempty"`
+	Servers []ServerStatus `json:"servers,omitempty"`
+	// HeatEvents are the latest failures of resources of the stack, oldest
+	// first
+	HeatEvents []HeatEvent `json:"heatEvents,omitempty"`
+	// LastHeatEventTime is the time of the latest failure recorded, earlier
+	// ones were already reported even if they're no longer in HeatEvents
+	LastHeatEventTime *metav1.Time `json:"lastHeatEventTime,omitempty"`
+	// DryRun is set by the last dry run
+	DryRun *DryRunStatus `json:"dryRun,omitempty"`
 }
 
 // +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+// +kubebuilder:printcolumn:name="Phase",type="string",JSONPath=".status.phase"
+// +kubebuilder:printcolumn:name="Stack Status",type="string",JSONPath=".status.vmStatus"
+// +kubebuilder:printcolumn:name="Age",type="date",JSONPath=".metadata.creationTimestamp"
 
 // VirtualMachine is the Schema for the virtualmachines API
 type VirtualMachine struct {
@@ -96,6 +238,44 @@ type VirtualMachine struct {
 	Status VirtualMachineStatus `json:"status,omitempty"`
 }
 
+// maxStackNameLength is the longest stack name heat accepts
+const maxStackNameLength = 255
+
+// StackName returns the name of the stack of the VirtualMachine, the one in
+// its status or the name of the VirtualMachine for stacks created before
+// names were recorded. Without stack, it's the name a new stack gets.
+func (vm *VirtualMachine) StackName() string {
+	switch {
+	case vm.Status.StackName != "":
+		return vm.Status.StackName
+	case vm.Status.StackID != "":
+		return vm.Name
+	default:
+		return vm.newStackName()
+	}
+}
+
+// newStackName returns <namespace>-<name>-<uid prefix>, VirtualMachines of
+// the same name in other namespaces, or recreated ones, get other stacks
+func (vm *VirtualMachine) newStackName() string {
+	name := vm.Namespace + "-" + vm.Name
+	// heat stack names start with a letter, namespaces may start with a digit
+	if name[0] < 'a' || name[0] > 'z' {
+		name = "vm-" + name
+	}
+	uid := string(vm.UID)
+	if len(uid) > 8 {
+		uid = uid[:8]
+	}
+	if uid == "" {
+		return name
+	}
+	if len(name) > maxStackNameLength-len(uid)-1 {
+		name = name[:maxStackNameLength-len(uid)-1]
+	}
+	return name + "-" + uid
+}
+
 // +kubebuilder:object:root=true
 
 // VirtualMachineList contains a list of VirtualMachine
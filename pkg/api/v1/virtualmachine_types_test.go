@@ -0,0 +1,66 @@
+/*
+Copyright 2020 easystack.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	"strings"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestStackName(t *testing.T) {
+	const uid = "4a3c7f1e-2b0d-4c59-9a1e-6f0c2d8b7e31"
+	cases := []struct {
+		name   string
+		vm     VirtualMachine
+		expect string
+	}{
+		{
+			name:   "new stack",
+			vm:     VirtualMachine{ObjectMeta: metav1.ObjectMeta{Namespace: "team-a", Name: "web", UID: uid}},
+			expect: "team-a-web-4a3c7f1e",
+		},
+		{
+			name:   "namespace starting with a digit",
+			vm:     VirtualMachine{ObjectMeta: metav1.ObjectMeta{Namespace: "2048", Name: "web", UID: uid}},
+			expect: "vm-2048-web-4a3c7f1e",
+		},
+		{
+			name:   "recorded",
+			vm:     VirtualMachine{ObjectMeta: metav1.ObjectMeta{Namespace: "team-a", Name: "web", UID: uid}, Status: VirtualMachineStatus{StackID: "id", StackName: "legacy-stack"}},
+			expect: "legacy-stack",
+		},
+		{
+			name:   "created before names were recorded",
+			vm:     VirtualMachine{ObjectMeta: metav1.ObjectMeta{Namespace: "team-a", Name: "web", UID: uid}, Status: VirtualMachineStatus{StackID: "id"}},
+			expect: "web",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := c.vm.StackName(); got != c.expect {
+				t.Errorf("expected %s, got %s", c.expect, got)
+			}
+		})
+	}
+
+	long := VirtualMachine{ObjectMeta: metav1.ObjectMeta{Namespace: "team-a", Name: strings.Repeat("a", 253), UID: uid}}
+	if got := long.StackName(); len(got) != maxStackNameLength || !strings.HasSuffix(got, "-4a3c7f1e") {
+		t.Errorf("expected a name of %d characters keeping the uid, got %s", maxStackNameLength, got)
+	}
+}
@@ -0,0 +1,238 @@
+/*
+Copyright 2020 easystack.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"strconv"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	ctrl "sigs.k8s.io/controller-runtime"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+)
+
+// FloatingIpEnable is the only value of floating_ip which allocates floating ips
+const FloatingIpEnable = "enable"
+
+const (
+	networkModeExisting = "existing"
+	networkModePrivate  = "private"
+)
+
+// log is for logging in this package.
+var virtualmachinelog = logf.Log.WithName("virtualmachine-resource")
+
+// SetupWebhookWithManager registers the validating webhook, and the defaulting
+// webhook filling specs from defaults
+func (r *VirtualMachine) SetupWebhookWithManager(mgr ctrl.Manager, defaults *DefaultsConfig) error {
+	mgr.GetWebhookServer().Register(mutatePath, &webhook.Admission{
+		Handler: &virtualMachineDefaulter{config: defaults},
+	})
+
+	return ctrl.NewWebhookManagedBy(mgr).
+		For(r).
+		Complete()
+}
+
+// +kubebuilder:webhook:verbs=create;update,path=/validate-mixapp-easystack-io-v1-virtualmachine,mutating=false,failurePolicy=fail,groups=mixapp.easystack.io,resources=virtualmachines,versions=v1,name=vvirtualmachine.kb.io
+
+var _ webhook.Validator = &VirtualMachine{}
+
+// ValidateCreate implements webhook.Validator so a webhook will be registered for the type
+func (r *VirtualMachine) ValidateCreate() error {
+	virtualmachinelog.Info("validate create", "name", r.Name)
+
+	allErrs := validateSpec(&r.Spec)
+	allErrs = append(allErrs, validateAction(r.Annotations)...)
+	allErrs = append(allErrs, validateAdopt(r.Annotations)...)
+	return r.toInvalid(allErrs)
+}
+
+// ValidateUpdate implements webhook.Validator so a webhook will be registered for the type
+func (r *VirtualMachine) ValidateUpdate(old runtime.Object) error {
+	virtualmachinelog.Info("validate update", "name", r.Name)
+
+	oldVM, ok := old.(*VirtualMachine)
+	if !ok {
+		return apierrors.NewBadRequest("old object is not a VirtualMachine")
+	}
+	allErrs := validateAction(r.Annotations)
+	// metadata only updates, e.g. removing the finalizer, must pass even if the
+	// spec was created before it was validated
+	if reflect.DeepEqual(r.Spec, oldVM.Spec) {
+		return r.toInvalid(allErrs)
+	}
+
+	allErrs = append(allErrs, validateSpec(&r.Spec)...)
+	allErrs = append(allErrs, validateImmutable(&r.Spec, &oldVM.Spec)...)
+	allErrs = append(allErrs, validateStackID(r.Spec.StackID, oldVM)...)
+	return r.toInvalid(allErrs)
+}
+
+// ValidateDelete implements webhook.Validator so a webhook will be registered for the type
+func (r *VirtualMachine) ValidateDelete() error {
+	return nil
+}
+
+func (r *VirtualMachine) toInvalid(allErrs field.ErrorList) error {
+	if len(allErrs) == 0 {
+		return nil
+	}
+	return apierrors.NewInvalid(GroupVersion.WithKind("VirtualMachine").GroupKind(), r.Name, allErrs)
+}
+
+// validateAction checks the server action requested by annotations
+func validateAction(annotations map[string]string) field.ErrorList {
+	action, ok := annotations[ActionAnnotation]
+	if !ok {
+		return nil
+	}
+	switch action {
+	case ActionReboot, ActionHardReboot, ActionRebuild:
+		return nil
+	}
+	path := field.NewPath("metadata", "annotations").Key(ActionAnnotation)
+	return field.ErrorList{field.NotSupported(path, action, []string{ActionReboot, ActionHardReboot, ActionRebuild})}
+}
+
+// validateAdopt checks the stack adopted by annotation is named
+func validateAdopt(annotations map[string]string) field.ErrorList {
+	if identity, ok := annotations[AdoptAnnotation]; ok && identity == "" {
+		path := field.NewPath("metadata", "annotations").Key(AdoptAnnotation)
+		return field.ErrorList{field.Required(path, "name or id of the stack to adopt")}
+	}
+	return nil
+}
+
+// validateStackID rejects binding a VirtualMachine which already has a stack
+// to another one, only new VirtualMachines adopt stacks
+func validateStackID(stackID string, old *VirtualMachine) field.ErrorList {
+	if stackID == "" || stackID == old.Spec.StackID || old.Status.StackID == "" || stackID == old.Status.StackID {
+		return nil
+	}
+	return field.ErrorList{field.Invalid(field.NewPath("spec", "stackID"), stackID,
+		fmt.Sprintf("the VirtualMachine already has stack %s", old.Status.StackID))}
+}
+
+func validateSpec(spec *VirtualMachineSpec) field.ErrorList {
+	var allErrs field.ErrorList
+	specPath := field.NewPath("spec")
+
+	allErrs = append(allErrs, validateProject(&spec.Project, specPath.Child("project"))...)
+	allErrs = append(allErrs, validateServer(&spec.Server, specPath.Child("server"))...)
+	allErrs = append(allErrs, validateNetwork(&spec.Network, specPath.Child("network"))...)
+	for i := range spec.Volume {
+		volPath := specPath.Child("volume").Index(i)
+		allErrs = append(allErrs, validateSize(spec.Volume[i].VolumeSize, volPath.Child("volume_size"))...)
+	}
+	if spec.Template != nil && spec.Template.Name == "" {
+		allErrs = append(allErrs, field.Required(specPath.Child("template", "name"), ""))
+	}
+
+	return allErrs
+}
+
+func validateProject(project *ProjectSpec, fldPath *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+
+	if project.ProjectID == "" {
+		allErrs = append(allErrs, field.Required(fldPath.Child("projectID"), ""))
+	}
+	if project.CredentialsSecretRef == nil && project.Token == "" {
+		allErrs = append(allErrs, field.Required(fldPath.Child("credentialsSecretRef"), "credentialsSecretRef or token must be set"))
+	}
+	if project.CredentialsSecretRef != nil && project.CredentialsSecretRef.Name == "" {
+		allErrs = append(allErrs, field.Required(fldPath.Child("credentialsSecretRef", "name"), ""))
+	}
+
+	return allErrs
+}
+
+func validateServer(server *ServerSpec, fldPath *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+
+	if server.Replicas < 0 {
+		allErrs = append(allErrs, field.Invalid(fldPath.Child("replicas"), server.Replicas, "must be greater than or equal to 0"))
+	}
+	allErrs = append(allErrs, validateSize(server.BootVolumeSize, fldPath.Child("boot_volume_size"))...)
+
+	return allErrs
+}
+
+// validateSize checks a volume size is a number of GB, heat rejects units
+// like "20G"
+func validateSize(size string, fldPath *field.Path) field.ErrorList {
+	if size == "" {
+		return nil
+	}
+	n, err := strconv.Atoi(size)
+	if err != nil {
+		return field.ErrorList{field.Invalid(fldPath, size, "must be a number of GB without unit, e.g. \"20\"")}
+	}
+	if n <= 0 {
+		return field.ErrorList{field.Invalid(fldPath, size, "must be greater than 0")}
+	}
+	return nil
+}
+
+func validateNetwork(network *NetworkSpec, fldPath *field.Path) field.ErrorList {
+	var allErrs field.ErrorList
+
+	if network.ExistingSubnet != "" && network.PrivateNetworkCidr != "" {
+		allErrs = append(allErrs, field.Forbidden(fldPath.Child("private_network_cidr"), "may not be set together with existing_subnet"))
+	}
+	if network.PrivateNetworkCidr != "" {
+		if _, _, err := net.ParseCIDR(network.PrivateNetworkCidr); err != nil {
+			allErrs = append(allErrs, field.Invalid(fldPath.Child("private_network_cidr"), network.PrivateNetworkCidr, "must be a valid CIDR, e.g. \"192.168.0.0/24\""))
+		}
+	}
+	if network.FloatingIp != "" && network.FloatingIp != FloatingIpEnable {
+		allErrs = append(allErrs, field.NotSupported(fldPath.Child("floating_ip"), network.FloatingIp, []string{FloatingIpEnable}))
+	}
+
+	return allErrs
+}
+
+// validateImmutable rejects changes the stack can't follow: the stack lives in
+// the project, and switching between an existing subnet and a private network
+// would replace every port of the servers.
+func validateImmutable(spec *VirtualMachineSpec, old *VirtualMachineSpec) field.ErrorList {
+	var allErrs field.ErrorList
+	specPath := field.NewPath("spec")
+
+	if spec.Project.ProjectID != old.Project.ProjectID {
+		allErrs = append(allErrs, field.Invalid(specPath.Child("project", "projectID"), spec.Project.ProjectID, "field is immutable"))
+	}
+	if networkMode(&spec.Network) != networkMode(&old.Network) {
+		allErrs = append(allErrs, field.Forbidden(specPath.Child("network", "existing_subnet"),
+			"can't switch between an existing subnet and a private network after creation"))
+	}
+
+	return allErrs
+}
+
+func networkMode(network *NetworkSpec) string {
+	if network.ExistingSubnet != "" {
+		return networkModeExisting
+	}
+	return networkModePrivate
+}
@@ -0,0 +1,244 @@
+/*
+Copyright 2020 easystack.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	"testing"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func validVM() *VirtualMachine {
+	return &VirtualMachine{
+		ObjectMeta: metav1.ObjectMeta{Name: "test-app", Namespace: "default"},
+		Spec: VirtualMachineSpec{
+			Project: ProjectSpec{
+				ProjectID:            "8e5eda4cac9f460ea2b471a357c42dd0",
+				CredentialsSecretRef: &SecretRef{Name: "test-app-credentials"},
+			},
+			Server: ServerSpec{
+				Replicas:       1,
+				NamePrefix:     "test-app",
+				BootVolumeSize: "20",
+			},
+			Network: NetworkSpec{
+				PrivateNetworkCidr: "192.168.18.0/24",
+				FloatingIp:         "enable",
+			},
+			Volume: []VolumeSpec{{VolumeName: "data", VolumeSize: "100"}},
+		},
+	}
+}
+
+// causes returns the invalid fields reported by err
+func causes(t *testing.T, err error) []string {
+	if err == nil {
+		return nil
+	}
+	status, ok := err.(apierrors.APIStatus)
+	if !ok || !apierrors.IsInvalid(err) {
+		t.Fatalf("expected an Invalid error, got %v", err)
+	}
+	var fields []string
+	for _, c := range status.Status().Details.Causes {
+		fields = append(fields, c.Field)
+	}
+	return fields
+}
+
+func TestValidateCreate(t *testing.T) {
+	cases := []struct {
+		name   string
+		mutate func(vm *VirtualMachine)
+		fields []string
+	}{
+		{
+			name:   "valid",
+			mutate: func(vm *VirtualMachine) {},
+		},
+		{
+			name:   "token instead of secret",
+			mutate: func(vm *VirtualMachine) { vm.Spec.Project.CredentialsSecretRef = nil; vm.Spec.Project.Token = "token" },
+		},
+		{
+			name: "existing subnet",
+			mutate: func(vm *VirtualMachine) {
+				vm.Spec.Network.PrivateNetworkCidr = ""
+				vm.Spec.Network.ExistingSubnet = "subnet"
+			},
+		},
+		{
+			name:   "missing project",
+			mutate: func(vm *VirtualMachine) { vm.Spec.Project = ProjectSpec{} },
+			fields: []string{"spec.project.projectID", "spec.project.credentialsSecretRef"},
+		},
+		{
+			name:   "secret without name",
+			mutate: func(vm *VirtualMachine) { vm.Spec.Project.CredentialsSecretRef.Name = "" },
+			fields: []string{"spec.project.credentialsSecretRef.name"},
+		},
+		{
+			name:   "negative replicas",
+			mutate: func(vm *VirtualMachine) { vm.Spec.Server.Replicas = -1 },
+			fields: []string{"spec.server.replicas"},
+		},
+		{
+			name:   "boot volume size with unit",
+			mutate: func(vm *VirtualMachine) { vm.Spec.Server.BootVolumeSize = "20G" },
+			fields: []string{"spec.server.boot_volume_size"},
+		},
+		{
+			name:   "zero data volume size",
+			mutate: func(vm *VirtualMachine) { vm.Spec.Volume[0].VolumeSize = "0" },
+			fields: []string{"spec.volume[0].volume_size"},
+		},
+		{
+			name:   "malformed cidr",
+			mutate: func(vm *VirtualMachine) { vm.Spec.Network.PrivateNetworkCidr = "192.168.18.0" },
+			fields: []string{"spec.network.private_network_cidr"},
+		},
+		{
+			name:   "existing subnet and cidr",
+			mutate: func(vm *VirtualMachine) { vm.Spec.Network.ExistingSubnet = "subnet" },
+			fields: []string{"spec.network.private_network_cidr"},
+		},
+		{
+			name:   "template without name",
+			mutate: func(vm *VirtualMachine) { vm.Spec.Template = &TemplateReference{Version: "v1"} },
+			fields: []string{"spec.template.name"},
+		},
+		{
+			name:   "unsupported floating ip",
+			mutate: func(vm *VirtualMachine) { vm.Spec.Network.FloatingIp = "true" },
+			fields: []string{"spec.network.floating_ip"},
+		},
+		{
+			name:   "unsupported action",
+			mutate: func(vm *VirtualMachine) { vm.Annotations = map[string]string{ActionAnnotation: "shutdown"} },
+			fields: []string{"metadata.annotations[" + ActionAnnotation + "]"},
+		},
+		{
+			name:   "adopt stack",
+			mutate: func(vm *VirtualMachine) { vm.Annotations = map[string]string{AdoptAnnotation: "legacy-app"} },
+		},
+		{
+			name:   "adopt unnamed stack",
+			mutate: func(vm *VirtualMachine) { vm.Annotations = map[string]string{AdoptAnnotation: ""} },
+			fields: []string{"metadata.annotations[" + AdoptAnnotation + "]"},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			vm := validVM()
+			c.mutate(vm)
+			fields := causes(t, vm.ValidateCreate())
+			if !equalStrings(fields, c.fields) {
+				t.Errorf("expected invalid fields %v, got %v", c.fields, fields)
+			}
+		})
+	}
+}
+
+func TestValidateUpdate(t *testing.T) {
+	cases := []struct {
+		name   string
+		old    func(vm *VirtualMachine)
+		mutate func(vm *VirtualMachine)
+		fields []string
+	}{
+		{
+			name:   "scale out",
+			mutate: func(vm *VirtualMachine) { vm.Spec.Server.Replicas = 3 },
+		},
+		{
+			name:   "rotate credentials secret",
+			mutate: func(vm *VirtualMachine) { vm.Spec.Project.CredentialsSecretRef.Name = "rotated" },
+		},
+		{
+			name:   "invalid new spec",
+			mutate: func(vm *VirtualMachine) { vm.Spec.Server.BootVolumeSize = "40G" },
+			fields: []string{"spec.server.boot_volume_size"},
+		},
+		{
+			name:   "move to another project",
+			mutate: func(vm *VirtualMachine) { vm.Spec.Project.ProjectID = "another" },
+			fields: []string{"spec.project.projectID"},
+		},
+		{
+			name: "switch to existing subnet",
+			mutate: func(vm *VirtualMachine) {
+				vm.Spec.Network.PrivateNetworkCidr = ""
+				vm.Spec.Network.ExistingSubnet = "subnet"
+			},
+			fields: []string{"spec.network.existing_subnet"},
+		},
+		{
+			name:   "reboot action",
+			mutate: func(vm *VirtualMachine) { vm.Annotations = map[string]string{ActionAnnotation: ActionReboot} },
+		},
+		{
+			name:   "unsupported action",
+			mutate: func(vm *VirtualMachine) { vm.Annotations = map[string]string{ActionAnnotation: "shutdown"} },
+			fields: []string{"metadata.annotations[" + ActionAnnotation + "]"},
+		},
+		{
+			name:   "record adopted stack id",
+			old:    func(vm *VirtualMachine) { vm.Status.StackID = "stack-1" },
+			mutate: func(vm *VirtualMachine) { vm.Spec.StackID = "stack-1" },
+		},
+		{
+			name:   "adopt another stack",
+			old:    func(vm *VirtualMachine) { vm.Status.StackID = "stack-1" },
+			mutate: func(vm *VirtualMachine) { vm.Spec.StackID = "stack-2" },
+			fields: []string{"spec.stackID"},
+		},
+		{
+			name:   "finalizer removed from invalid legacy spec",
+			old:    func(vm *VirtualMachine) { vm.Spec.Server.BootVolumeSize = "20G" },
+			mutate: func(vm *VirtualMachine) { vm.Spec.Server.BootVolumeSize = "20G"; vm.Finalizers = nil },
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			old := validVM()
+			if c.old != nil {
+				c.old(old)
+			}
+			vm := old.DeepCopy()
+			c.mutate(vm)
+			fields := causes(t, vm.ValidateUpdate(old))
+			if !equalStrings(fields, c.fields) {
+				t.Errorf("expected invalid fields %v, got %v", c.fields, fields)
+			}
+		})
+	}
+}
+
+func equalStrings(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
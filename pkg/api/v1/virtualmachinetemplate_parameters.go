@@ -0,0 +1,93 @@
+/*
+Copyright 2020 easystack.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// Matches reports whether ref selects t
+func (t *VirtualMachineTemplate) Matches(ref *TemplateReference) bool {
+	return ref.Name == t.Name && (ref.Version == "" || ref.Version == t.Spec.Version)
+}
+
+// ResolveParameters returns the values of the declared parameters, converted
+// to their type, with the defaults of the parameters not in values. Values of
+// undeclared parameters are rejected, heat would reject them too.
+func (t *VirtualMachineTemplate) ResolveParameters(values map[string]string) (map[string]interface{}, error) {
+	params := make(map[string]interface{}, len(t.Spec.Parameters))
+	declared := make(map[string]bool, len(t.Spec.Parameters))
+
+	for _, p := range t.Spec.Parameters {
+		declared[p.Name] = true
+		value, ok := values[p.Name]
+		if !ok {
+			if p.Required {
+				return nil, fmt.Errorf("parameter %s of template %s is required", p.Name, t.Name)
+			}
+			if p.Default == "" {
+				continue
+			}
+			value = p.Default
+		}
+
+		converted, err := convertParameter(p.Type, value)
+		if err != nil {
+			return nil, fmt.Errorf("parameter %s of template %s: %v", p.Name, t.Name, err)
+		}
+		params[p.Name] = converted
+	}
+
+	var unknown []string
+	for name := range values {
+		if !declared[name] {
+			unknown = append(unknown, name)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return nil, fmt.Errorf("parameters %v are not declared by template %s", unknown, t.Name)
+	}
+
+	return params, nil
+}
+
+func convertParameter(paramType ParameterType, value string) (interface{}, error) {
+	switch paramType {
+	case "", ParameterString:
+		return value, nil
+	case ParameterNumber:
+		if n, err := strconv.ParseInt(value, 10, 64); err == nil {
+			return n, nil
+		}
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a number", value)
+		}
+		return f, nil
+	case ParameterBoolean:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a boolean", value)
+		}
+		return b, nil
+	default:
+		return nil, fmt.Errorf("unknown type %s", paramType)
+	}
+}
@@ -0,0 +1,116 @@
+/*
+Copyright 2020 easystack.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	"reflect"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestTemplateMatches(t *testing.T) {
+	tpl := &VirtualMachineTemplate{
+		ObjectMeta: metav1.ObjectMeta{Name: "lb"},
+		Spec:       VirtualMachineTemplateSpec{Version: "v2"},
+	}
+	cases := []struct {
+		ref   TemplateReference
+		match bool
+	}{
+		{ref: TemplateReference{Name: "lb"}, match: true},
+		{ref: TemplateReference{Name: "lb", Version: "v2"}, match: true},
+		{ref: TemplateReference{Name: "lb", Version: "v1"}, match: false},
+		{ref: TemplateReference{Name: "web", Version: "v2"}, match: false},
+	}
+	for _, c := range cases {
+		if tpl.Matches(&c.ref) != c.match {
+			t.Errorf("expected match of %+v to be %v", c.ref, c.match)
+		}
+	}
+}
+
+func TestResolveParameters(t *testing.T) {
+	tpl := &VirtualMachineTemplate{
+		ObjectMeta: metav1.ObjectMeta{Name: "lb"},
+		Spec: VirtualMachineTemplateSpec{
+			Version: "v1",
+			Parameters: []TemplateParameter{
+				{Name: "lb_port", Type: ParameterNumber, Required: true},
+				{Name: "lb_algorithm", Default: "ROUND_ROBIN"},
+				{Name: "lb_weight", Type: ParameterNumber, Default: "0.5"},
+				{Name: "lb_public", Type: ParameterBoolean},
+			},
+		},
+	}
+
+	cases := []struct {
+		name   string
+		values map[string]string
+		want   map[string]interface{}
+		fail   bool
+	}{
+		{
+			name:   "defaults",
+			values: map[string]string{"lb_port": "80"},
+			want:   map[string]interface{}{"lb_port": int64(80), "lb_algorithm": "ROUND_ROBIN", "lb_weight": 0.5},
+		},
+		{
+			name:   "all set",
+			values: map[string]string{"lb_port": "443", "lb_algorithm": "LEAST_CONNECTIONS", "lb_weight": "2", "lb_public": "true"},
+			want:   map[string]interface{}{"lb_port": int64(443), "lb_algorithm": "LEAST_CONNECTIONS", "lb_weight": int64(2), "lb_public": true},
+		},
+		{
+			name:   "missing required",
+			values: map[string]string{"lb_algorithm": "SOURCE_IP"},
+			fail:   true,
+		},
+		{
+			name:   "not a number",
+			values: map[string]string{"lb_port": "http"},
+			fail:   true,
+		},
+		{
+			name:   "not a boolean",
+			values: map[string]string{"lb_port": "80", "lb_public": "yes"},
+			fail:   true,
+		},
+		{
+			name:   "undeclared",
+			values: map[string]string{"lb_port": "80", "lb_timeout": "10"},
+			fail:   true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			params, err := tpl.ResolveParameters(c.values)
+			if c.fail {
+				if err == nil {
+					t.Errorf("expected an error, got %v", params)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(params, c.want) {
+				t.Errorf("expected %v, got %v", c.want, params)
+			}
+		})
+	}
+}
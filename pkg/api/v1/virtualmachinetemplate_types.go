@@ -0,0 +1,76 @@
+/*
+Copyright 2020 easystack.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+type ParameterType string
+
+const (
+	ParameterString  ParameterType = "string"
+	ParameterNumber  ParameterType = "number"
+	ParameterBoolean ParameterType = "boolean"
+)
+
+// TemplateParameter declares a parameter of the templates, set by the
+// VirtualMachines using them in addition to the parameters of the spec
+type TemplateParameter struct {
+	Name string `json:"name"`
+	// +kubebuilder:validation:Enum=string;number;boolean
+	Type        ParameterType `json:"type,omitempty"`
+	Required    bool          `json:"required,omitempty"`
+	Default     string        `json:"default,omitempty"`
+	Description string        `json:"description,omitempty"`
+}
+
+// VirtualMachineTemplateSpec defines a set of heat templates
+type VirtualMachineTemplateSpec struct {
+	// Version is matched against the version referenced by VirtualMachines
+	Version string `json:"version"`
+	// Templates are the pongo2 sources of the heat templates keyed by the name
+	// they refer to each other with, vm_group.yaml is the root template
+	Templates  map[string]string   `json:"templates"`
+	Parameters []TemplateParameter `json:"parameters,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:resource:shortName=vmt
+// +kubebuilder:printcolumn:name="Version",type="string",JSONPath=".spec.version"
+// +kubebuilder:printcolumn:name="Age",type="date",JSONPath=".metadata.creationTimestamp"
+
+// VirtualMachineTemplate is the Schema for the virtualmachinetemplates API
+type VirtualMachineTemplate struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec VirtualMachineTemplateSpec `json:"spec,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// VirtualMachineTemplateList contains a list of VirtualMachineTemplate
+type VirtualMachineTemplateList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []VirtualMachineTemplate `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&VirtualMachineTemplate{}, &VirtualMachineTemplateList{})
+}
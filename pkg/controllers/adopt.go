@@ -0,0 +1,257 @@
+/*
+Copyright 2020 easystack.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	vmv1 "easystack.io/vm-operator/pkg/api/v1"
+	"easystack.io/vm-operator/pkg/openstack"
+	vmtpl "easystack.io/vm-operator/pkg/templates"
+	"easystack.io/vm-operator/pkg/utils"
+	"github.com/gophercloud/gophercloud/openstack/orchestration/v1/stacks"
+	corev1 "k8s.io/api/core/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+// hiddenValue is the value heat shows for hidden parameters
+const hiddenValue = "******"
+
+// adoptIdentity returns the name or id of the existing stack vm adopts,
+// spec.stackID takes precedence over the annotation
+func adoptIdentity(vm *vmv1.VirtualMachine) string {
+	if vm.Spec.StackID != "" {
+		return vm.Spec.StackID
+	}
+	return vm.Annotations[vmv1.AdoptAnnotation]
+}
+
+// adoptStack binds vm to the existing stack identity instead of creating one.
+// The status of vm is rebuilt from the stack and the parameters of the stack
+// differing from the spec are updated. Its template is kept unless
+// spec.template is set, spec changes needing another template are refused,
+// see keepsTemplate. The stack is tagged like created ones. A stack in
+// progress is adopted once it's done.
+func (r *VirtualMachineReconciler) adoptStack(ctx context.Context, vm *vmv1.VirtualMachine, identity string) (ctrl.Result, error) {
+	logger := utils.GetLogger(ctx)
+	logger.Info("Adopt Event", "stack", identity)
+
+	if err := r.newHeatClient(ctx, vm); err != nil {
+		return r.handleAuthError(ctx, vm, err)
+	}
+	stack, err := r.osService.StackFind(ctx, vm.Spec.Project.ProjectID, identity)
+	if openstack.IsAuthExpired(err) {
+		return r.handleAuthError(ctx, vm, err)
+	}
+	if err != nil {
+		if !openstack.IsNotFound(err) {
+			return ctrl.Result{}, err
+		}
+		// retried when the spec or the annotations change
+		return r.rejectAdoption(ctx, vm, "StackNotFound", fmt.Sprintf("stack %s not found in project %s", identity, vm.Spec.Project.ProjectID))
+	}
+
+	if owner, ok := r.vmCache.ownerOf(stack.ID); ok && owner != vmKey(vm) {
+		return r.rejectAdoption(ctx, vm, "StackManaged", fmt.Sprintf("stack %s is managed by VirtualMachine %s", stack.ID, owner))
+	}
+	// the cache only knows the VirtualMachines reconciled by this process,
+	// the owner tags are checked against the existing ones
+	if owner, ok := openstack.StackOwnerOf(stack.Tags); ok && owner.UID != string(vm.UID) {
+		exists, err := r.ownerExists(ctx, owner)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		if exists {
+			return r.rejectAdoption(ctx, vm, "StackManaged", fmt.Sprintf("stack %s is managed by VirtualMachine %s/%s", stack.ID, owner.Namespace, owner.Name))
+		}
+	}
+	switch {
+	case strings.HasPrefix(stack.Status, "DELETE_"):
+		return r.rejectAdoption(ctx, vm, "StackDeleted", fmt.Sprintf("stack %s is %s", stack.ID, stack.Status))
+	case strings.HasSuffix(stack.Status, "_IN_PROGRESS"):
+		setCondition(vm, vmv1.StackAdopted, metav1.ConditionFalse, "StackInProgress",
+			fmt.Sprintf("stack %s is %s, it's adopted once done", stack.ID, stack.Status))
+		if err := r.doUpdateVmCrdStatus(ctx, vm); err != nil {
+			return ctrl.Result{}, err
+		}
+		return ctrl.Result{RequeueAfter: time.Duration(r.PollingPeriod) * time.Second}, nil
+	}
+
+	params, err := vmtpl.BuildParameters(&vm.Spec)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	changed, undeclared := parametersDiff(params.Heat, stack.Parameters)
+
+	vm.Status.StackID = stack.ID
+	vm.Status.StackName = stack.Name
+	applyRetrievedStatus(vm, stack)
+	message := fmt.Sprintf("adopted stack %s/%s", stack.Name, stack.ID)
+	if len(undeclared) > 0 {
+		message += fmt.Sprintf(", parameters %s aren't declared by its template", strings.Join(undeclared, ", "))
+	}
+	updateOpts := &stacks.UpdateOpts{Parameters: changed}
+	if len(changed) > 0 {
+		names := make([]string, 0, len(changed))
+		for k := range changed {
+			names = append(names, k)
+		}
+		sort.Strings(names)
+		message += fmt.Sprintf(", updating parameters %s", strings.Join(names, ", "))
+	}
+	// the resync only lists tagged stacks, and the orphan collector deletes
+	// the ones not owned by an existing VirtualMachine
+	for _, tag := range openstack.StackTags(stackOwner(vm, r.ClusterID)) {
+		if !containsString(stack.Tags, tag) {
+			updateOpts.Tags = openstack.MergeStackTags(stack.Tags, stackOwner(vm, r.ClusterID))
+			message += fmt.Sprintf(", tagging it %s", openstack.StackTag)
+			break
+		}
+	}
+	updated := true
+	if len(updateOpts.Parameters) > 0 || len(updateOpts.Tags) > 0 {
+		err = r.osService.StackUpdate(ctx, vm.Spec.Project.ProjectID, stack.Name, stack.ID, updateOpts)
+		if openstack.IsAuthExpired(err) {
+			return r.handleAuthError(ctx, vm, err)
+		}
+		if err != nil {
+			logger.Error(err, "Update adopted Stack failed")
+			updated = false
+			vm.Status.Phase = vmv1.Failed
+			vm.Status.VmStatus = openstack.S_UPDATE_FAILED
+			vm.Status.LastError = err.Error()
+		} else {
+			vm.Status.Phase = vmv1.Updating
+			vm.Status.VmStatus = openstack.S_UPDATE_IN_PROGRESS
+			vm.Status.LastError = ""
+		}
+		setStackCondition(vm)
+	}
+	logger.Info("Adopted Stack", "stack", stack.Name, "id", stack.ID, "changed", len(changed), "undeclared", undeclared)
+
+	r.syncHeatEvents(ctx, vm)
+	setCondition(vm, vmv1.StackAdopted, metav1.ConditionTrue, "StackAdopted", message)
+	setAuthCondition(vm, nil)
+	r.recorder.Event(vm, corev1.EventTypeNormal, "StackAdopted", message)
+	// a rejected update is sent again as a whole by the next reconcile, the
+	// spec isn't applied yet
+	if updated {
+		vm.Status.ObservedGeneration = vm.Generation
+		r.vmCache.set(vmKey(vm), vm.DeepCopy())
+	}
+	if err := r.doUpdateVmCrdStatus(ctx, vm); err != nil {
+		return ctrl.Result{}, err
+	}
+	return r.requeue(vm), nil
+}
+
+// keepsTemplate reports whether vm is bound to an adopted stack whose own
+// template is kept, only spec.template replaces it
+func keepsTemplate(vm *vmv1.VirtualMachine) bool {
+	if vm.Spec.Template != nil {
+		return false
+	}
+	for _, cond := range vm.Status.Conditions {
+		if cond.Type == vmv1.StackAdopted {
+			return cond.Status == metav1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// refuseTemplateChange reports a spec change of vm which can't be applied to
+// its adopted stack without replacing the template, which would destroy the
+// resources the operator doesn't know about. It's retried when the spec
+// changes.
+func (r *VirtualMachineReconciler) refuseTemplateChange(ctx context.Context, vm *vmv1.VirtualMachine) (ctrl.Result, error) {
+	message := fmt.Sprintf("the template of adopted stack %s/%s is kept, set spec.template to change the structure of the stack", vm.StackName(), vm.Status.StackID)
+	utils.GetLogger(ctx).Info("Update of adopted stack refused", "message", message)
+	setCondition(vm, vmv1.TemplateReady, metav1.ConditionFalse, "TemplateKept", message)
+	r.recorder.Event(vm, corev1.EventTypeWarning, "TemplateKept", message)
+	return ctrl.Result{}, r.doUpdateVmCrdStatus(ctx, vm)
+}
+
+// ownerExists reports whether the VirtualMachine recorded by the tags of a
+// stack still exists, a VirtualMachine recreated with the same name is another
+// owner
+func (r *VirtualMachineReconciler) ownerExists(ctx context.Context, owner openstack.StackOwner) (bool, error) {
+	var vm vmv1.VirtualMachine
+	err := r.cliReader.Get(ctx, types.NamespacedName{Namespace: owner.Namespace, Name: owner.Name}, &vm)
+	if apierrs.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return string(vm.UID) == owner.UID, nil
+}
+
+// rejectAdoption reports why vm can't adopt its stack, nothing is created
+func (r *VirtualMachineReconciler) rejectAdoption(ctx context.Context, vm *vmv1.VirtualMachine, reason string, message string) (ctrl.Result, error) {
+	utils.GetLogger(ctx).Info("Adoption rejected", "reason", reason, "message", message)
+	vm.Status.LastError = message
+	setCondition(vm, vmv1.StackAdopted, metav1.ConditionFalse, reason, message)
+	setAuthCondition(vm, nil)
+	r.recorder.Event(vm, corev1.EventTypeWarning, reason, message)
+	return ctrl.Result{}, r.doUpdateVmCrdStatus(ctx, vm)
+}
+
+// applyRetrievedStatus sets the phase of vm from the status of the stack it's
+// bound to, and copies the outputs of a completed stack
+func applyRetrievedStatus(vm *vmv1.VirtualMachine, stack *stacks.RetrievedStack) {
+	vm.Status.VmStatus = stack.Status
+	switch {
+	case stack.Status == openstack.S_CREATE_IN_PROGRESS:
+		vm.Status.Phase = vmv1.Creating
+	case strings.HasSuffix(stack.Status, "_IN_PROGRESS"):
+		vm.Status.Phase = vmv1.Updating
+	case strings.HasSuffix(stack.Status, "_FAILED"):
+		vm.Status.Phase = vmv1.Failed
+		vm.Status.LastError = stack.StatusReason
+	default:
+		vm.Status.Phase = vmv1.Succeeded
+		vm.Status.LastError = ""
+		applyStackOutputs(vm, stack)
+	}
+	setStackCondition(vm)
+}
+
+// parametersDiff returns the parameters of the spec whose value differs from
+// the one of the stack, and the names of the ones the stack doesn't have,
+// which heat would reject. Hidden parameters can't be compared and are left.
+func parametersDiff(desired map[string]interface{}, current map[string]string) (map[string]interface{}, []string) {
+	changed := make(map[string]interface{})
+	var undeclared []string
+	for k, v := range desired {
+		value, ok := current[k]
+		switch {
+		case !ok:
+			undeclared = append(undeclared, k)
+		case value != hiddenValue && value != fmt.Sprintf("%v", v):
+			changed[k] = v
+		}
+	}
+	sort.Strings(undeclared)
+	return changed, undeclared
+}
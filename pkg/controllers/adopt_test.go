@@ -0,0 +1,145 @@
+/*
+Copyright 2020 easystack.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/gophercloud/gophercloud/openstack/orchestration/v1/stacks"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	fakecli "sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	vmv1 "easystack.io/vm-operator/pkg/api/v1"
+	"easystack.io/vm-operator/pkg/openstack"
+	"easystack.io/vm-operator/pkg/openstack/fake"
+	"easystack.io/vm-operator/pkg/utils"
+)
+
+func TestAdoptTaggedStack(t *testing.T) {
+	const projectID = "8e5eda4cac9f460ea2b471a357c42dd0"
+	ctx := utils.WithLogger(context.Background(), log.NullLogger{})
+	heat := fake.NewHeat(0)
+
+	owner := &vmv1.VirtualMachine{ObjectMeta: metav1.ObjectMeta{Namespace: "other", Name: "owner", UID: "uid-owner"}}
+	// the owner of the second stack was deleted, a VirtualMachine of the same
+	// name was created since
+	recreated := &vmv1.VirtualMachine{ObjectMeta: metav1.ObjectMeta{Namespace: "other", Name: "recreated", UID: "uid-new"}}
+	for _, stack := range []struct {
+		name  string
+		owner openstack.StackOwner
+	}{
+		{"managed", stackOwner(owner, "")},
+		{"abandoned", openstack.StackOwner{Namespace: "other", Name: "recreated", UID: "uid-old"}},
+	} {
+		if _, err := heat.StackCreate(ctx, projectID, &stacks.CreateOpts{Name: stack.name, Tags: openstack.StackTags(stack.owner)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	adoptedBy := func(identity string) *vmv1.Condition {
+		vm := &vmv1.VirtualMachine{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "vm-" + identity, UID: types.UID("uid-" + identity)}}
+		vm.Spec.Project.ProjectID = projectID
+		vm.Spec.Project.Token = "token"
+		scheme := runtime.NewScheme()
+		_ = vmv1.AddToScheme(scheme)
+		c := fakecli.NewFakeClientWithScheme(scheme, vm.DeepCopy(), owner.DeepCopy(), recreated.DeepCopy())
+		r := NewVirtualMachine(c, c, record.NewFakeRecorder(10), log.NullLogger{}, heat, nil, 1)
+
+		if _, err := r.adoptStack(ctx, vm, identity); err != nil {
+			t.Fatalf("adoptStack failed: %v", err)
+		}
+		for i := range vm.Status.Conditions {
+			if vm.Status.Conditions[i].Type == vmv1.StackAdopted {
+				return &vm.Status.Conditions[i]
+			}
+		}
+		t.Fatalf("expected a StackAdopted condition on %s", vm.Name)
+		return nil
+	}
+
+	// the owner isn't in the cache of this process but still exists
+	if cond := adoptedBy("managed"); cond.Status != metav1.ConditionFalse || cond.Reason != "StackManaged" {
+		t.Errorf("expected the stack of an existing VirtualMachine to be rejected, got %+v", cond)
+	}
+	if cond := adoptedBy("abandoned"); cond.Status != metav1.ConditionTrue {
+		t.Errorf("expected the stack of a deleted VirtualMachine to be adopted, got %+v", cond)
+	}
+}
+
+func TestAdoptedStackKeepsTemplate(t *testing.T) {
+	const projectID = "8e5eda4cac9f460ea2b471a357c42dd0"
+	ctx := utils.WithLogger(context.Background(), log.NullLogger{})
+	heat := fake.NewHeat(0)
+
+	id, err := heat.StackCreate(ctx, projectID, &stacks.CreateOpts{Name: "foreign"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	vm := &vmv1.VirtualMachine{ObjectMeta: metav1.ObjectMeta{
+		Namespace:  "default",
+		Name:       "vm",
+		Generation: 2,
+		Finalizers: []string{vmFinalizer},
+	}}
+	vm.Spec.Project.ProjectID = projectID
+	vm.Spec.Project.Token = "token"
+	vm.Spec.StackID = id
+	vm.Status.StackID = id
+	vm.Status.StackName = "foreign"
+	vm.Status.Phase = vmv1.Succeeded
+	vm.Status.ObservedGeneration = 1
+	setCondition(vm, vmv1.StackAdopted, metav1.ConditionTrue, "StackAdopted", "")
+
+	scheme := runtime.NewScheme()
+	_ = vmv1.AddToScheme(scheme)
+	r := NewVirtualMachine(nil, nil, record.NewFakeRecorder(10), log.NullLogger{}, heat, nil, 1)
+
+	// without the applied spec only the parameters are sent
+	updateOpts, err := r.buildStackUpdateOpts(ctx, nil, vm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updateOpts.TemplateOpts != nil {
+		t.Errorf("expected the template of the adopted stack to be kept, got %+v", updateOpts)
+	}
+
+	// a change of the structure of the stack is refused
+	applied := vm.DeepCopy()
+	vm.Spec.Volume = []vmv1.VolumeSpec{{VolumeName: "data", VolumeSize: "10"}}
+	c := fakecli.NewFakeClientWithScheme(scheme, vm.DeepCopy())
+	r = NewVirtualMachine(c, c, record.NewFakeRecorder(10), log.NullLogger{}, heat, nil, 1)
+	r.vmCache.set(vmKey(vm), applied)
+	if _, err := r.Reconcile(ctrl.Request{NamespacedName: vmKey(vm)}); err != nil {
+		t.Fatal(err)
+	}
+	if n := heat.Calls("StackUpdate"); n != 0 {
+		t.Errorf("expected the adopted stack not to be updated, got %d updates", n)
+	}
+	var latest vmv1.VirtualMachine
+	if err := c.Get(ctx, vmKey(vm), &latest); err != nil {
+		t.Fatal(err)
+	}
+	if cond := findCondition(&latest, vmv1.TemplateReady); cond == nil || cond.Status != metav1.ConditionFalse || cond.Reason != "TemplateKept" {
+		t.Errorf("expected the refusal to be reported, got %+v", cond)
+	}
+}
@@ -0,0 +1,91 @@
+/*
+Copyright 2020 easystack.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	fakecli "sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	vmv1 "easystack.io/vm-operator/pkg/api/v1"
+	"easystack.io/vm-operator/pkg/openstack/fake"
+	"easystack.io/vm-operator/pkg/utils"
+)
+
+func TestHandleAuthErrorRetriesUnavailableCredential(t *testing.T) {
+	ctx := utils.WithLogger(context.Background(), log.NullLogger{})
+	vm := &vmv1.VirtualMachine{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "vm"}}
+	vm.Spec.Project.CredentialsSecretRef = &vmv1.SecretRef{Name: "not-yet-created"}
+
+	scheme := runtime.NewScheme()
+	_ = vmv1.AddToScheme(scheme)
+	_ = clientgoscheme.AddToScheme(scheme)
+	c := fakecli.NewFakeClientWithScheme(scheme, vm.DeepCopy())
+	recorder := record.NewFakeRecorder(10)
+	r := NewVirtualMachine(c, c, recorder, log.NullLogger{}, fake.NewHeat(0), nil, 1)
+
+	err := r.newHeatClient(ctx, vm)
+	if err == nil {
+		t.Fatal("expected the missing secret to fail")
+	}
+	result, err := r.handleAuthError(ctx, vm, err)
+	if err != nil || result.RequeueAfter == 0 {
+		t.Errorf("expected vm to be requeued, got %+v, %v", result, err)
+	}
+	cond := findCondition(vm, vmv1.AuthExpired)
+	if cond == nil || cond.Status != metav1.ConditionUnknown || cond.Reason != "CredentialUnavailable" {
+		t.Errorf("expected AuthExpired to be unknown, got %+v", cond)
+	}
+	select {
+	case event := <-recorder.Events:
+		if !strings.HasPrefix(event, "Warning CredentialUnavailable") {
+			t.Errorf("expected a warning, got %s", event)
+		}
+	default:
+		t.Error("expected an event")
+	}
+
+	// the condition is cleared once the credential works again
+	setAuthCondition(vm, nil)
+	if cond := findCondition(vm, vmv1.AuthExpired); cond.Status != metav1.ConditionFalse {
+		t.Errorf("expected AuthExpired to be cleared, got %+v", cond)
+	}
+
+	// requeued later each time
+	first, _ := r.handleAuthError(ctx, vm, errors.New("keystone unreachable"))
+	second, _ := r.handleAuthError(ctx, vm, errors.New("keystone unreachable"))
+	if second.RequeueAfter <= first.RequeueAfter {
+		t.Errorf("expected backoff, got %v then %v", first.RequeueAfter, second.RequeueAfter)
+	}
+}
+
+func findCondition(vm *vmv1.VirtualMachine, condType vmv1.ConditionType) *vmv1.Condition {
+	for i := range vm.Status.Conditions {
+		if vm.Status.Conditions[i].Type == condType {
+			return &vm.Status.Conditions[i]
+		}
+	}
+	return nil
+}
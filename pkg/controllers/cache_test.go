@@ -0,0 +1,64 @@
+/*
+Copyright 2020 easystack.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	fakecli "sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	vmv1 "easystack.io/vm-operator/pkg/api/v1"
+	"easystack.io/vm-operator/pkg/openstack"
+	"easystack.io/vm-operator/pkg/openstack/fake"
+)
+
+func TestInitVmCacheFromCRD(t *testing.T) {
+	newVM := func(name string, generation int64) *vmv1.VirtualMachine {
+		vm := &vmv1.VirtualMachine{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name, Generation: generation}}
+		vm.Status.StackID = "stack-" + name
+		vm.Status.ObservedGeneration = 1
+		vm.Status.Phase = vmv1.Succeeded
+		vm.Status.VmStatus = openstack.S_UPDATE_COMPLETE
+		return vm
+	}
+	applied := newVM("applied", 1)
+	pending := newVM("pending", 2)
+	// recorded as observed by older versions although heat rejected it
+	rejected := newVM("rejected", 1)
+	rejected.Status.Phase = vmv1.Failed
+	rejected.Status.VmStatus = openstack.S_UPDATE_FAILED
+	rejected.Status.LastError = "Bad request with: [PATCH ...], error message: invalid parameter"
+
+	scheme := runtime.NewScheme()
+	_ = vmv1.AddToScheme(scheme)
+	c := fakecli.NewFakeClientWithScheme(scheme, applied, pending, rejected)
+	r := NewVirtualMachine(c, c, record.NewFakeRecorder(10), log.NullLogger{}, fake.NewHeat(0), nil, 1)
+	if err := r.InitVmCacheFromCRD(); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, want := range map[string]bool{"applied": true, "pending": false, "rejected": false} {
+		if _, ok := r.vmCache.get(types.NamespacedName{Namespace: "default", Name: name}); ok != want {
+			t.Errorf("expected %s to be cached: %v, got %v", name, want, ok)
+		}
+	}
+}
@@ -0,0 +1,157 @@
+/*
+Copyright 2020 easystack.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"strings"
+
+	vmv1 "easystack.io/vm-operator/pkg/api/v1"
+	"easystack.io/vm-operator/pkg/openstack"
+	vmtpl "easystack.io/vm-operator/pkg/templates"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// setCondition adds or updates the condition of the given type, the transition
+// time is only bumped when the status changes.
+func setCondition(vm *vmv1.VirtualMachine, condType vmv1.ConditionType, status metav1.ConditionStatus, reason string, message string) {
+	cond := vmv1.Condition{
+		Type:               condType,
+		Status:             status,
+		ObservedGeneration: vm.Generation,
+		LastTransitionTime: metav1.Now(),
+		Reason:             reason,
+		Message:            message,
+	}
+
+	for i := range vm.Status.Conditions {
+		existing := &vm.Status.Conditions[i]
+		if existing.Type != condType {
+			continue
+		}
+		if existing.Status == status {
+			cond.LastTransitionTime = existing.LastTransitionTime
+		}
+		*existing = cond
+		return
+	}
+	vm.Status.Conditions = append(vm.Status.Conditions, cond)
+}
+
+// setAuthCondition sets AuthExpired from err of an openstack call and reports
+// whether err was an authentication failure. A nil err clears a previous failure
+// or a credential that couldn't be checked.
+func setAuthCondition(vm *vmv1.VirtualMachine, err error) bool {
+	if err == nil {
+		for _, cond := range vm.Status.Conditions {
+			if cond.Type == vmv1.AuthExpired && cond.Status != metav1.ConditionFalse {
+				setCondition(vm, vmv1.AuthExpired, metav1.ConditionFalse, "Authenticated", "")
+			}
+		}
+		return false
+	}
+
+	authErr, ok := err.(openstack.ErrAuthExpired)
+	if !ok {
+		return false
+	}
+	reason := "TokenExpired"
+	if authErr.Renewable {
+		reason = "CredentialRejected"
+	}
+	setCondition(vm, vmv1.AuthExpired, metav1.ConditionTrue, reason, authErr.Error())
+	return true
+}
+
+// setCredentialUnavailable marks AuthExpired unknown, the credential of the
+// project couldn't be read or checked by keystone
+func setCredentialUnavailable(vm *vmv1.VirtualMachine, err error) {
+	setCondition(vm, vmv1.AuthExpired, metav1.ConditionUnknown, "CredentialUnavailable", err.Error())
+}
+
+// setStackCondition derives StackReady from the heat stack status of vm
+func setStackCondition(vm *vmv1.VirtualMachine) {
+	stackStatus := vm.Status.VmStatus
+	switch {
+	case strings.HasSuffix(stackStatus, "_COMPLETE"):
+		setCondition(vm, vmv1.StackReady, metav1.ConditionTrue, stackStatus, "")
+	case strings.HasSuffix(stackStatus, "_FAILED"):
+		setCondition(vm, vmv1.StackReady, metav1.ConditionFalse, stackStatus, vm.Status.LastError)
+	default:
+		setCondition(vm, vmv1.StackReady, metav1.ConditionUnknown, stackStatus, "")
+	}
+}
+
+// setNetworkCondition derives NetworkReady from the network outputs of the stack
+func setNetworkCondition(vm *vmv1.VirtualMachine) {
+	if vm.Status.Network == "" || vm.Status.Subnet == "" {
+		setCondition(vm, vmv1.NetworkReady, metav1.ConditionFalse, "OutputMissing", "stack has no network or subnet output")
+		return
+	}
+	setCondition(vm, vmv1.NetworkReady, metav1.ConditionTrue, "StackComplete", "")
+}
+
+// setServersCondition derives ServersReady from the servers reported by the
+// stack outputs, every replica must have a server id
+func setServersCondition(vm *vmv1.VirtualMachine) {
+	if !strings.HasSuffix(vm.Status.VmStatus, "_COMPLETE") {
+		setCondition(vm, vmv1.ServersReady, metav1.ConditionFalse, vm.Status.VmStatus, vm.Status.LastError)
+		return
+	}
+	ready := 0
+	for _, server := range vm.Status.Servers {
+		if server.ID != "" {
+			ready++
+		}
+	}
+	if ready != int(vm.Spec.Server.Replicas) {
+		setCondition(vm, vmv1.ServersReady, metav1.ConditionFalse, "ServersMissing",
+			fmt.Sprintf("%d of %d servers reported by stack outputs", ready, vm.Spec.Server.Replicas))
+		return
+	}
+	setCondition(vm, vmv1.ServersReady, metav1.ConditionTrue, "StackComplete", "")
+}
+
+// templateError is a failure to resolve the templates of a vm, reason is the
+// reason of TemplateReady
+type templateError struct {
+	reason string
+	err    error
+}
+
+func (e *templateError) Error() string {
+	return e.err.Error()
+}
+
+// setTemplateCondition sets TemplateReady from the result of rendering the
+// templates of set, the message of success tells which templates are used
+func setTemplateCondition(vm *vmv1.VirtualMachine, set *vmtpl.Set, err error) {
+	if err != nil {
+		setCondition(vm, vmv1.TemplateReady, metav1.ConditionFalse, templateErrorReason(err), err.Error())
+		return
+	}
+	setCondition(vm, vmv1.TemplateReady, metav1.ConditionTrue, "Rendered",
+		fmt.Sprintf("templates of %s at version %s", set.Source, set.Version))
+}
+
+// templateErrorReason returns the reason of TemplateReady for err
+func templateErrorReason(err error) string {
+	if tplErr, ok := err.(*templateError); ok {
+		return tplErr.reason
+	}
+	return "InvalidTemplate"
+}
@@ -0,0 +1,135 @@
+/*
+Copyright 2020 easystack.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/gophercloud/gophercloud/openstack/orchestration/v1/stacks"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	fakecli "sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	vmv1 "easystack.io/vm-operator/pkg/api/v1"
+	"easystack.io/vm-operator/pkg/openstack"
+	"easystack.io/vm-operator/pkg/openstack/fake"
+	"easystack.io/vm-operator/pkg/utils"
+)
+
+func TestDeleteStack(t *testing.T) {
+	const projectID = "8e5eda4cac9f460ea2b471a357c42dd0"
+	ctx := utils.WithLogger(context.Background(), log.NullLogger{})
+
+	newVM := func(name string) *vmv1.VirtualMachine {
+		vm := &vmv1.VirtualMachine{ObjectMeta: metav1.ObjectMeta{
+			Namespace:  "default",
+			Name:       name,
+			UID:        types.UID("uid-" + name),
+			Finalizers: []string{vmFinalizer},
+		}}
+		vm.Spec.Project.ProjectID = projectID
+		vm.Spec.Project.Token = "token"
+		return vm
+	}
+	deleted := func(t *testing.T, heat *fake.Heat, vm *vmv1.VirtualMachine) *vmv1.VirtualMachine {
+		scheme := runtime.NewScheme()
+		_ = vmv1.AddToScheme(scheme)
+		_ = clientgoscheme.AddToScheme(scheme)
+		c := fakecli.NewFakeClientWithScheme(scheme, vm.DeepCopy())
+		r := NewVirtualMachine(c, c, record.NewFakeRecorder(10), log.NullLogger{}, heat, nil, 1)
+		if err := r.deleteStack(ctx, vm); err != nil {
+			t.Fatalf("deleteStack failed: %v", err)
+		}
+		if vm.Status.Phase == vmv1.Deleting {
+			if _, err := r.syncStackStatus(ctx, vm); err != nil {
+				t.Fatalf("syncStackStatus failed: %v", err)
+			}
+		}
+		var latest vmv1.VirtualMachine
+		if err := c.Get(ctx, types.NamespacedName{Namespace: vm.Namespace, Name: vm.Name}, &latest); err != nil {
+			t.Fatal(err)
+		}
+		return &latest
+	}
+
+	t.Run("without stack", func(t *testing.T) {
+		heat := fake.NewHeat(0)
+		if latest := deleted(t, heat, newVM("vm-none")); len(latest.Finalizers) != 0 {
+			t.Errorf("expected the finalizer to be removed, got %v", latest.Finalizers)
+		}
+	})
+
+	t.Run("lost status", func(t *testing.T) {
+		heat := fake.NewHeat(0)
+		vm := newVM("vm-lost")
+		if _, err := heat.StackCreate(ctx, projectID, &stacks.CreateOpts{Name: vm.StackName(), Tags: openstack.StackTags(stackOwner(vm, ""))}); err != nil {
+			t.Fatal(err)
+		}
+		latest := deleted(t, heat, vm)
+		if status := heat.Status(vm.StackName()); status != openstack.S_DELETE_COMPLETE {
+			t.Errorf("expected the stack missing from the status to be deleted, got %s", status)
+		}
+		if len(latest.Finalizers) != 0 {
+			t.Errorf("expected the finalizer to be removed, got %v", latest.Finalizers)
+		}
+	})
+
+	t.Run("missing secret", func(t *testing.T) {
+		heat := fake.NewHeat(0)
+		vm := newVM("vm-secret")
+		vm.Spec.Project.Token = ""
+		vm.Spec.Project.CredentialsSecretRef = &vmv1.SecretRef{Name: "deleted"}
+		id, err := heat.StackCreate(ctx, projectID, &stacks.CreateOpts{Name: vm.StackName(), Tags: openstack.StackTags(stackOwner(vm, ""))})
+		if err != nil {
+			t.Fatal(err)
+		}
+		vm.Status.StackName = vm.StackName()
+		vm.Status.StackID = id
+
+		latest := deleted(t, heat, vm)
+		if n := heat.Calls("StackAdminDelete"); n != 1 {
+			t.Errorf("expected the stack to be deleted as cloud admin, got %d calls", n)
+		}
+		if len(latest.Finalizers) != 0 {
+			t.Errorf("expected the finalizer to be removed, got %v", latest.Finalizers)
+		}
+	})
+
+	t.Run("expired token", func(t *testing.T) {
+		heat := fake.NewHeat(0)
+		vm := newVM("vm-expired")
+		id, err := heat.StackCreate(ctx, projectID, &stacks.CreateOpts{Name: vm.StackName(), Tags: openstack.StackTags(stackOwner(vm, ""))})
+		if err != nil {
+			t.Fatal(err)
+		}
+		heat.RejectAuth(projectID, openstack.ErrAuthExpired{ProjectID: projectID})
+		vm.Status.StackName = vm.StackName()
+		vm.Status.StackID = id
+
+		if latest := deleted(t, heat, vm); len(latest.Finalizers) != 0 {
+			t.Errorf("expected the finalizer to be removed, got %v", latest.Finalizers)
+		}
+		if status := heat.Status(vm.StackName()); status != openstack.S_DELETE_COMPLETE {
+			t.Errorf("expected the stack to be deleted, got %s", status)
+		}
+	})
+}
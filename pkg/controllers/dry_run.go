@@ -0,0 +1,189 @@
+/*
+Copyright 2020 easystack.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	vmv1 "easystack.io/vm-operator/pkg/api/v1"
+	"easystack.io/vm-operator/pkg/openstack"
+	vmtpl "easystack.io/vm-operator/pkg/templates"
+	"easystack.io/vm-operator/pkg/utils"
+	"github.com/gophercloud/gophercloud/openstack/orchestration/v1/stacks"
+	"gopkg.in/yaml.v2"
+	corev1 "k8s.io/api/core/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+const (
+	// dryRunLabel is set on the ConfigMap of a dry run to the name of its vm
+	dryRunLabel = "mixapp.easystack.io/virtualmachine"
+	// previewTimeout is the stack timeout in minutes sent with a preview, heat
+	// requires one
+	previewTimeout = 60
+
+	// keys of the ConfigMap of a dry run besides the rendered templates, which
+	// are keyed by their names
+	dryRunDigestKey     = "digest"
+	dryRunParametersKey = "parameters"
+	dryRunPreviewKey    = "preview"
+)
+
+// dryRunConfigMapName returns the name of the ConfigMap of the dry run of vm
+func dryRunConfigMapName(vm *vmv1.VirtualMachine) string {
+	return vm.Name + "-dry-run"
+}
+
+// dryRun renders the stack of vm into a ConfigMap instead of creating or
+// updating it. The stack is rendered again on every reconcile, the ConfigMap
+// is only written when the spec or what heat would receive changed.
+func (r *VirtualMachineReconciler) dryRun(ctx context.Context, vm *vmv1.VirtualMachine) (ctrl.Result, error) {
+	logger := utils.GetLogger(ctx)
+
+	template, params, err := r.renderStack(ctx, vm)
+	if err != nil {
+		logger.Error(err, "Failed to build stack of dry run")
+		r.doUpdateVmCrdStatus(ctx, vm)
+		return ctrl.Result{}, err
+	}
+	preview, err := r.redactedPreview(ctx, vm)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	last := vm.Status.DryRun
+	if last != nil && last.ObservedGeneration == vm.Generation && last.Digest == preview.Digest {
+		return ctrl.Result{}, nil
+	}
+	logger.Info("Dry run", "digest", preview.Digest)
+
+	data, err := dryRunData(preview)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	vm.Status.LastError = ""
+	if vm.Spec.DryRun.Preview {
+		previewed, err := r.previewStack(ctx, vm, template, params)
+		if openstack.IsAuthExpired(err) {
+			return r.handleAuthError(ctx, vm, err)
+		}
+		if err != nil {
+			// heat rejects the stack, which is what the preview is for, it's
+			// previewed again once the spec changes
+			logger.Error(err, "Preview Stack failed")
+			vm.Status.LastError = err.Error()
+		} else {
+			out, err := yaml.Marshal(previewed.Resources)
+			if err != nil {
+				return ctrl.Result{}, fmt.Errorf("failed to marshal preview of stack: %v", err)
+			}
+			data[dryRunPreviewKey] = string(out)
+			setAuthCondition(vm, nil)
+		}
+	}
+
+	if err := r.writeDryRunConfigMap(ctx, vm, data); err != nil {
+		return ctrl.Result{}, err
+	}
+	vm.Status.DryRun = &vmv1.DryRunStatus{
+		ConfigMap:          dryRunConfigMapName(vm),
+		Digest:             preview.Digest,
+		ObservedGeneration: vm.Generation,
+	}
+	return ctrl.Result{}, r.doUpdateVmCrdStatus(ctx, vm)
+}
+
+// redactedPreview returns the Preview of the stack of vm rendered without the
+// software config and the admin password, which may carry secrets, the
+// ConfigMap is readable by anyone reading the namespace
+func (r *VirtualMachineReconciler) redactedPreview(ctx context.Context, vm *vmv1.VirtualMachine) (*vmtpl.Preview, error) {
+	redacted := vm.DeepCopy()
+	redacted.Spec = *redactedSpec(&vm.Spec)
+	template, params, err := r.renderStack(ctx, redacted)
+	if err != nil {
+		return nil, err
+	}
+	rendered := map[string]string{vmtpl.RootTemplate: string(template.Bin)}
+	for name, content := range template.Files {
+		rendered[name] = content
+	}
+	return vmtpl.NewPreview(rendered, params)
+}
+
+func (r *VirtualMachineReconciler) previewStack(ctx context.Context, vm *vmv1.VirtualMachine, template *stacks.Template, params map[string]interface{}) (*stacks.PreviewedStack, error) {
+	if err := r.newHeatClient(ctx, vm); err != nil {
+		return nil, err
+	}
+	return r.osService.StackPreview(ctx, vm.Spec.Project.ProjectID, &stacks.PreviewOpts{
+		Name:         vm.StackName(),
+		Timeout:      previewTimeout,
+		TemplateOpts: template,
+		Parameters:   params,
+	})
+}
+
+// dryRunData returns the content of the ConfigMap of a dry run
+func dryRunData(preview *vmtpl.Preview) (map[string]string, error) {
+	data := make(map[string]string, len(preview.Templates)+2)
+	for name, content := range preview.Templates {
+		data[name] = content
+	}
+	out, err := yaml.Marshal(preview.Parameters)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal parameters of stack: %v", err)
+	}
+	data[dryRunParametersKey] = string(out)
+	data[dryRunDigestKey] = preview.Digest
+	return data, nil
+}
+
+// writeDryRunConfigMap creates or replaces the ConfigMap of the dry run of vm,
+// it's owned by vm so it's deleted along with it
+func (r *VirtualMachineReconciler) writeDryRunConfigMap(ctx context.Context, vm *vmv1.VirtualMachine, data map[string]string) error {
+	var cm corev1.ConfigMap
+	key := types.NamespacedName{Namespace: vm.Namespace, Name: dryRunConfigMapName(vm)}
+	err := r.cliReader.Get(ctx, key, &cm)
+	if err != nil && !apierrs.IsNotFound(err) {
+		return fmt.Errorf("failed to get dry run configmap %s: %v", key, err)
+	}
+	exists := err == nil
+
+	cm.Name = key.Name
+	cm.Namespace = key.Namespace
+	if cm.Labels == nil {
+		cm.Labels = make(map[string]string)
+	}
+	cm.Labels[dryRunLabel] = vm.Name
+	cm.OwnerReferences = []metav1.OwnerReference{
+		*metav1.NewControllerRef(vm, vmv1.GroupVersion.WithKind("VirtualMachine")),
+	}
+	cm.Data = data
+
+	if exists {
+		err = r.client.Update(ctx, &cm)
+	} else {
+		err = r.client.Create(ctx, &cm)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write dry run configmap %s: %v", key, err)
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+/*
+Copyright 2020 easystack.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	vmv1 "easystack.io/vm-operator/pkg/api/v1"
+	"easystack.io/vm-operator/pkg/openstack"
+	"easystack.io/vm-operator/pkg/utils"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// maxHeatEvents caps the failures of resources kept in the status
+const maxHeatEvents = 10
+
+// recordPhase emits an event for the phase of vm when it differs from the
+// phase of old, the status before the update. Failures are warnings with the
+// last error, and a new error of a failed vm is a failure again.
+func (r *VirtualMachineReconciler) recordPhase(vm *vmv1.VirtualMachine, old *vmv1.VirtualMachineStatus) {
+	phase := vm.Status.Phase
+	if phase == "" {
+		return
+	}
+	if phase == vmv1.Failed {
+		if old.Phase != phase || old.LastError != vm.Status.LastError {
+			r.recorder.Eventf(vm, corev1.EventTypeWarning, string(phase), "stack %s is %s: %s",
+				vm.StackName(), vm.Status.VmStatus, vm.Status.LastError)
+		}
+		return
+	}
+	if old.Phase != phase {
+		r.recorder.Eventf(vm, corev1.EventTypeNormal, string(phase), "stack %s is %s", vm.StackName(), vm.Status.VmStatus)
+	}
+}
+
+// syncHeatEvents records the failures of the resources of the failed stack of
+// vm, which tell why it failed, e.g. no valid host for a server. Heat events
+// already in the status or older than the latest one recorded aren't emitted
+// again. Heat times events to the second, the ones of the same second as the
+// latest one are told apart by their id.
+func (r *VirtualMachineReconciler) syncHeatEvents(ctx context.Context, vm *vmv1.VirtualMachine) {
+	logger := utils.GetLogger(ctx)
+
+	if !strings.HasSuffix(vm.Status.VmStatus, "_FAILED") || vm.Status.StackID == "" {
+		return
+	}
+	events, err := r.osService.StackEvents(ctx, vm.Spec.Project.ProjectID, vm.StackName(), vm.Status.StackID)
+	if err != nil {
+		logger.Error(err, "Failed to list stack events")
+		return
+	}
+
+	known := make(map[string]bool, len(vm.Status.HeatEvents))
+	for _, e := range vm.Status.HeatEvents {
+		known[e.ID] = true
+	}
+	var watermark time.Time
+	if vm.Status.LastHeatEventTime != nil {
+		watermark = vm.Status.LastHeatEventTime.Time
+	}
+	latest := watermark
+	for _, e := range openstack.FailedResourceEvents(vm.Status.StackID, events) {
+		if known[e.ID] || e.Time.Before(watermark) {
+			continue
+		}
+		if e.Time.After(latest) {
+			latest = e.Time
+		}
+		vm.Status.HeatEvents = append(vm.Status.HeatEvents, vmv1.HeatEvent{
+			ID:       e.ID,
+			Time:     metav1.NewTime(e.Time),
+			Resource: e.ResourceName,
+			Status:   e.ResourceStatus,
+			Reason:   e.ResourceStatusReason,
+		})
+		r.recorder.Eventf(vm, corev1.EventTypeWarning, "StackResourceFailed", "resource %s of stack %s is %s: %s",
+			e.ResourceName, vm.StackName(), e.ResourceStatus, e.ResourceStatusReason)
+	}
+	if latest.After(watermark) {
+		t := metav1.NewTime(latest)
+		vm.Status.LastHeatEventTime = &t
+	}
+	if n := len(vm.Status.HeatEvents); n > maxHeatEvents {
+		vm.Status.HeatEvents = vm.Status.HeatEvents[n-maxHeatEvents:]
+	}
+}
@@ -0,0 +1,154 @@
+/*
+Copyright 2020 easystack.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gophercloud/gophercloud/openstack/orchestration/v1/stackevents"
+	"github.com/gophercloud/gophercloud/openstack/orchestration/v1/stacks"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+	fakecli "sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	vmv1 "easystack.io/vm-operator/pkg/api/v1"
+	"easystack.io/vm-operator/pkg/openstack"
+	"easystack.io/vm-operator/pkg/openstack/fake"
+	"easystack.io/vm-operator/pkg/utils"
+)
+
+func TestFailedStackEvents(t *testing.T) {
+	const projectID = "8e5eda4cac9f460ea2b471a357c42dd0"
+	ctx := utils.WithLogger(context.Background(), log.NullLogger{})
+	heat := fake.NewHeat(0)
+	heat.FailNext("CREATE", "vm-failed", "No valid host was found")
+	id, err := heat.StackCreate(ctx, projectID, &stacks.CreateOpts{Name: "vm-failed"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vm := &vmv1.VirtualMachine{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "vm-failed"}}
+	vm.Spec.Project.ProjectID = projectID
+	vm.Status.Phase = vmv1.Creating
+	vm.Status.VmStatus = openstack.S_CREATE_IN_PROGRESS
+	vm.Status.StackID = id
+	vm.Status.StackName = "vm-failed"
+	scheme := runtime.NewScheme()
+	_ = vmv1.AddToScheme(scheme)
+	c := fakecli.NewFakeClientWithScheme(scheme, vm.DeepCopy())
+	recorder := record.NewFakeRecorder(10)
+	r := NewVirtualMachine(c, c, recorder, log.NullLogger{}, heat, nil, 1)
+
+	events := func() []string {
+		var list []string
+		for len(recorder.Events) > 0 {
+			list = append(list, <-recorder.Events)
+		}
+		return list
+	}
+
+	if _, err := r.syncStackStatus(ctx, vm); err != nil {
+		t.Fatalf("syncStackStatus failed: %v", err)
+	}
+	if len(vm.Status.HeatEvents) != 1 {
+		t.Fatalf("expected the failure of one resource, got %+v", vm.Status.HeatEvents)
+	}
+	if e := vm.Status.HeatEvents[0]; e.Resource != "server" || e.Status != openstack.S_CREATE_FAILED || e.Reason != "No valid host was found" {
+		t.Errorf("unexpected failure %+v", e)
+	}
+	got := events()
+	if len(got) != 2 ||
+		!strings.HasPrefix(got[0], "Warning StackResourceFailed resource server of stack vm-failed is CREATE_FAILED") ||
+		!strings.HasPrefix(got[1], "Warning Failed stack vm-failed is CREATE_FAILED: No valid host was found") {
+		t.Errorf("expected the resource failure and the phase, got %q", got)
+	}
+
+	// failures already in the status aren't emitted again
+	r.syncHeatEvents(ctx, vm)
+	if len(vm.Status.HeatEvents) != 1 {
+		t.Errorf("expected no new failure, got %+v", vm.Status.HeatEvents)
+	}
+	if got := events(); len(got) != 0 {
+		t.Errorf("expected no event, got %q", got)
+	}
+
+	// nor are the ones trimmed from the status, older than the latest one
+	if vm.Status.LastHeatEventTime == nil {
+		t.Fatal("expected the time of the latest failure to be recorded")
+	}
+	later := metav1.NewTime(vm.Status.LastHeatEventTime.Add(time.Second))
+	vm.Status.LastHeatEventTime = &later
+	vm.Status.HeatEvents = nil
+	r.syncHeatEvents(ctx, vm)
+	if len(vm.Status.HeatEvents) != 0 {
+		t.Errorf("expected no failure before the watermark, got %+v", vm.Status.HeatEvents)
+	}
+	if got := events(); len(got) != 0 {
+		t.Errorf("expected no event, got %q", got)
+	}
+}
+
+// eventsHeat returns events as the events of every stack
+type eventsHeat struct {
+	*fake.Heat
+	events []stackevents.Event
+}
+
+func (h *eventsHeat) StackEvents(ctx context.Context, projectID string, stackName string, stackID string) ([]stackevents.Event, error) {
+	return h.events, nil
+}
+
+func TestFailedStackEventsOfTheSameSecond(t *testing.T) {
+	ctx := utils.WithLogger(context.Background(), log.NullLogger{})
+	vm := &vmv1.VirtualMachine{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "vm-failed"}}
+	vm.Status.VmStatus = openstack.S_CREATE_FAILED
+	vm.Status.StackID = "stack-1"
+	vm.Status.StackName = "vm-failed"
+
+	second := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	failure := func(id string, resource string) stackevents.Event {
+		return stackevents.Event{
+			ID:                   id,
+			Time:                 second,
+			ResourceName:         resource,
+			PhysicalResourceID:   "resource-" + resource,
+			ResourceStatus:       openstack.S_CREATE_FAILED,
+			ResourceStatusReason: "No valid host was found",
+		}
+	}
+	heat := &eventsHeat{Heat: fake.NewHeat(0), events: []stackevents.Event{failure("event-1", "server-0")}}
+	recorder := record.NewFakeRecorder(10)
+	r := NewVirtualMachine(nil, nil, recorder, log.NullLogger{}, heat, nil, 1)
+
+	r.syncHeatEvents(ctx, vm)
+	// heat lists another failure of the same second on the next sync
+	heat.events = append(heat.events, failure("event-2", "server-1"))
+	r.syncHeatEvents(ctx, vm)
+	r.syncHeatEvents(ctx, vm)
+
+	if len(vm.Status.HeatEvents) != 2 || vm.Status.HeatEvents[1].Resource != "server-1" {
+		t.Errorf("expected both failures, got %+v", vm.Status.HeatEvents)
+	}
+	if n := len(recorder.Events); n != 2 {
+		t.Errorf("expected one event per failure, got %d", n)
+	}
+}
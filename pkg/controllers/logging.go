@@ -0,0 +1,60 @@
+/*
+Copyright 2020 easystack.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+
+	vmv1 "easystack.io/vm-operator/pkg/api/v1"
+	"easystack.io/vm-operator/pkg/openstack"
+	"easystack.io/vm-operator/pkg/utils"
+	"github.com/go-logr/logr"
+)
+
+// vmLogger returns logger with the fields of vm, its key, its project and the
+// id of its stack once it has one. The openstack service logs with it too, so
+// its calls are logged with the vm they're made for.
+func vmLogger(logger logr.Logger, vm *vmv1.VirtualMachine) logr.Logger {
+	logger = logger.WithValues("vm", vmKey(vm), "project", vm.Spec.Project.ProjectID)
+	if vm.Status.StackID != "" {
+		logger = logger.WithValues("stackID", vm.Status.StackID)
+	}
+	return logger
+}
+
+// withVM returns ctx for the calls made on behalf of vm: its logger is given
+// the fields of vm and openstack clients are the ones of the credential of vm
+func withVM(ctx context.Context, vm *vmv1.VirtualMachine) context.Context {
+	ctx = utils.WithLogger(ctx, vmLogger(utils.GetLogger(ctx), vm))
+	return openstack.WithCredentialSource(ctx, credentialSource(vm))
+}
+
+// redactedSpec returns a copy of spec to log, the token of the project, the
+// admin password and the software config, which may carry secrets, are hidden
+func redactedSpec(spec *vmv1.VirtualMachineSpec) *vmv1.VirtualMachineSpec {
+	redacted := spec.DeepCopy()
+	if redacted.Project.Token != "" {
+		redacted.Project.Token = hiddenValue
+	}
+	if redacted.Server.AdminPass != "" {
+		redacted.Server.AdminPass = hiddenValue
+	}
+	if len(redacted.SoftwareConfig) > 0 {
+		redacted.SoftwareConfig = []byte(hiddenValue)
+	}
+	return redacted
+}
@@ -0,0 +1,48 @@
+/*
+Copyright 2020 easystack.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	vmv1 "easystack.io/vm-operator/pkg/api/v1"
+)
+
+func TestRedactedSpec(t *testing.T) {
+	spec := &vmv1.VirtualMachineSpec{}
+	spec.Project.ProjectID = "8e5eda4cac9f460ea2b471a357c42dd0"
+	spec.Project.Token = "gAAAAABe-secret-token"
+	spec.Server.AdminPass = "secret-password"
+	spec.Server.NamePrefix = "web"
+	spec.SoftwareConfig = []byte("#cloud-config\npassword: secret-config\n")
+
+	redacted := fmt.Sprintf("%+v", redactedSpec(spec))
+	for _, secret := range []string{"secret-token", "secret-password", "secret-config"} {
+		if strings.Contains(redacted, secret) {
+			t.Errorf("expected %s to be hidden, got %s", secret, redacted)
+		}
+	}
+	if !strings.Contains(redacted, spec.Project.ProjectID) || !strings.Contains(redacted, "web") {
+		t.Errorf("expected the other fields to be kept, got %s", redacted)
+	}
+	// the spec itself is left alone
+	if spec.Project.Token != "gAAAAABe-secret-token" || spec.Server.AdminPass != "secret-password" {
+		t.Errorf("expected spec to be unchanged, got %+v", spec)
+	}
+}
@@ -0,0 +1,109 @@
+/*
+Copyright 2020 easystack.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	vmv1 "easystack.io/vm-operator/pkg/api/v1"
+	"github.com/prometheus/client_golang/prometheus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	cli "sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+var (
+	stackOperationDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "vm_operator_stack_operation_duration_seconds",
+		Help:    "Time from triggering a stack operation until the stack is complete or failed, by operation and result.",
+		Buckets: prometheus.ExponentialBuckets(10, 2, 10),
+	}, []string{"operation", "result"})
+	resyncDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "vm_operator_resync_duration_seconds",
+		Help:    "Duration of resyncing the status of all VirtualMachines in one batch.",
+		Buckets: prometheus.ExponentialBuckets(0.1, 2, 12),
+	})
+	templateRenderFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "vm_operator_template_render_failures_total",
+		Help: "Number of failures to render the templates of a VirtualMachine, by reason of TemplateReady.",
+	}, []string{"reason"})
+	orphanStacks = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "vm_operator_orphan_stacks",
+		Help: "Number of tagged stacks without VirtualMachine found by the last orphan collection, by project.",
+	}, []string{"project"})
+	orphanStacksDeleted = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "vm_operator_orphan_stacks_deleted_total",
+		Help: "Number of deletions of orphan stacks, by result.",
+	}, []string{"result"})
+)
+
+func init() {
+	// served by the metrics endpoint of the manager
+	metrics.Registry.MustRegister(orphanStacks, orphanStacksDeleted, stackOperationDuration, resyncDuration, templateRenderFailures)
+}
+
+// observeStackOperation records the duration of the stack operation of vm
+// ending in stackStatus, e.g. CREATE_COMPLETE. The operation started when
+// StackReady became Unknown, so it must be called before the condition is set
+// from stackStatus.
+func observeStackOperation(vm *vmv1.VirtualMachine, stackStatus string) {
+	i := strings.LastIndex(stackStatus, "_")
+	if i < 0 {
+		return
+	}
+	for _, cond := range vm.Status.Conditions {
+		if cond.Type == vmv1.StackReady && cond.Status == metav1.ConditionUnknown {
+			stackOperationDuration.WithLabelValues(strings.ToLower(stackStatus[:i]), strings.ToLower(stackStatus[i+1:])).
+				Observe(time.Since(cond.LastTransitionTime.Time).Seconds())
+		}
+	}
+}
+
+var virtualMachinesDesc = prometheus.NewDesc("vm_operator_virtualmachines",
+	"Number of VirtualMachines by phase and project.", []string{"phase", "project"}, nil)
+
+// vmCollector counts the VirtualMachines of the cache of the manager when
+// the metrics are scraped
+type vmCollector struct {
+	client cli.Reader
+}
+
+func (c *vmCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- virtualMachinesDesc
+}
+
+func (c *vmCollector) Collect(ch chan<- prometheus.Metric) {
+	var vmList vmv1.VirtualMachineList
+	if err := c.client.List(context.Background(), &vmList); err != nil {
+		ch <- prometheus.NewInvalidMetric(virtualMachinesDesc, err)
+		return
+	}
+	type key struct {
+		phase   string
+		project string
+	}
+	counts := make(map[key]int)
+	for i := range vmList.Items {
+		vm := &vmList.Items[i]
+		counts[key{string(vm.Status.Phase), vm.Spec.Project.ProjectID}]++
+	}
+	for k, n := range counts {
+		ch <- prometheus.MustNewConstMetric(virtualMachinesDesc, prometheus.GaugeValue, float64(n), k.phase, k.project)
+	}
+}
@@ -0,0 +1,100 @@
+/*
+Copyright 2020 easystack.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	fakecli "sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+
+	vmv1 "easystack.io/vm-operator/pkg/api/v1"
+	"easystack.io/vm-operator/pkg/openstack"
+)
+
+func TestVmCollector(t *testing.T) {
+	newVM := func(name string, project string, phase vmv1.AssemblyPhaseType) *vmv1.VirtualMachine {
+		vm := &vmv1.VirtualMachine{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: name}}
+		vm.Spec.Project.ProjectID = project
+		vm.Status.Phase = phase
+		return vm
+	}
+	scheme := runtime.NewScheme()
+	_ = vmv1.AddToScheme(scheme)
+	c := fakecli.NewFakeClientWithScheme(scheme,
+		newVM("a", "project-a", vmv1.Succeeded),
+		newVM("b", "project-a", vmv1.Succeeded),
+		newVM("c", "project-a", vmv1.Creating),
+		newVM("d", "project-b", vmv1.Failed))
+
+	expected := `
+# HELP vm_operator_virtualmachines Number of VirtualMachines by phase and project.
+# TYPE vm_operator_virtualmachines gauge
+vm_operator_virtualmachines{phase="Creating",project="project-a"} 1
+vm_operator_virtualmachines{phase="Failed",project="project-b"} 1
+vm_operator_virtualmachines{phase="Succeeded",project="project-a"} 2
+`
+	if err := testutil.CollectAndCompare(&vmCollector{client: c}, strings.NewReader(expected)); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestObserveStackOperation(t *testing.T) {
+	samples := func(operation string, result string) uint64 {
+		families, err := metrics.Registry.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, family := range families {
+			if family.GetName() != "vm_operator_stack_operation_duration_seconds" {
+				continue
+			}
+		metric:
+			for _, m := range family.GetMetric() {
+				for _, label := range m.GetLabel() {
+					if (label.GetName() == "operation" && label.GetValue() != operation) ||
+						(label.GetName() == "result" && label.GetValue() != result) {
+						continue metric
+					}
+				}
+				return m.GetHistogram().GetSampleCount()
+			}
+		}
+		return 0
+	}
+
+	vm := &vmv1.VirtualMachine{}
+	vm.Status.Phase = vmv1.Creating
+	vm.Status.VmStatus = openstack.S_CREATE_IN_PROGRESS
+	setStackCondition(vm)
+	vm.Status.Conditions[0].LastTransitionTime = metav1.NewTime(time.Now().Add(-time.Minute))
+
+	applyStackStatus(vm, openstack.S_CREATE_COMPLETE, "")
+	if n := samples("create", "complete"); n != 1 {
+		t.Errorf("expected the creation to be observed, got %d", n)
+	}
+	// the stack is ready, nothing is in progress anymore
+	observeStackOperation(vm, openstack.S_UPDATE_COMPLETE)
+	if n := samples("update", "complete"); n != 0 {
+		t.Errorf("expected no observation without operation in progress, got %d", n)
+	}
+}
@@ -0,0 +1,184 @@
+/*
+Copyright 2020 easystack.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	vmv1 "easystack.io/vm-operator/pkg/api/v1"
+	"easystack.io/vm-operator/pkg/openstack"
+	"easystack.io/vm-operator/pkg/utils"
+	"github.com/go-logr/logr"
+	"github.com/gophercloud/gophercloud/openstack/orchestration/v1/stacks"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	cli "sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// OrphanCollector finds the stacks tagged by the operator which no
+// VirtualMachine owns, left behind when a VirtualMachine went away without its
+// stack or when the status recording a new stack was lost. A stack is owned
+// by the VirtualMachine whose uid is in its tags or whose status has its id.
+// Orphans are reported by metrics and events on the VirtualMachine of their
+// tags, and deleted once orphaned for the grace period unless reportOnly.
+// Only the stacks tagged with clusterID are collected, the VirtualMachines of
+// other clusters sharing the cloud aren't known. Stacks tagged before owners
+// were recorded are only reported, nothing tells they aren't owned by a
+// VirtualMachine of another cluster.
+type OrphanCollector struct {
+	cliReader   cli.Reader
+	recorder    record.EventRecorder
+	log         logr.Logger
+	osService   openstack.Service
+	period      time.Duration
+	gracePeriod time.Duration
+	reportOnly  bool
+	clusterID   string
+
+	// orphanedSince is when each orphan was first found, by stack id. It's
+	// not persisted, so the grace period starts over on restart.
+	orphanedSince map[string]time.Time
+	now           func() time.Time
+}
+
+func NewOrphanCollector(r cli.Reader, recorder record.EventRecorder, logger logr.Logger, oss openstack.Service, period time.Duration, gracePeriod time.Duration, reportOnly bool, clusterID string) *OrphanCollector {
+	return &OrphanCollector{
+		cliReader:     r,
+		recorder:      recorder,
+		log:           logger,
+		osService:     oss,
+		period:        period,
+		gracePeriod:   gracePeriod,
+		reportOnly:    reportOnly,
+		clusterID:     clusterID,
+		orphanedSince: make(map[string]time.Time),
+		now:           time.Now,
+	}
+}
+
+// Start collects orphans every period until stop is closed. Added to the
+// manager, it only runs on the leader.
+func (c *OrphanCollector) Start(stop <-chan struct{}) error {
+	ctx := utils.WithLogger(context.Background(), c.log)
+
+	ticker := time.NewTicker(c.period)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return nil
+		case <-ticker.C:
+			if err := c.collect(ctx); err != nil {
+				c.log.Error(err, "Failed to collect orphan stacks")
+			}
+		}
+	}
+}
+
+// collect runs one collection, the stacks are listed before the
+// VirtualMachines so a stack is never listed without the one creating it
+func (c *OrphanCollector) collect(ctx context.Context) error {
+	stackList, err := c.osService.StackListAll(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list stacks: %v", err)
+	}
+	var vmList vmv1.VirtualMachineList
+	if err := c.cliReader.List(ctx, &vmList); err != nil {
+		return fmt.Errorf("failed to list vm crd: %v", err)
+	}
+
+	uids := make(map[types.UID]bool, len(vmList.Items))
+	stackIDs := make(map[string]bool, len(vmList.Items))
+	for i := range vmList.Items {
+		uids[vmList.Items[i].UID] = true
+		if vmList.Items[i].Status.StackID != "" {
+			stackIDs[vmList.Items[i].Status.StackID] = true
+		}
+	}
+
+	now := c.now()
+	orphaned := make(map[string]time.Time)
+	orphanStacks.Reset()
+	for i := range stackList {
+		stack := &stackList[i]
+		owner, tagged := openstack.StackOwnerOf(stack.Tags)
+		// the stack of another cluster, or of a cluster without id
+		if tagged && owner.Cluster != c.clusterID {
+			continue
+		}
+		if stackIDs[stack.ID] || (tagged && uids[types.UID(owner.UID)]) {
+			continue
+		}
+		projectID := openstack.ListedStackProjectID(stack)
+		orphanStacks.WithLabelValues(projectID).Inc()
+		logger := c.log.WithValues("project", projectID, "stackID", stack.ID, "stack", stack.Name)
+
+		since, seen := c.orphanedSince[stack.ID]
+		if !seen {
+			since = now
+			logger.Info("Found orphan stack", "owner", owner)
+			c.eventf(owner, corev1.EventTypeWarning, "OrphanStack",
+				"stack %s/%s of project %s has no VirtualMachine", stack.Name, stack.ID, projectID)
+		}
+		orphaned[stack.ID] = since
+
+		if c.reportOnly || !tagged || stack.Status == openstack.S_DELETE_IN_PROGRESS || now.Sub(since) < c.gracePeriod {
+			continue
+		}
+		c.deleteOrphan(utils.WithLogger(ctx, logger), stack, owner, projectID)
+	}
+	// stacks gone or owned again are forgotten
+	c.orphanedSince = orphaned
+	return nil
+}
+
+func (c *OrphanCollector) deleteOrphan(ctx context.Context, stack *stacks.ListedStack, owner openstack.StackOwner, projectID string) {
+	logger := utils.GetLogger(ctx)
+
+	err := c.osService.StackAdminDelete(ctx, projectID, stack.Name, stack.ID)
+	if err != nil {
+		logger.Error(err, "Failed to delete orphan stack")
+		orphanStacksDeleted.WithLabelValues("error").Inc()
+		c.eventf(owner, corev1.EventTypeWarning, "OrphanStackDeleteFailed",
+			"failed to delete orphan stack %s/%s of project %s: %v", stack.Name, stack.ID, projectID, err)
+		return
+	}
+	logger.Info("Deleting orphan stack")
+	orphanStacksDeleted.WithLabelValues("success").Inc()
+	c.eventf(owner, corev1.EventTypeNormal, "OrphanStackDeleted",
+		"deleting orphan stack %s/%s of project %s, orphaned for over %v", stack.Name, stack.ID, projectID, c.gracePeriod)
+}
+
+// eventf records an event on the VirtualMachine owner of an orphan stack,
+// there is none for stacks tagged before owners were recorded, their namespace
+// is unknown
+func (c *OrphanCollector) eventf(owner openstack.StackOwner, eventtype string, reason string, messageFmt string, args ...interface{}) {
+	if owner.Namespace == "" {
+		return
+	}
+	ref := &corev1.ObjectReference{
+		APIVersion: vmv1.GroupVersion.String(),
+		Kind:       "VirtualMachine",
+		Namespace:  owner.Namespace,
+		Name:       owner.Name,
+		UID:        types.UID(owner.UID),
+	}
+	c.recorder.Eventf(ref, eventtype, reason, messageFmt, args...)
+}
@@ -0,0 +1,128 @@
+/*
+Copyright 2020 easystack.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gophercloud/gophercloud/openstack/orchestration/v1/stacks"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+	fakecli "sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	vmv1 "easystack.io/vm-operator/pkg/api/v1"
+	"easystack.io/vm-operator/pkg/openstack"
+	"easystack.io/vm-operator/pkg/openstack/fake"
+	"easystack.io/vm-operator/pkg/utils"
+)
+
+func TestOrphanCollector(t *testing.T) {
+	const projectID = "8e5eda4cac9f460ea2b471a357c42dd0"
+	ctx := utils.WithLogger(context.Background(), log.NullLogger{})
+	heat := fake.NewHeat(0)
+	create := func(name string, tags []string) string {
+		id, err := heat.StackCreate(ctx, projectID, &stacks.CreateOpts{Name: name, Tags: tags})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+
+	owned := &vmv1.VirtualMachine{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "owned", UID: "uid-owned"}}
+	create("owned", openstack.StackTags(stackOwner(owned, "cluster-a")))
+	// stacks tagged before owners were recorded are owned by their id
+	legacy := &vmv1.VirtualMachine{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "legacy", UID: "uid-legacy"}}
+	legacy.Status.StackID = create("legacy", []string{openstack.StackTag})
+	gone := &vmv1.VirtualMachine{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "gone", UID: "uid-gone"}}
+	create("gone", openstack.StackTags(stackOwner(gone, "cluster-a")))
+	// the VirtualMachines of other clusters sharing the cloud aren't known
+	other := &vmv1.VirtualMachine{ObjectMeta: metav1.ObjectMeta{Namespace: "default", Name: "other", UID: "uid-other"}}
+	create("other", openstack.StackTags(stackOwner(other, "cluster-b")))
+	create("no-cluster", openstack.StackTags(stackOwner(other, "")))
+	// an untagged orphan may belong to another cluster, it's only reported
+	create("untagged", []string{openstack.StackTag})
+
+	scheme := runtime.NewScheme()
+	_ = vmv1.AddToScheme(scheme)
+	recorder := record.NewFakeRecorder(10)
+	gc := NewOrphanCollector(fakecli.NewFakeClientWithScheme(scheme, owned, legacy), recorder, log.NullLogger{}, heat, time.Minute, time.Hour, true, "cluster-a")
+	now := time.Now()
+	gc.now = func() time.Time { return now }
+
+	events := func() []string {
+		var list []string
+		for len(recorder.Events) > 0 {
+			list = append(list, <-recorder.Events)
+		}
+		return list
+	}
+
+	// report only never deletes
+	for i := 0; i < 2; i++ {
+		if err := gc.collect(ctx); err != nil {
+			t.Fatalf("collect failed: %v", err)
+		}
+		now = now.Add(2 * time.Hour)
+	}
+	if got := events(); len(got) != 1 || !strings.HasPrefix(got[0], "Warning OrphanStack stack gone/") {
+		t.Errorf("expected one event of the orphan, got %q", got)
+	}
+	if n := heat.Calls("StackAdminDelete"); n != 0 {
+		t.Errorf("expected no deletion in report mode, got %d", n)
+	}
+
+	gc.reportOnly = false
+	gc.orphanedSince = make(map[string]time.Time)
+	if err := gc.collect(ctx); err != nil {
+		t.Fatalf("collect failed: %v", err)
+	}
+	if n := heat.Calls("StackAdminDelete"); n != 0 {
+		t.Errorf("expected no deletion within the grace period, got %d", n)
+	}
+	now = now.Add(time.Hour)
+	if err := gc.collect(ctx); err != nil {
+		t.Fatalf("collect failed: %v", err)
+	}
+	if status := heat.Status("gone"); status != openstack.S_DELETE_COMPLETE {
+		t.Errorf("expected the orphan to be deleted, got %s", status)
+	}
+	for _, name := range []string{"owned", "legacy", "untagged", "other", "no-cluster"} {
+		if status := heat.Status(name); status != openstack.S_CREATE_COMPLETE {
+			t.Errorf("expected stack %s to be kept, got %s", name, status)
+		}
+	}
+	if got := events(); len(got) != 2 || !strings.HasPrefix(got[1], "Normal OrphanStackDeleted") {
+		t.Errorf("expected the deletion to be reported, got %q", got)
+	}
+
+	// deleted stacks are forgotten
+	if err := gc.collect(ctx); err != nil {
+		t.Fatalf("collect failed: %v", err)
+	}
+	if len(gc.orphanedSince) != 1 {
+		t.Errorf("expected only the untagged orphan left, got %v", gc.orphanedSince)
+	}
+	if n := testutil.ToFloat64(orphanStacks.WithLabelValues(projectID)); n != 1 {
+		t.Errorf("expected the untagged orphan to be reported, got %v", n)
+	}
+}
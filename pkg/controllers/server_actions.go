@@ -0,0 +1,110 @@
+/*
+Copyright 2020 easystack.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	vmv1 "easystack.io/vm-operator/pkg/api/v1"
+	"easystack.io/vm-operator/pkg/utils"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// runServerAction runs the action requested by the annotations of vm on its
+// servers. The annotations are removed before the action is run, so it's run
+// at most once, ActionCompleted of vm reports the result.
+func (r *VirtualMachineReconciler) runServerAction(ctx context.Context, vm *vmv1.VirtualMachine) error {
+	logger := utils.GetLogger(ctx)
+
+	action := vm.Annotations[vmv1.ActionAnnotation]
+	names := vm.Annotations[vmv1.ActionServersAnnotation]
+	delete(vm.Annotations, vmv1.ActionAnnotation)
+	delete(vm.Annotations, vmv1.ActionServersAnnotation)
+	if err := r.doUpdateVmCrd(ctx, vm); err != nil {
+		return err
+	}
+
+	logger.Info("Server action", "action", action, "servers", names)
+	servers, err := actionServers(vm, names)
+	if err == nil {
+		err = r.newHeatClient(ctx, vm)
+	}
+	var failed string
+	for _, server := range servers {
+		if err != nil {
+			break
+		}
+		switch action {
+		case vmv1.ActionReboot, vmv1.ActionHardReboot:
+			err = r.osService.ServerReboot(ctx, vm.Spec.Project.ProjectID, server.ID, action == vmv1.ActionHardReboot)
+		case vmv1.ActionRebuild:
+			// the boot volume of the server is reimaged
+			err = r.osService.ServerRebuild(ctx, vm.Spec.Project.ProjectID, server.ID, vm.Spec.Server.Image, server.BootVolumeID != "")
+		default:
+			err = fmt.Errorf("unknown action %q", action)
+		}
+		failed = server.Name
+	}
+
+	if err != nil {
+		message := err.Error()
+		if failed != "" {
+			message = fmt.Sprintf("%s of server %s failed: %v", action, failed, err)
+		}
+		logger.Error(err, "Server action failed", "server", failed)
+		setCondition(vm, vmv1.ActionCompleted, metav1.ConditionFalse, "ActionFailed", message)
+	} else {
+		serverNames := make([]string, 0, len(servers))
+		for _, server := range servers {
+			serverNames = append(serverNames, server.Name)
+		}
+		setCondition(vm, vmv1.ActionCompleted, metav1.ConditionTrue, "ActionTriggered",
+			fmt.Sprintf("%s of %s", action, strings.Join(serverNames, ", ")))
+	}
+	setAuthCondition(vm, err)
+	return r.doUpdateVmCrdStatus(ctx, vm)
+}
+
+// actionServers returns the servers of vm with the comma separated names, all
+// of its servers if names is empty
+func actionServers(vm *vmv1.VirtualMachine, names string) ([]vmv1.ServerStatus, error) {
+	if len(vm.Status.Servers) == 0 {
+		return nil, fmt.Errorf("stack has no servers yet")
+	}
+	if names == "" {
+		return vm.Status.Servers, nil
+	}
+
+	var servers []vmv1.ServerStatus
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		found := false
+		for _, s := range vm.Status.Servers {
+			if s.Name == name {
+				servers = append(servers, s)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("server %s not found in stack", name)
+		}
+	}
+	return servers, nil
+}
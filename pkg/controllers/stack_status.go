@@ -0,0 +1,367 @@
+/*
+Copyright 2020 easystack.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	vmv1 "easystack.io/vm-operator/pkg/api/v1"
+	"easystack.io/vm-operator/pkg/openstack"
+	"easystack.io/vm-operator/pkg/utils"
+	"github.com/gophercloud/gophercloud/openstack/orchestration/v1/stacks"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+// maxRequeuePeriod caps the backoff of polling a stack in progress
+const maxRequeuePeriod = 5 * time.Minute
+
+// requeueBackoff hands out exponentially growing requeue periods per vm
+type requeueBackoff struct {
+	mu    sync.Mutex
+	base  time.Duration
+	max   time.Duration
+	steps map[types.NamespacedName]uint
+}
+
+func newRequeueBackoff(base time.Duration, max time.Duration) *requeueBackoff {
+	return &requeueBackoff{
+		base:  base,
+		max:   max,
+		steps: make(map[types.NamespacedName]uint),
+	}
+}
+
+func (b *requeueBackoff) next(key types.NamespacedName) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	step := b.steps[key]
+	d := b.base << step
+	if d <= 0 || d >= b.max {
+		return b.max
+	}
+	b.steps[key] = step + 1
+	return d
+}
+
+func (b *requeueBackoff) reset(key types.NamespacedName) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.steps, key)
+}
+
+func inProgress(phase vmv1.AssemblyPhaseType) bool {
+	return phase == vmv1.Creating || phase == vmv1.Updating || phase == vmv1.Deleting
+}
+
+// requeue polls the stack of vm again after the next backoff period while it's
+// in progress
+func (r *VirtualMachineReconciler) requeue(vm *vmv1.VirtualMachine) ctrl.Result {
+	key := vmKey(vm)
+	if !inProgress(vm.Status.Phase) {
+		r.backoff.reset(key)
+		return ctrl.Result{}
+	}
+	return ctrl.Result{RequeueAfter: r.backoff.next(key)}
+}
+
+// syncStackStatus refreshes the status of vm from its own heat stack, vm is
+// requeued with backoff until the stack leaves the in progress state.
+func (r *VirtualMachineReconciler) syncStackStatus(ctx context.Context, vm *vmv1.VirtualMachine) (ctrl.Result, error) {
+	logger := utils.GetLogger(ctx)
+
+	stack, err := r.osService.StackGet(ctx, vm.Spec.Project.ProjectID, vm.StackName(), vm.Status.StackID)
+	// a stack deleted as cloud admin is followed as cloud admin
+	if err != nil && !openstack.IsNotFound(err) && vm.Status.Phase == vmv1.Deleting {
+		stack, err = r.osService.StackAdminGet(ctx, vm.Spec.Project.ProjectID, vm.StackName(), vm.Status.StackID)
+	}
+	if err != nil {
+		if openstack.IsNotFound(err) && vm.Status.Phase == vmv1.Deleting {
+			r.backoff.reset(vmKey(vm))
+			return ctrl.Result{}, r.removeFinalizer(ctx, vm)
+		}
+		logger.Error(err, "Failed to get stack")
+		if setAuthCondition(vm, err) {
+			if err := r.doUpdateVmCrdStatus(ctx, vm); err != nil {
+				return ctrl.Result{}, err
+			}
+		}
+		return r.requeue(vm), nil
+	}
+
+	// 1. release vm crd if phase is deleting and stack is gone
+	if vm.Status.Phase == vmv1.Deleting && stack.Status == openstack.S_DELETE_COMPLETE {
+		r.backoff.reset(vmKey(vm))
+		return ctrl.Result{}, r.removeFinalizer(ctx, vm)
+	}
+
+	// 2. update vm status
+	if applyStackStatus(vm, stack.Status, stack.StatusReason) {
+		logger.Info("Stack status changed", "status", stack.Status, "phase", vm.Status.Phase)
+		setAuthCondition(vm, nil)
+		if vm.Status.Phase == vmv1.Succeeded {
+			applyStackOutputs(vm, stack)
+		}
+		r.syncHeatEvents(ctx, vm)
+		if err := r.doUpdateVmCrdStatus(ctx, vm); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+
+	return r.requeue(vm), nil
+}
+
+// applyStackStatus moves vm to the phase matching the status of its heat stack,
+// it reports whether the status of vm changed
+func applyStackStatus(vm *vmv1.VirtualMachine, stackStatus string, reason string) bool {
+	if vm.Status.VmStatus == stackStatus {
+		return false
+	}
+
+	switch vm.Status.Phase {
+	case vmv1.Deleting:
+		vm.Status.VmStatus = stackStatus
+		if stackStatus == openstack.S_DELETE_FAILED {
+			// reconcile triggered by this update will retry the deletion
+			observeStackOperation(vm, stackStatus)
+			vm.Status.Phase = vmv1.Failed
+			vm.Status.LastError = reason
+		}
+	case vmv1.Creating, vmv1.Updating:
+		vm.Status.VmStatus = stackStatus
+		switch stackStatus {
+		case openstack.S_CREATE_FAILED:
+			vm.Status.Phase = vmv1.Failed
+		case openstack.S_CREATE_COMPLETE:
+			vm.Status.Phase = vmv1.Succeeded
+		case openstack.S_UPDATE_FAILED:
+			vm.Status.Phase = vmv1.Failed
+		case openstack.S_UPDATE_COMPLETE:
+			vm.Status.Phase = vmv1.Succeeded
+		}
+		if vm.Status.Phase == vmv1.Failed {
+			vm.Status.LastError = reason
+		}
+		if vm.Status.Phase == vmv1.Succeeded {
+			vm.Status.LastError = ""
+		}
+		if !inProgress(vm.Status.Phase) {
+			observeStackOperation(vm, stackStatus)
+		}
+	default:
+		return false
+	}
+
+	setStackCondition(vm)
+	return true
+}
+
+// VmResync periodically lists the tagged stacks of all tenants in one batch
+// and fixes up vm status missed by the per vm polling. It's only a safety net,
+// vm in progress are tracked by requeueing them in Reconcile.
+type VmResync struct {
+	reconciler *VirtualMachineReconciler
+	period     time.Duration
+}
+
+// NewVmResync returns the resync of the VirtualMachines of r every period
+func NewVmResync(r *VirtualMachineReconciler, period time.Duration) *VmResync {
+	return &VmResync{reconciler: r, period: period}
+}
+
+// Start resyncs every period until stop is closed. Added to the manager, it
+// only runs on the leader.
+func (v *VmResync) Start(stop <-chan struct{}) error {
+	logger := v.reconciler.log.WithName("Resync")
+	ctx := utils.WithLogger(context.Background(), logger)
+
+	ticker := time.NewTicker(v.period)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return nil
+		case <-ticker.C:
+			logger.V(1).Info("Start resync of vm status")
+			v.reconciler.resync(ctx)
+		}
+	}
+}
+
+// resync runs one pass of VmResync
+func (r *VirtualMachineReconciler) resync(ctx context.Context) {
+	logger := utils.GetLogger(ctx)
+	start := time.Now()
+	defer func() { resyncDuration.Observe(time.Since(start).Seconds()) }()
+
+	// Get all VM Stacks
+	stackList, err := r.osService.StackListAll(ctx)
+	if err != nil {
+		logger.Error(err, "failed to list stacks")
+		return
+	}
+
+	// transfer stack list to map, adopted stacks may be named differently
+	// than their vm
+	stackMap := make(map[string]*stacks.ListedStack)
+	for i := range stackList {
+		stackMap[stackList[i].ID] = &stackList[i]
+	}
+
+	// Get all vm CRD
+	var vmList vmv1.VirtualMachineList
+	err = r.cliReader.List(ctx, &vmList)
+	if err != nil {
+		logger.Error(err, "Failed to list vm crd")
+		return
+	}
+
+	for i := range vmList.Items {
+		vm := &vmList.Items[i]
+		err := r.checkAndUpdate(withVM(ctx, vm), vm, stackMap)
+		if err != nil {
+			vmLogger(logger, vm).Error(err, "Failed to update vm CRD")
+		}
+	}
+}
+
+func (r *VirtualMachineReconciler) checkAndUpdate(ctx context.Context, vm *vmv1.VirtualMachine, stackMap map[string]*stacks.ListedStack) error {
+	logger := utils.GetLogger(ctx)
+	stack, ok := stackMap[vm.Status.StackID]
+
+	// 1. release vm crd if phase is deleting and stack is gone
+	if vm.Status.Phase == vmv1.Deleting {
+		if !ok || stack.Status == openstack.S_DELETE_COMPLETE {
+			err := r.removeFinalizer(ctx, vm)
+			if err != nil {
+				logger.Error(err, "Failed to remove finalizer of vm crd")
+				return err
+			}
+			return nil
+		}
+	}
+
+	if !ok {
+		logger.V(1).Info("Stack of vm not found, nothing to update")
+		return nil
+	}
+
+	// 2. if vm status not changed, ingore this time
+	if vm.Status.VmStatus == stack.Status {
+		// servers are missing if outputs could not be fetched last time
+		if vm.Status.Phase == vmv1.Succeeded && len(vm.Status.Servers) != int(vm.Spec.Server.Replicas) {
+			r.syncStackOutputs(ctx, vm)
+			return r.doUpdateVmCrdStatus(ctx, vm)
+		}
+		logger.V(1).Info("Stack status didn't change, nothing to update", "status", stack.Status)
+		return nil
+	}
+
+	// 3. update vm status
+	if !applyStackStatus(vm, stack.Status, stack.StatusReason) {
+		return nil
+	}
+	logger.Info("Stack status changed", "status", stack.Status, "phase", vm.Status.Phase)
+	if vm.Status.Phase == vmv1.Succeeded {
+		r.syncStackOutputs(ctx, vm)
+	}
+	r.syncHeatEvents(ctx, vm)
+	return r.doUpdateVmCrdStatus(ctx, vm)
+}
+
+// syncStackOutputs fetches the stack of vm and copies its outputs into vm status
+func (r *VirtualMachineReconciler) syncStackOutputs(ctx context.Context, vm *vmv1.VirtualMachine) {
+	logger := utils.GetLogger(ctx)
+
+	stack, err := r.osService.StackGet(ctx, vm.Spec.Project.ProjectID, vm.StackName(), vm.Status.StackID)
+	if err != nil {
+		logger.Error(err, "Failed to get stack outputs")
+		setAuthCondition(vm, err)
+		return
+	}
+	setAuthCondition(vm, nil)
+	applyStackOutputs(vm, stack)
+}
+
+// applyStackOutputs copies the outputs of a completed stack into vm status
+func applyStackOutputs(vm *vmv1.VirtualMachine, stack *stacks.RetrievedStack) {
+	outputs := openstack.StackOutputs(stack)
+	vm.Status.Network = outputString(outputs["network"])
+	vm.Status.Subnet = outputString(outputs["subnet"])
+	vm.Status.Servers = serversFromOutputs(outputs)
+	setNetworkCondition(vm)
+	setServersCondition(vm)
+}
+
+// serversFromOutputs zips the per-member lists of the server resource group
+// outputs into one entry per server.
+func serversFromOutputs(outputs map[string]interface{}) []vmv1.ServerStatus {
+	ids := outputList(outputs["server_ids"])
+	names := outputList(outputs["server_names"])
+	fixedIPs := outputList(outputs["server_fixed_ips"])
+	floatingIPs := outputList(outputs["server_floating_ips"])
+	bootVolumeIDs := outputList(outputs["server_boot_volume_ids"])
+	dataVolumeIDs := outputList(outputs["server_data_volume_ids"])
+
+	servers := make([]vmv1.ServerStatus, 0, len(ids))
+	for i := range ids {
+		server := vmv1.ServerStatus{
+			ID: outputString(ids[i]),
+		}
+		if i < len(names) {
+			server.Name = outputString(names[i])
+		}
+		if i < len(fixedIPs) {
+			server.FixedIP = outputString(fixedIPs[i])
+		}
+		if i < len(floatingIPs) {
+			server.FloatingIP = outputString(floatingIPs[i])
+		}
+		if i < len(bootVolumeIDs) {
+			server.BootVolumeID = outputString(bootVolumeIDs[i])
+		}
+		if i < len(dataVolumeIDs) {
+			for _, v := range outputList(dataVolumeIDs[i]) {
+				server.DataVolumeIDs = append(server.DataVolumeIDs, outputString(v))
+			}
+		}
+		servers = append(servers, server)
+	}
+	return servers
+}
+
+func outputString(v interface{}) string {
+	switch s := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return s
+	default:
+		return fmt.Sprintf("%v", s)
+	}
+}
+
+func outputList(v interface{}) []interface{} {
+	l, ok := v.([]interface{})
+	if !ok {
+		return nil
+	}
+	return l
+}
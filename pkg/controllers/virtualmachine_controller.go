@@ -19,7 +19,6 @@ package controllers
 import (
 	"context"
 	"fmt"
-	"strings"
 	"sync"
 	"time"
 
@@ -28,222 +27,512 @@ import (
 	vmtpl "easystack.io/vm-operator/pkg/templates"
 	"easystack.io/vm-operator/pkg/utils"
 	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
 	apierrs "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/client-go/util/retry"
 	ctrl "sigs.k8s.io/controller-runtime"
 	cli "sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
 
 	"github.com/gophercloud/gophercloud/openstack/orchestration/v1/stacks"
-	"os"
 	"reflect"
 )
 
 const (
-	loggerCtxKey = "logger"
-	tplOutBase   = "/tmp/vm-templates"
+	// vmFinalizer keeps the vm crd until its heat stack has been deleted
+	vmFinalizer = "virtualmachine.mixapp.easystack.io"
 )
 
 // VirtualMachineReconciler reconciles a VirtualMachine object
 type VirtualMachineReconciler struct {
 	client        cli.Client
 	cliReader     cli.Reader
+	recorder      record.EventRecorder
 	log           logr.Logger
 	scheme        *runtime.Scheme
-	osService     *openstack.OSService
+	osService     openstack.Service
+	templates     *vmtpl.Set
 	vmCache       *vmCache
+	backoff       *requeueBackoff
 	PollingPeriod int
+	// ClusterID is recorded in the tags of the stacks, the orphan collector
+	// of another cluster leaves them alone
+	ClusterID string
 }
 
+// vmCache holds the last applied vm by their namespaced name
 type vmCache struct {
-	mu sync.Mutex
-	// using stackname as key
-	vmMap map[string]*vmv1.VirtualMachine
+	mu    sync.Mutex
+	vmMap map[types.NamespacedName]*vmv1.VirtualMachine
 }
 
-func NewVirtualMachine(c cli.Client, r cli.Reader, logger logr.Logger, oss *openstack.OSService, period int) *VirtualMachineReconciler {
+func NewVirtualMachine(c cli.Client, r cli.Reader, recorder record.EventRecorder, logger logr.Logger, oss openstack.Service, templates *vmtpl.Set, period int) *VirtualMachineReconciler {
 	return &VirtualMachineReconciler{
 		client:        c,
 		cliReader:     r,
+		recorder:      recorder,
 		log:           logger,
 		osService:     oss,
-		vmCache:       &vmCache{vmMap: make(map[string]*vmv1.VirtualMachine)},
+		templates:     templates,
+		vmCache:       &vmCache{vmMap: make(map[types.NamespacedName]*vmv1.VirtualMachine)},
+		backoff:       newRequeueBackoff(time.Duration(period)*time.Second, maxRequeuePeriod),
 		PollingPeriod: period,
 	}
 }
 
 // +kubebuilder:rbac:groups=mixapp.easystack.io,resources=virtualmachines,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=mixapp.easystack.io,resources=virtualmachines/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups=mixapp.easystack.io,resources=virtualmachinetemplates,verbs=get
+// +kubebuilder:rbac:groups="",resources=secrets,verbs=get
+// +kubebuilder:rbac:groups="",resources=configmaps,verbs=get;create;update
+// +kubebuilder:rbac:groups="",resources=events,verbs=create;patch
 
 func (r *VirtualMachineReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 	rootCtx := context.Background()
-	logger := r.log.WithValues("Reconcile", req.NamespacedName)
-	ctx := context.WithValue(rootCtx, loggerCtxKey, logger)
+	logger := r.log.WithValues("vm", req.NamespacedName)
+	ctx := utils.WithLogger(rootCtx, logger)
 
 	var vm vmv1.VirtualMachine
 	err := r.cliReader.Get(ctx, req.NamespacedName, &vm)
 	if err != nil {
 		if apierrs.IsNotFound(err) {
 			// Delete event
-			logger.Info("Delete Event", "vm crd has been deleted")
+			logger.Info("Delete Event: vm crd has been deleted")
+			r.vmCache.del(req.NamespacedName)
+			r.backoff.reset(req.NamespacedName)
 			return ctrl.Result{}, nil
 		}
 		return ctrl.Result{}, err
 	}
+	ctx = withVM(utils.WithLogger(rootCtx, r.log), &vm)
+	logger = utils.GetLogger(ctx)
 
-	// vm is in the process of being deleted, so no need to do anything.
+	// vm is in the process of being deleted, delete its stack first.
 	if vm.DeletionTimestamp != nil {
-		logger.Info("Delete Event", "vm crd is in the process of being deleted")
-		return ctrl.Result{}, nil
+		logger.Info("Delete Event: vm crd is in the process of being deleted")
+		if err := r.deleteStack(ctx, &vm); err != nil {
+			return ctrl.Result{}, err
+		}
+		if vm.Status.Phase != vmv1.Deleting {
+			return ctrl.Result{}, nil
+		}
+		return r.syncStackStatus(ctx, &vm)
 	}
 
-	cached, ok := r.vmCache.get(vm.Name)
-	if !ok {
-		// Add event
-		logger.Info("Add Event", "CRD Spec", vm.Spec)
-		createOpts, err := r.buildStackCreateOpts(ctx, &vm)
-		if err != nil {
-			return ctrl.Result{}, nil
+	// nothing is created or updated in a dry run, an existing stack is left
+	// as it is until the dry run is turned off
+	if vm.Spec.DryRun != nil {
+		return r.dryRun(ctx, &vm)
+	}
+
+	if !containsString(vm.Finalizers, vmFinalizer) {
+		vm.Finalizers = append(vm.Finalizers, vmFinalizer)
+		if err := r.doUpdateVmCrd(ctx, &vm); err != nil {
+			return ctrl.Result{}, err
 		}
-		err = r.osService.NewHeatClient(ctx, vm.Spec.Project.ProjectID, vm.Spec.Project.Token)
-		if err != nil {
+	}
+
+	// a vm without stack id has no stack yet, or lost the status recording
+	// it, which createStack finds in heat
+	if vm.Status.StackID == "" {
+		if identity := adoptIdentity(&vm); identity != "" {
+			return r.adoptStack(ctx, &vm, identity)
+		}
+		// a failed creation is retried once the spec changes
+		if vm.Status.Phase == vmv1.Failed && vm.Status.ObservedGeneration == vm.Generation {
 			return ctrl.Result{}, nil
 		}
-		stackID, err := r.osService.StackCreate(ctx, vm.Spec.Project.ProjectID, createOpts)
-		if err != nil {
-			logger.Error(err, "Create Stack failed")
-			vm.Status.VmStatus = openstack.S_CREATE_FAILED
+		return r.createStack(ctx, &vm)
+	}
+
+	// the cache only holds the spec last applied to the stack to update just
+	// the changed parameters, without it the generation tells whether the
+	// spec was applied, e.g. after a restart
+	cached, ok := r.vmCache.get(req.NamespacedName)
+	changed := vm.Generation != vm.Status.ObservedGeneration
+	if ok {
+		changed = specChanged(&cached.Spec, &vm.Spec)
+	}
+	if !changed {
+		if !ok {
+			r.vmCache.set(req.NamespacedName, vm.DeepCopy())
 		}
-		vm.Status.StackID = stackID
-		vm.Status.VmStatus = openstack.S_CREATE_IN_PROGRESS
-		r.vmCache.set(vm.Name, &vm)
+		if inProgress(vm.Status.Phase) {
+			return r.syncStackStatus(ctx, &vm)
+		}
+		if _, ok := vm.Annotations[vmv1.ActionAnnotation]; ok {
+			return ctrl.Result{}, r.runServerAction(ctx, &vm)
+		}
+		return ctrl.Result{}, nil
+	}
+
+	// Update event
+	logger.Info("Update Event", "CRD Spec", redactedSpec(&vm.Spec))
+	// heat refuses to update a stack which is still in progress, the status
+	// update after it completes triggers the update again
+	if inProgress(vm.Status.Phase) {
+		logger.Info("Stack of vm is in progress, retry update later")
+		return r.syncStackStatus(ctx, &vm)
+	}
+	if ok && keepsTemplate(&vm) && templateChanged(&cached.Spec, &vm.Spec) {
+		return r.refuseTemplateChange(ctx, &vm)
+	}
+	updateOpts, err := r.buildStackUpdateOpts(ctx, cached, &vm)
+	if err != nil {
+		logger.Error(err, "Failed to build stack update")
+		r.recorder.Eventf(&vm, corev1.EventTypeWarning, "BuildFailed", "failed to build the update of the stack: %v", err)
 		r.doUpdateVmCrdStatus(ctx, &vm)
+		return ctrl.Result{}, err
+	}
+	err = r.newHeatClient(ctx, &vm)
+	if err != nil {
+		return r.handleAuthError(ctx, &vm, err)
+	}
+	err = r.osService.StackUpdate(ctx, vm.Spec.Project.ProjectID, vm.StackName(), vm.Status.StackID, updateOpts)
+	if openstack.IsAuthExpired(err) {
+		return r.handleAuthError(ctx, &vm, err)
+	}
+	if err != nil {
+		logger.Error(err, "Update Stack failed")
+		vm.Status.Phase = vmv1.Failed
+		vm.Status.VmStatus = openstack.S_UPDATE_FAILED
+		vm.Status.LastError = err.Error()
 	} else {
-		// TODO: Update event, deal with vm update and delete
-		fmt.Printf("update event: %v\n", cached)
+		vm.Status.Phase = vmv1.Updating
+		vm.Status.VmStatus = openstack.S_UPDATE_IN_PROGRESS
+		vm.Status.LastError = ""
+		// the cache and the observed generation record the spec applied to
+		// the stack, a rejected update is diffed against the same spec when
+		// it's retried, also after a restart
+		r.vmCache.set(req.NamespacedName, vm.DeepCopy())
+		vm.Status.ObservedGeneration = vm.Generation
 	}
-
-	return ctrl.Result{}, nil
-}
-
-func (r *VirtualMachineReconciler) SetupWithManager(mgr ctrl.Manager) error {
-	return ctrl.NewControllerManagedBy(mgr).
-		For(&vmv1.VirtualMachine{}).
-		Complete(r)
+	setStackCondition(&vm)
+	setAuthCondition(&vm, nil)
+	r.doUpdateVmCrdStatus(ctx, &vm)
+	return r.requeue(&vm), nil
 }
 
-func (r *VirtualMachineReconciler) InitVmCacheFromCRD() error {
-	rootCtx := context.Background()
-	logger := r.log.WithName("InitCRD")
-	ctx := context.WithValue(rootCtx, loggerCtxKey, logger)
+// createStack creates the stack of vm. A stack of vm found in heat by its
+// name was created by a reconcile whose status update was lost, it's bound to
+// vm instead of creating another one.
+func (r *VirtualMachineReconciler) createStack(ctx context.Context, vm *vmv1.VirtualMachine) (ctrl.Result, error) {
+	logger := utils.GetLogger(ctx)
 
-	var vmList vmv1.VirtualMachineList
+	logger.Info("Add Event", "CRD Spec", redactedSpec(&vm.Spec))
+	createOpts, err := r.buildStackCreateOpts(ctx, vm)
+	if err != nil {
+		logger.Error(err, "Failed to build stack")
+		r.recorder.Eventf(vm, corev1.EventTypeWarning, "BuildFailed", "failed to build the stack: %v", err)
+		r.doUpdateVmCrdStatus(ctx, vm)
+		return ctrl.Result{}, err
+	}
+	err = r.newHeatClient(ctx, vm)
+	if err != nil {
+		return r.handleAuthError(ctx, vm, err)
+	}
 
-	err := r.cliReader.List(ctx, &vmList)
+	stack, err := r.osService.StackFind(ctx, vm.Spec.Project.ProjectID, createOpts.Name)
+	if openstack.IsAuthExpired(err) {
+		return r.handleAuthError(ctx, vm, err)
+	}
+	if err != nil && !openstack.IsNotFound(err) {
+		return ctrl.Result{}, err
+	}
+	if err == nil {
+		if owner, ok := openstack.StackOwnerOf(stack.Tags); ok && owner.UID == string(vm.UID) {
+			return r.bindStack(ctx, vm, stack)
+		}
+		err = fmt.Errorf("stack %s/%s exists and is not owned by this VirtualMachine", stack.Name, stack.ID)
+	} else {
+		vm.Status.StackID, err = r.osService.StackCreate(ctx, vm.Spec.Project.ProjectID, createOpts)
+		// only a rejected stack is failed, the creation is retried with the
+		// rate limiting of the controller otherwise
+		if err != nil && !openstack.IsAuthExpired(err) && !openstack.IsInvalid(err) {
+			logger.Error(err, "Create Stack failed, retrying")
+			return ctrl.Result{}, err
+		}
+	}
+	if openstack.IsAuthExpired(err) {
+		return r.handleAuthError(ctx, vm, err)
+	}
 	if err != nil {
-		logger.Error(err, "Failed to list vm crd")
-		return err
+		logger.Error(err, "Create Stack failed")
+		vm.Status.Phase = vmv1.Failed
+		vm.Status.VmStatus = openstack.S_CREATE_FAILED
+		vm.Status.LastError = err.Error()
+	} else {
+		vm.Status.Phase = vmv1.Creating
+		vm.Status.VmStatus = openstack.S_CREATE_IN_PROGRESS
+		vm.Status.LastError = ""
 	}
+	vm.Status.StackName = createOpts.Name
+	vm.Status.ObservedGeneration = vm.Generation
+	setStackCondition(vm)
+	setAuthCondition(vm, nil)
+	r.vmCache.set(vmKey(vm), vm.DeepCopy())
+	r.doUpdateVmCrdStatus(ctx, vm)
+	return r.requeue(vm), nil
+}
 
-	r.vmCache.mu.Lock()
-	defer r.vmCache.mu.Unlock()
-	for i := range vmList.Items {
-		projectID := vmList.Items[i].Spec.Project.ProjectID
-		appName := vmList.Items[i].Spec.Server.NamePrefix
-		key := strings.Join([]string{appName, projectID}, "-")
-		r.vmCache.vmMap[key] = &vmList.Items[i]
+// bindStack records the found stack of vm in its status. The spec counts as
+// applied when the parameters of the stack match it, otherwise the next
+// reconcile updates the stack.
+func (r *VirtualMachineReconciler) bindStack(ctx context.Context, vm *vmv1.VirtualMachine, stack *stacks.RetrievedStack) (ctrl.Result, error) {
+	logger := utils.GetLogger(ctx)
+	logger.Info("Found Stack of vm, binding it", "stack", stack.Name, "id", stack.ID)
+
+	params, err := vmtpl.BuildParameters(&vm.Spec)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	vm.Status.StackID = stack.ID
+	vm.Status.StackName = stack.Name
+	if changed, _ := parametersDiff(params.Heat, stack.Parameters); len(changed) == 0 {
+		vm.Status.ObservedGeneration = vm.Generation
+	}
+	applyRetrievedStatus(vm, stack)
+	r.syncHeatEvents(ctx, vm)
+	setAuthCondition(vm, nil)
+	if err := r.doUpdateVmCrdStatus(ctx, vm); err != nil {
+		return ctrl.Result{}, err
 	}
+	return r.requeue(vm), nil
+}
 
-	return nil
+// specChanged reports whether any field rendered into the heat stack differs
+// between the last applied spec and the new one.
+func specChanged(old *vmv1.VirtualMachineSpec, new *vmv1.VirtualMachineSpec) bool {
+	return !reflect.DeepEqual(old.Server, new.Server) ||
+		!reflect.DeepEqual(old.Network, new.Network) ||
+		!reflect.DeepEqual(old.Volume, new.Volume) ||
+		!reflect.DeepEqual(old.SoftwareConfig, new.SoftwareConfig) ||
+		!reflect.DeepEqual(old.Template, new.Template)
 }
 
-func (r *VirtualMachineReconciler) PollingVmInfo() error {
-	rootCtx := context.Background()
-	logger := r.log.WithName("Polling")
-	ctx := context.WithValue(rootCtx, loggerCtxKey, logger)
+// templateChanged reports whether the spec change alters the structure of the
+// rendered heat templates, in which case parameters alone can't express the update.
+// Optional server properties are only rendered when they're set.
+func templateChanged(old *vmv1.VirtualMachineSpec, new *vmv1.VirtualMachineSpec) bool {
+	return old.Network.ExistingSubnet != new.Network.ExistingSubnet ||
+		old.Network.FloatingIp != new.Network.FloatingIp ||
+		toggled(old.Server.KeyName, new.Server.KeyName) ||
+		toggled(old.Server.AdminPass, new.Server.AdminPass) ||
+		toggled(old.Server.AvailableZone, new.Server.AvailableZone) ||
+		toggled(old.Server.BootVolumeType, new.Server.BootVolumeType) ||
+		toggled(old.Server.SecurityGroup, new.Server.SecurityGroup) ||
+		!reflect.DeepEqual(old.Volume, new.Volume) ||
+		!reflect.DeepEqual(old.SoftwareConfig, new.SoftwareConfig) ||
+		!reflect.DeepEqual(old.Template, new.Template)
+}
 
-	var vmList vmv1.VirtualMachineList
+// toggled reports whether a value was set or unset
+func toggled(old string, new string) bool {
+	return (old == "") != (new == "")
+}
 
-	for {
-		time.Sleep(time.Duration(r.PollingPeriod) * time.Second)
-		fmt.Println("start polling vm latest info")
+// deleteStack triggers the deletion of the heat stack of vm. The finalizer is
+// removed by syncStackStatus once the stack is gone. The stack is deleted as
+// cloud admin when the credential of the project can't be used anymore, e.g.
+// its secret was deleted along with the namespace.
+func (r *VirtualMachineReconciler) deleteStack(ctx context.Context, vm *vmv1.VirtualMachine) error {
+	logger := utils.GetLogger(ctx)
 
-		// Get all VM Stacks
-		stackList, err := r.osService.StackListAll(ctx)
+	if !containsString(vm.Finalizers, vmFinalizer) || vm.Status.Phase == vmv1.Deleting {
+		return nil
+	}
+	// the status recording a created stack may have been lost, heat is asked
+	// before the finalizer is removed
+	if vm.Status.StackID == "" {
+		id, name, err := r.findOwnStack(ctx, vm)
 		if err != nil {
-			logger.Error(err, "failed to list stacks")
-			continue
+			logger.Error(err, "Failed to look up stack of vm")
+			return err
 		}
-
-		// transfer stack list to map
-		var stackMap map[string]*stacks.ListedStack
-		stackMap = make(map[string]*stacks.ListedStack)
-		for i := range stackList {
-			stackMap[stackList[i].Name] = &stackList[i]
+		if id == "" {
+			return r.removeFinalizer(ctx, vm)
 		}
+		logger.Info("Found stack of vm missing from its status", "stack", name, "id", id)
+		vm.Status.StackID = id
+		vm.Status.StackName = name
+	}
 
-		// Get all vm CRD
-		err = r.cliReader.List(ctx, &vmList)
-		if err != nil {
-			logger.Error(err, "Failed to list vm crd")
-			continue
+	err := r.newHeatClient(ctx, vm)
+	if err == nil {
+		err = r.osService.StackDelete(ctx, vm.Spec.Project.ProjectID, vm.StackName(), vm.Status.StackID)
+		if err != nil && !openstack.IsAuthExpired(err) {
+			logger.Error(err, "Delete Stack failed")
+			return err
+		}
+	}
+	if err == nil {
+		setAuthCondition(vm, nil)
+	} else {
+		logger.Info("Credential of project can't be used, deleting stack as cloud admin", "reason", err.Error())
+		if err := r.osService.StackAdminDelete(ctx, vm.Spec.Project.ProjectID, vm.StackName(), vm.Status.StackID); err != nil {
+			logger.Error(err, "Delete Stack as cloud admin failed")
+			return err
 		}
+	}
+	vm.Status.Phase = vmv1.Deleting
+	vm.Status.VmStatus = openstack.S_DELETE_IN_PROGRESS
+	setStackCondition(vm)
+	return r.doUpdateVmCrdStatus(ctx, vm)
+}
 
-		for i := range vmList.Items {
-			err := r.checkAndUpdate(ctx, &vmList.Items[i], stackMap)
-			if err != nil {
-				logger.Error(err, "Failed to update vm CRD")
+// findOwnStack returns the id and the name of the stack tagged with the uid of
+// vm, or an empty id if there is none. The stack is found by its name in the
+// project, or among the stacks of all projects if the credential of the
+// project can't be used.
+func (r *VirtualMachineReconciler) findOwnStack(ctx context.Context, vm *vmv1.VirtualMachine) (string, string, error) {
+	owned := func(tags []string) bool {
+		owner, ok := openstack.StackOwnerOf(tags)
+		return ok && owner.UID == string(vm.UID)
+	}
+
+	err := r.newHeatClient(ctx, vm)
+	if err == nil {
+		stack, err := r.osService.StackFind(ctx, vm.Spec.Project.ProjectID, vm.StackName())
+		switch {
+		case err == nil:
+			if owned(stack.Tags) {
+				return stack.ID, stack.Name, nil
 			}
+			return "", "", nil
+		case openstack.IsNotFound(err):
+			return "", "", nil
+		case !openstack.IsAuthExpired(err):
+			return "", "", err
+		}
+	}
+
+	stackList, err := r.osService.StackListAll(ctx)
+	if err != nil {
+		return "", "", err
+	}
+	for i := range stackList {
+		if owned(stackList[i].Tags) {
+			return stackList[i].ID, stackList[i].Name, nil
 		}
-		stackMap = nil
 	}
+	return "", "", nil
 }
 
-func (r *VirtualMachineReconciler) checkAndUpdate(ctx context.Context, vm *vmv1.VirtualMachine, stackMap map[string]*stacks.ListedStack) error {
-	key := vm.Name
-	stackStatus := stackMap[key].Status
-	// 1. if vm status not changed, ingore this time
-	if vm.Status.VmStatus == stackStatus {
-		fmt.Printf("vm[%s] of project[%s] didn't change status, nothing to update", vm.Name, vm.Spec.Project.ProjectID)
-		return nil
+// newHeatClient makes sure a heat client of the project of vm is cached, the
+// client is rebuilt once the cached one expired or the credential changed
+func (r *VirtualMachineReconciler) newHeatClient(ctx context.Context, vm *vmv1.VirtualMachine) error {
+	logger := utils.GetLogger(ctx)
+
+	cred, err := r.getUserCredential(ctx, vm)
+	if err != nil {
+		logger.Error(err, "Failed to get credential of project", "project", vm.Spec.Project.ProjectID)
+		return err
 	}
+	return r.osService.Authenticate(ctx, vm.Spec.Project.ProjectID, cred)
+}
 
-	// 2. remove vm crd if phase is deleting and stack not found
-	if vm.Spec.AssemblyPhase == vmv1.Deleting {
-		if _, ok := stackMap[key]; !ok {
-			err := r.client.Delete(ctx, vm)
-			if err != nil {
-				fmt.Printf("Failed to delete crd %s\n", vm.Name)
-				return err
-			}
-			r.vmCache.del(key)
-			return nil
+// handleAuthError records an expired authentication on vm and retries later.
+// Any other error means the credential couldn't be read or checked, e.g. a
+// missing secret or an unreachable keystone. Secrets aren't watched, so vm is
+// retried with backoff until it can be authenticated.
+func (r *VirtualMachineReconciler) handleAuthError(ctx context.Context, vm *vmv1.VirtualMachine, err error) (ctrl.Result, error) {
+	if setAuthCondition(vm, err) {
+		r.recorder.Eventf(vm, corev1.EventTypeWarning, string(vmv1.AuthExpired), "%v", err)
+		if err := r.doUpdateVmCrdStatus(ctx, vm); err != nil {
+			return ctrl.Result{}, err
+		}
+		return ctrl.Result{RequeueAfter: time.Duration(r.PollingPeriod) * time.Second}, nil
+	}
+	setCredentialUnavailable(vm, err)
+	r.recorder.Eventf(vm, corev1.EventTypeWarning, "CredentialUnavailable", "%v", err)
+	if err := r.doUpdateVmCrdStatus(ctx, vm); err != nil {
+		return ctrl.Result{}, err
+	}
+	return ctrl.Result{RequeueAfter: r.backoff.next(vmKey(vm))}, nil
+}
+
+// getUserCredential reads the credential of the project of vm from the referenced
+// secret, falling back to the token in spec
+func (r *VirtualMachineReconciler) getUserCredential(ctx context.Context, vm *vmv1.VirtualMachine) (*openstack.UserCredential, error) {
+	ref := vm.Spec.Project.CredentialsSecretRef
+	if ref == nil {
+		if vm.Spec.Project.Token == "" {
+			return nil, fmt.Errorf("neither credentialsSecretRef nor token is set")
 		}
+		return &openstack.UserCredential{Token: vm.Spec.Project.Token}, nil
+	}
+
+	var secret corev1.Secret
+	key := types.NamespacedName{Namespace: vm.Namespace, Name: ref.Name}
+	if err := r.cliReader.Get(ctx, key, &secret); err != nil {
+		return nil, fmt.Errorf("failed to get credentials secret %s: %v", key, err)
+	}
+
+	return openstack.CredentialFromSecretData(secret.Data, ref.Cloud)
+}
+
+// credentialSource names where the credential of vm comes from, VirtualMachines
+// sharing a credentials secret share their clients
+func credentialSource(vm *vmv1.VirtualMachine) string {
+	if ref := vm.Spec.Project.CredentialsSecretRef; ref != nil {
+		return fmt.Sprintf("secret %s/%s %s", vm.Namespace, ref.Name, ref.Cloud)
+	}
+	return fmt.Sprintf("token of %s", vmKey(vm))
+}
+
+func (r *VirtualMachineReconciler) removeFinalizer(ctx context.Context, vm *vmv1.VirtualMachine) error {
+	vm.Finalizers = removeString(vm.Finalizers, vmFinalizer)
+	if err := r.doUpdateVmCrd(ctx, vm); err != nil {
+		return err
+	}
+	if vm.Status.Phase == vmv1.Deleting {
+		observeStackOperation(vm, openstack.S_DELETE_COMPLETE)
+		r.recorder.Eventf(vm, corev1.EventTypeNormal, "Deleted", "stack %s is deleted", vm.StackName())
 	}
+	r.vmCache.del(vmKey(vm))
+	return nil
+}
 
-	// 3. update vm status
-	if vm.Spec.AssemblyPhase == vmv1.Creating || vm.Spec.AssemblyPhase == vmv1.Updating {
-		vm.Status.VmStatus = stackStatus
-		switch stackStatus {
-		case openstack.S_CREATE_FAILED:
-			vm.Spec.AssemblyPhase = vmv1.Failed
-		case openstack.S_CREATE_COMPLETE:
-			vm.Spec.AssemblyPhase = vmv1.Succeeded
-		case openstack.S_UPDATE_FAILED:
-			vm.Spec.AssemblyPhase = vmv1.Failed
-		case openstack.S_UPDATE_COMPLETE:
-			vm.Spec.AssemblyPhase = vmv1.Succeeded
-		default:
-			fmt.Printf("Unknown stack status: %s\n", stackStatus)
+func (r *VirtualMachineReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	if err := metrics.Registry.Register(&vmCollector{client: mgr.GetClient()}); err != nil {
+		return err
+	}
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&vmv1.VirtualMachine{}).
+		Complete(r)
+}
+
+func (r *VirtualMachineReconciler) InitVmCacheFromCRD() error {
+	rootCtx := context.Background()
+	logger := r.log.WithName("InitCRD")
+	ctx := utils.WithLogger(rootCtx, logger)
+
+	var vmList vmv1.VirtualMachineList
+
+	err := r.cliReader.List(ctx, &vmList)
+	if err != nil {
+		logger.Error(err, "Failed to list vm crd")
+		return err
+	}
+
+	// only specs applied to their stack may serve as base of updates, a
+	// rejected update may have been recorded as observed by older versions
+	for i := range vmList.Items {
+		vm := &vmList.Items[i]
+		rejected := vm.Status.VmStatus == openstack.S_UPDATE_FAILED && vm.Status.LastError != ""
+		if vm.Status.StackID != "" && vm.Status.ObservedGeneration == vm.Generation && !rejected {
+			r.vmCache.set(vmKey(vm), vm)
 		}
-		return r.doUpdateVmCrdStatus(ctx, vm)
 	}
 
 	return nil
 }
 
-func (r *VirtualMachineReconciler) doUpdateVmCrdStatus(ctx context.Context, vm *vmv1.VirtualMachine) error {
-	logger := utils.GetLoggerOrDie(ctx)
+func (r *VirtualMachineReconciler) doUpdateVmCrd(ctx context.Context, vm *vmv1.VirtualMachine) error {
+	logger := utils.GetLogger(ctx)
 
 	if err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
 		if err := r.client.Update(ctx, vm); err != nil {
@@ -257,113 +546,231 @@ func (r *VirtualMachineReconciler) doUpdateVmCrdStatus(ctx context.Context, vm *
 	return nil
 }
 
-func spec2HeatParams(spec interface{}, params *map[string]interface{}) error {
-	t := reflect.TypeOf(spec)
-	v := reflect.ValueOf(spec)
-	if t.Kind() == reflect.Ptr {
-		t = t.Elem()
-		v = v.Elem()
-	}
-
-	if t.Kind() == reflect.Struct {
-		for i := 0; i < t.NumField(); i++ {
-			switch t.Field(i).Name {
-			case "Replicas":
-				(*params)["replicas"] = v.Field(i).Interface()
-			case "NamePrefix":
-				(*params)["replicas"] = v.Field(i).Interface()
-			case "Image":
-				(*params)["image"] = v.Field(i).Interface()
-			case "Flavor":
-				(*params)["flavor"] = v.Field(i).Interface()
-			case "AvailableZone":
-				(*params)["availability_zone"] = v.Field(i).Interface()
-			case "KeyName":
-				(*params)["key_name"] = v.Field(i).Interface()
-			case "AdminPass":
-				(*params)["admin_pass"] = v.Field(i).Interface()
-			case "BootVolumeType":
-				(*params)["boot_volume_type"] = v.Field(i).Interface()
-			case "BootVolumeSize":
-				(*params)["boot_volume_size"] = v.Field(i).Interface()
-			case "SecurityGroup":
-				(*params)["security_group"] = v.Field(i).Interface()
-			case "ExternalNetwork":
-				(*params)["external_network"] = v.Field(i).Interface()
-			case "ExistingNetwork":
-				(*params)["existing_network"] = v.Field(i).Interface()
-			case "ExistingSubnet":
-				(*params)["existing_subnet"] = v.Field(i).Interface()
-			case "PrivateNetworkCidr":
-				(*params)["private_network_cidr"] = v.Field(i).Interface()
-			case "PrivateNetworkName":
-				(*params)["private_network_name"] = v.Field(i).Interface()
-			case "NeutronAz":
-				(*params)["neutron_az"] = v.Field(i).Interface()
-			case "FloatingIp":
-				(*params)["floating_ip"] = v.Field(i).Interface()
-			case "FloatingIpBandwidth":
-				(*params)["floating_ip_bandwidth"] = v.Field(i).Interface()
-			case "SoftwareConfig":
-				(*params)["softwareConfig"] = v.Field(i).Interface()
-			default:
-				fmt.Println("Unknown spec field")
-			}
+func (r *VirtualMachineReconciler) doUpdateVmCrdStatus(ctx context.Context, vm *vmv1.VirtualMachine) error {
+	logger := utils.GetLogger(ctx)
+
+	// the cached vm has the status before this update
+	var old vmv1.VirtualMachine
+	if err := r.client.Get(ctx, vmKey(vm), &old); err != nil {
+		old.Status = vm.Status
+	}
+	if err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		if err := r.client.Status().Update(ctx, vm); err != nil {
+			logger.Error(err, "Failed to update VM CRD")
+			return err
 		}
+		return nil
+	}); err != nil {
+		return fmt.Errorf("failed to update VM %s status: %v", vm.Name, err)
 	}
+	r.recordPhase(vm, &old.Status)
 	return nil
 }
 
+// vmKey returns the key of vm in the cache and the backoff
+func vmKey(vm *vmv1.VirtualMachine) types.NamespacedName {
+	return types.NamespacedName{Namespace: vm.Namespace, Name: vm.Name}
+}
+
+// stackOwner returns the owner recorded in the tags of the stack of vm in the
+// cluster clusterID, the orphan collector looks for its VirtualMachine by uid
+func stackOwner(vm *vmv1.VirtualMachine, clusterID string) openstack.StackOwner {
+	return openstack.StackOwner{Namespace: vm.Namespace, Name: vm.Name, UID: string(vm.UID), Cluster: clusterID}
+}
+
 func (r *VirtualMachineReconciler) buildStackCreateOpts(ctx context.Context, vm *vmv1.VirtualMachine) (*stacks.CreateOpts, error) {
-	params := make(map[string]interface{})
-	spec2HeatParams(&vm.Spec.Server, &params)
-	spec2HeatParams(&vm.Spec.Network, &params)
+	template, params, err := r.renderStack(ctx, vm)
+	if err != nil {
+		return nil, err
+	}
+
+	return &stacks.CreateOpts{
+		Name:         vm.StackName(),
+		TemplateOpts: template,
+		Parameters:   params,
+		Tags:         openstack.StackTags(stackOwner(vm, r.ClusterID)),
+	}, nil
+}
 
-	tplDir := strings.Join([]string{tplOutBase, vm.Name}, "/")
-	tpl := vmtpl.New(r.osService.ConfigDir, tplDir, params)
-	err := tpl.RenderToFile()
+// buildStackUpdateOpts returns the update of the stack from the old spec to
+// the one of vm, the whole stack is sent again when old is unknown
+func (r *VirtualMachineReconciler) buildStackUpdateOpts(ctx context.Context, old *vmv1.VirtualMachine, vm *vmv1.VirtualMachine) (*stacks.UpdateOpts, error) {
+	// the template of an adopted stack is only replaced by spec.template, all
+	// parameters are sent when the applied spec isn't known
+	if old != nil && !templateChanged(&old.Spec, &vm.Spec) || old == nil && keepsTemplate(vm) {
+		// only send changed parameters, heat keeps the existing ones. The
+		// parameters of the template are unchanged as its reference is.
+		params, err := vmtpl.BuildParameters(&vm.Spec)
+		if err != nil {
+			return nil, err
+		}
+		if old != nil {
+			oldParams, err := vmtpl.BuildParameters(&old.Spec)
+			if err != nil {
+				return nil, err
+			}
+			for k, v := range oldParams.Heat {
+				if reflect.DeepEqual(params.Heat[k], v) {
+					delete(params.Heat, k)
+				}
+			}
+		}
+		return &stacks.UpdateOpts{
+			Parameters: params.Heat,
+		}, nil
+	}
+
+	template, params, err := r.renderStack(ctx, vm)
 	if err != nil {
-		fmt.Println("render heat template file failed")
 		return nil, err
 	}
 
-	// stack use '.' as baseUrl, need to change work dir to tplDir
-	if err := os.Chdir(tplDir); err != nil {
-		fmt.Printf("change work dir to %s failed\n", tplDir)
+	return &stacks.UpdateOpts{
+		TemplateOpts: template,
+		Parameters:   params,
+		Tags:         openstack.StackTags(stackOwner(vm, r.ClusterID)),
+	}, nil
+}
+
+// renderStack renders the templates of vm and returns them with the stack
+// parameters, TemplateReady of vm reports the result.
+func (r *VirtualMachineReconciler) renderStack(ctx context.Context, vm *vmv1.VirtualMachine) (*stacks.Template, map[string]interface{}, error) {
+	params, err := vmtpl.BuildParameters(&vm.Spec)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	set, tplParams, err := r.stackTemplates(ctx, vm)
+	if err == nil {
+		for k, v := range tplParams {
+			if _, ok := params.Context[k]; ok {
+				err = &templateError{reason: "InvalidParameters", err: fmt.Errorf("parameter %s of template %s is set from the spec", k, set.Source)}
+				break
+			}
+			params.Heat[k] = v
+			params.Context[k] = v
+		}
+	}
+	var template *stacks.Template
+	if err == nil {
+		template, err = r.renderTemplate(set, params)
+	}
+	setTemplateCondition(vm, set, err)
+	if err != nil {
+		templateRenderFailures.WithLabelValues(templateErrorReason(err)).Inc()
+		return nil, nil, err
+	}
+
+	return template, params.Heat, nil
+}
+
+// stackTemplates returns the templates of the VirtualMachineTemplate
+// referenced by vm with the values of its parameters, or the templates of the
+// operator if vm references none
+func (r *VirtualMachineReconciler) stackTemplates(ctx context.Context, vm *vmv1.VirtualMachine) (*vmtpl.Set, map[string]interface{}, error) {
+	ref := vm.Spec.Template
+	if ref == nil {
+		return r.templates, nil, nil
+	}
+
+	var vmt vmv1.VirtualMachineTemplate
+	key := types.NamespacedName{Namespace: vm.Namespace, Name: ref.Name}
+	if err := r.cliReader.Get(ctx, key, &vmt); err != nil {
+		reason := "TemplateUnavailable"
+		if apierrs.IsNotFound(err) {
+			reason = "TemplateNotFound"
+		}
+		return nil, nil, &templateError{reason: reason, err: fmt.Errorf("failed to get template %s: %v", key, err)}
+	}
+	if !vmt.Matches(ref) {
+		return nil, nil, &templateError{
+			reason: "VersionMismatch",
+			err:    fmt.Errorf("template %s is at version %s, not %s", key, vmt.Spec.Version, ref.Version),
+		}
+	}
+
+	params, err := vmt.ResolveParameters(ref.Parameters)
+	if err != nil {
+		return nil, nil, &templateError{reason: "InvalidParameters", err: err}
+	}
+	set, err := vmtpl.NewSet("VirtualMachineTemplate "+key.String(), vmt.Spec.Version, vmt.Spec.Templates)
+	if err != nil {
+		return nil, nil, err
+	}
+	return set, params, nil
+}
+
+// renderTemplate renders the heat templates in memory, the child templates are
+// sent in the files of the root template, so heat never fetches them. The
+// rendered templates are linted against params, heat would reject the stack
+// anyway, but only after the stack is created.
+func (r *VirtualMachineReconciler) renderTemplate(set *vmtpl.Set, params *vmtpl.Parameters) (*stacks.Template, error) {
+	files, err := vmtpl.New(set, params.Context).Render()
+	if err != nil {
 		return nil, err
 	}
+	if err := vmtpl.Lint(files, params.Heat); err != nil {
+		return nil, fmt.Errorf("templates of %s are invalid: %v", set.Source, err)
+	}
 
-	template := &stacks.Template{}
-	tplUrl := strings.Join([]string{"file:/", tplDir, "vm_group.yaml"}, "/")
-	fmt.Printf("tplUrl = %s\n", tplUrl)
+	root := files[vmtpl.RootTemplate]
+	delete(files, vmtpl.RootTemplate)
 
+	template := &stacks.Template{}
 	template.TE = stacks.TE{
-		URL: tplUrl,
+		Bin:   []byte(root),
+		Files: files,
 	}
 
-	return &stacks.CreateOpts{
-		Name:         vm.Name,
-		TemplateOpts: template,
-		Parameters:   params,
-		Tags:         []string{openstack.StackTag},
-	}, nil
+	return template, nil
 }
 
-func (v *vmCache) get(key string) (*vmv1.VirtualMachine, bool) {
+func (v *vmCache) get(key types.NamespacedName) (*vmv1.VirtualMachine, bool) {
 	v.mu.Lock()
 	defer v.mu.Unlock()
 	vm, ok := v.vmMap[key]
 	return vm, ok
 }
 
-func (v *vmCache) set(key string, vm *vmv1.VirtualMachine) {
+func (v *vmCache) set(key types.NamespacedName, vm *vmv1.VirtualMachine) {
 	v.mu.Lock()
 	defer v.mu.Unlock()
 	v.vmMap[key] = vm
 }
 
-func (v *vmCache) del(key string) {
+// ownerOf returns the key of the vm whose stack is stackID
+func (v *vmCache) ownerOf(stackID string) (types.NamespacedName, bool) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for key, vm := range v.vmMap {
+		if vm.Status.StackID == stackID {
+			return key, true
+		}
+	}
+	return types.NamespacedName{}, false
+}
+
+func (v *vmCache) del(key types.NamespacedName) {
 	v.mu.Lock()
 	defer v.mu.Unlock()
 	delete(v.vmMap, key)
 }
+
+func containsString(slice []string, s string) bool {
+	for _, item := range slice {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func removeString(slice []string, s string) []string {
+	result := make([]string, 0, len(slice))
+	for _, item := range slice {
+		if item != s {
+			result = append(result, item)
+		}
+	}
+	return result
+}
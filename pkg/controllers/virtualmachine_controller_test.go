@@ -0,0 +1,414 @@
+/*
+Copyright 2020 easystack.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/gophercloud/gophercloud/openstack/orchestration/v1/stacks"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	vmv1 "easystack.io/vm-operator/pkg/api/v1"
+	"easystack.io/vm-operator/pkg/openstack"
+	vmtpl "easystack.io/vm-operator/pkg/templates"
+)
+
+var _ = Describe("VirtualMachine controller", func() {
+	const (
+		timeout  = 30 * time.Second
+		interval = 250 * time.Millisecond
+	)
+
+	ctx := context.Background()
+
+	newVM := func(name string) *vmv1.VirtualMachine {
+		return &vmv1.VirtualMachine{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: "default",
+			},
+			Spec: vmv1.VirtualMachineSpec{
+				Project: vmv1.ProjectSpec{
+					ProjectID: "8e5eda4cac9f460ea2b471a357c42dd0",
+					Token:     "fake-token",
+				},
+				Server: vmv1.ServerSpec{
+					Replicas:       1,
+					NamePrefix:     name,
+					Image:          "cirros",
+					Flavor:         "1-512-20",
+					BootVolumeSize: "20",
+				},
+				Network: vmv1.NetworkSpec{
+					PrivateNetworkCidr: "192.168.18.0/24",
+					PrivateNetworkName: "ecns-private",
+				},
+			},
+		}
+	}
+
+	getVM := func(name string) *vmv1.VirtualMachine {
+		vm := &vmv1.VirtualMachine{}
+		err := k8sClient.Get(ctx, types.NamespacedName{Namespace: "default", Name: name}, vm)
+		if err != nil {
+			return nil
+		}
+		return vm
+	}
+
+	phaseOf := func(name string) func() vmv1.AssemblyPhaseType {
+		return func() vmv1.AssemblyPhaseType {
+			vm := getVM(name)
+			if vm == nil {
+				return ""
+			}
+			return vm.Status.Phase
+		}
+	}
+
+	It("should create a stack and report Succeeded", func() {
+		vm := newVM("vm-create")
+		Expect(k8sClient.Create(ctx, vm)).To(Succeed())
+
+		Eventually(phaseOf(vm.Name), timeout, interval).Should(Equal(vmv1.AssemblyPhaseType(vmv1.Creating)))
+		Eventually(phaseOf(vm.Name), timeout, interval).Should(Equal(vmv1.AssemblyPhaseType(vmv1.Succeeded)))
+
+		created := getVM(vm.Name)
+		Expect(created.Finalizers).To(ContainElement(vmFinalizer))
+		Expect(created.Status.StackID).NotTo(BeEmpty())
+		Expect(created.Status.VmStatus).To(Equal(openstack.S_CREATE_COMPLETE))
+		Expect(created.Status.Network).NotTo(BeEmpty())
+		Expect(created.Status.StackName).To(Equal("default-vm-create-" + string(created.UID)[:8]))
+		Expect(fakeHeat.Status(created.Status.StackName)).To(Equal(openstack.S_CREATE_COMPLETE))
+	})
+
+	It("should create separate stacks for VirtualMachines of the same name", func() {
+		Expect(k8sClient.Create(ctx, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-b"}})).To(Succeed())
+		vm := newVM("vm-shared")
+		Expect(k8sClient.Create(ctx, vm)).To(Succeed())
+		other := newVM("vm-shared")
+		other.Namespace = "team-b"
+		Expect(k8sClient.Create(ctx, other)).To(Succeed())
+
+		stackNames := func() []string {
+			var names []string
+			for _, ns := range []string{"default", "team-b"} {
+				latest := &vmv1.VirtualMachine{}
+				err := k8sClient.Get(ctx, types.NamespacedName{Namespace: ns, Name: "vm-shared"}, latest)
+				if err != nil || latest.Status.Phase != vmv1.Succeeded {
+					return nil
+				}
+				names = append(names, latest.Status.StackName)
+			}
+			return names
+		}
+		Eventually(stackNames, timeout, interval).Should(HaveLen(2))
+		names := stackNames()
+		Expect(names[0]).To(HavePrefix("default-vm-shared-"))
+		Expect(names[1]).To(HavePrefix("team-b-vm-shared-"))
+		Expect(fakeHeat.Status(names[0])).To(Equal(openstack.S_CREATE_COMPLETE))
+		Expect(fakeHeat.Status(names[1])).To(Equal(openstack.S_CREATE_COMPLETE))
+	})
+
+	It("should update the stack when the spec changes", func() {
+		vm := newVM("vm-update")
+		Expect(k8sClient.Create(ctx, vm)).To(Succeed())
+		Eventually(phaseOf(vm.Name), timeout, interval).Should(Equal(vmv1.AssemblyPhaseType(vmv1.Succeeded)))
+
+		updates := fakeHeat.Calls("StackUpdate")
+		Eventually(func() error {
+			latest := getVM(vm.Name)
+			latest.Spec.Server.Flavor = "2-1024-20"
+			return k8sClient.Update(ctx, latest)
+		}, timeout, interval).Should(Succeed())
+
+		Eventually(phaseOf(vm.Name), timeout, interval).Should(Equal(vmv1.AssemblyPhaseType(vmv1.Updating)))
+		Eventually(phaseOf(vm.Name), timeout, interval).Should(Equal(vmv1.AssemblyPhaseType(vmv1.Succeeded)))
+		Expect(fakeHeat.Calls("StackUpdate")).To(Equal(updates + 1))
+		Expect(getVM(vm.Name).Status.VmStatus).To(Equal(openstack.S_UPDATE_COMPLETE))
+	})
+
+	It("should find its stack instead of creating another one when the status is lost", func() {
+		vm := newVM("vm-lost")
+		Expect(k8sClient.Create(ctx, vm)).To(Succeed())
+		Eventually(phaseOf(vm.Name), timeout, interval).Should(Equal(vmv1.AssemblyPhaseType(vmv1.Succeeded)))
+		stackID := getVM(vm.Name).Status.StackID
+
+		creates := fakeHeat.Calls("StackCreate")
+		Eventually(func() error {
+			latest := getVM(vm.Name)
+			latest.Status = vmv1.VirtualMachineStatus{}
+			return k8sClient.Status().Update(ctx, latest)
+		}, timeout, interval).Should(Succeed())
+
+		Eventually(func() string { return getVM(vm.Name).Status.StackID }, timeout, interval).Should(Equal(stackID))
+		Eventually(phaseOf(vm.Name), timeout, interval).Should(Equal(vmv1.AssemblyPhaseType(vmv1.Succeeded)))
+		Expect(fakeHeat.Calls("StackCreate")).To(Equal(creates))
+	})
+
+	It("should delete the stack before releasing the VirtualMachine", func() {
+		vm := newVM("vm-delete")
+		Expect(k8sClient.Create(ctx, vm)).To(Succeed())
+		Eventually(phaseOf(vm.Name), timeout, interval).Should(Equal(vmv1.AssemblyPhaseType(vmv1.Succeeded)))
+
+		Expect(k8sClient.Delete(ctx, getVM(vm.Name))).To(Succeed())
+		Eventually(phaseOf(vm.Name), timeout, interval).Should(Equal(vmv1.AssemblyPhaseType(vmv1.Deleting)))
+
+		Eventually(func() bool {
+			err := k8sClient.Get(ctx, types.NamespacedName{Namespace: "default", Name: vm.Name}, &vmv1.VirtualMachine{})
+			return apierrs.IsNotFound(err)
+		}, timeout, interval).Should(BeTrue())
+		Expect(fakeHeat.Status(vm.Name)).To(Equal(openstack.S_DELETE_COMPLETE))
+	})
+
+	It("should report Failed with the reason of a failed stack", func() {
+		vm := newVM("vm-failed")
+		fakeHeat.FailNext("CREATE", vm.Name, "No valid host was found")
+		Expect(k8sClient.Create(ctx, vm)).To(Succeed())
+
+		Eventually(phaseOf(vm.Name), timeout, interval).Should(Equal(vmv1.AssemblyPhaseType(vmv1.Failed)))
+		failed := getVM(vm.Name)
+		Expect(failed.Status.VmStatus).To(Equal(openstack.S_CREATE_FAILED))
+		Expect(failed.Status.LastError).To(Equal("No valid host was found"))
+		var stackReady *vmv1.Condition
+		for i := range failed.Status.Conditions {
+			if failed.Status.Conditions[i].Type == vmv1.StackReady {
+				stackReady = &failed.Status.Conditions[i]
+			}
+		}
+		Expect(stackReady).NotTo(BeNil())
+		Expect(stackReady.Status).To(Equal(metav1.ConditionFalse))
+
+		// the failing resource is recorded in the status and in events
+		Expect(failed.Status.HeatEvents).To(HaveLen(1))
+		Expect(failed.Status.HeatEvents[0].Resource).To(Equal("server"))
+		Expect(failed.Status.HeatEvents[0].Reason).To(Equal("No valid host was found"))
+		Eventually(func() []string {
+			var events corev1.EventList
+			Expect(k8sClient.List(ctx, &events, client.InNamespace(vm.Namespace))).To(Succeed())
+			var reasons []string
+			for _, e := range events.Items {
+				if e.InvolvedObject.Name == vm.Name {
+					reasons = append(reasons, e.Reason)
+				}
+			}
+			return reasons
+		}, timeout, interval).Should(ContainElement("StackResourceFailed"))
+	})
+
+	It("should render the stack from the referenced VirtualMachineTemplate", func() {
+		vm := newVM("vm-template")
+		vm.Spec.Template = &vmv1.TemplateReference{
+			Name:       "web-server",
+			Version:    "1.0",
+			Parameters: map[string]string{"http_port": "8080"},
+		}
+		Expect(k8sClient.Create(ctx, vm)).To(Succeed())
+
+		templateReady := func() string {
+			latest := getVM(vm.Name)
+			if latest == nil {
+				return ""
+			}
+			for _, cond := range latest.Status.Conditions {
+				if cond.Type == vmv1.TemplateReady {
+					return string(cond.Status) + "/" + cond.Reason
+				}
+			}
+			return ""
+		}
+		Eventually(templateReady, timeout, interval).Should(Equal("False/TemplateNotFound"))
+
+		vmt := &vmv1.VirtualMachineTemplate{
+			ObjectMeta: metav1.ObjectMeta{Name: "web-server", Namespace: "default"},
+			Spec: vmv1.VirtualMachineTemplateSpec{
+				Version:    "1.0",
+				Templates:  map[string]string{"vm_group.yaml": "heat_template_version: 2016-10-14\n"},
+				Parameters: []vmv1.TemplateParameter{{Name: "http_port", Type: vmv1.ParameterNumber}},
+			},
+		}
+		Expect(k8sClient.Create(ctx, vmt)).To(Succeed())
+		// the template declares none of the parameters of the stack
+		Eventually(templateReady, timeout, interval).Should(Equal("False/InvalidTemplate"))
+		Expect(fakeHeat.Status(vm.Name)).To(BeEmpty())
+
+		params, err := vmtpl.BuildParameters(&vm.Spec)
+		Expect(err).NotTo(HaveOccurred())
+		root := "heat_template_version: 2016-10-14\nparameters:\n  http_port: {type: number}\n"
+		for name := range params.Heat {
+			root += fmt.Sprintf("  %s: {type: string}\n", name)
+		}
+		Expect(k8sClient.Get(ctx, types.NamespacedName{Name: vmt.Name, Namespace: vmt.Namespace}, vmt)).To(Succeed())
+		vmt.Spec.Templates = map[string]string{"vm_group.yaml": root}
+		Expect(k8sClient.Update(ctx, vmt)).To(Succeed())
+
+		Eventually(phaseOf(vm.Name), timeout, interval).Should(Equal(vmv1.AssemblyPhaseType(vmv1.Succeeded)))
+		Expect(templateReady()).To(Equal("True/Rendered"))
+		Expect(fakeHeat.Parameters(vm.Name)).To(HaveKeyWithValue("http_port", int64(8080)))
+	})
+
+	It("should run the server action of the annotations once", func() {
+		vm := newVM("vm-action")
+		Expect(k8sClient.Create(ctx, vm)).To(Succeed())
+		Eventually(phaseOf(vm.Name), timeout, interval).Should(Equal(vmv1.AssemblyPhaseType(vmv1.Succeeded)))
+
+		actionCompleted := func() string {
+			latest := getVM(vm.Name)
+			if latest == nil {
+				return ""
+			}
+			for _, cond := range latest.Status.Conditions {
+				if cond.Type == vmv1.ActionCompleted {
+					return string(cond.Status) + "/" + cond.Reason
+				}
+			}
+			return ""
+		}
+		Eventually(func() error {
+			latest := getVM(vm.Name)
+			latest.Annotations = map[string]string{vmv1.ActionAnnotation: vmv1.ActionHardReboot}
+			return k8sClient.Update(ctx, latest)
+		}, timeout, interval).Should(Succeed())
+
+		Eventually(actionCompleted, timeout, interval).Should(Equal("True/ActionTriggered"))
+		rebooted := getVM(vm.Name)
+		Expect(rebooted.Annotations).NotTo(HaveKey(vmv1.ActionAnnotation))
+		Expect(rebooted.Status.Servers).To(HaveLen(1))
+		Expect(fakeHeat.ServerActions(rebooted.Status.Servers[0].ID)).To(Equal([]string{"hard-reboot"}))
+
+		// an unknown server fails the action without running it
+		Eventually(func() error {
+			latest := getVM(vm.Name)
+			latest.Annotations = map[string]string{
+				vmv1.ActionAnnotation:        vmv1.ActionReboot,
+				vmv1.ActionServersAnnotation: "missing",
+			}
+			return k8sClient.Update(ctx, latest)
+		}, timeout, interval).Should(Succeed())
+		Eventually(actionCompleted, timeout, interval).Should(Equal("False/ActionFailed"))
+		Expect(fakeHeat.ServerActions(rebooted.Status.Servers[0].ID)).To(HaveLen(1))
+
+		// servers of the operator templates boot from a volume, which is
+		// reimaged
+		Eventually(func() error {
+			latest := getVM(vm.Name)
+			latest.Annotations = map[string]string{vmv1.ActionAnnotation: vmv1.ActionRebuild}
+			return k8sClient.Update(ctx, latest)
+		}, timeout, interval).Should(Succeed())
+		Eventually(func() string {
+			latest := getVM(vm.Name)
+			if latest == nil || latest.Annotations[vmv1.ActionAnnotation] != "" {
+				return ""
+			}
+			for _, cond := range latest.Status.Conditions {
+				if cond.Type == vmv1.ActionCompleted {
+					return cond.Message
+				}
+			}
+			return ""
+		}, timeout, interval).Should(HavePrefix("rebuild of "))
+		Expect(fakeHeat.ServerActions(rebooted.Status.Servers[0].ID)).To(Equal([]string{"hard-reboot", "reimage " + vm.Spec.Server.Image}))
+	})
+
+	It("should adopt an existing stack instead of creating one", func() {
+		vm := newVM("vm-adopt")
+		legacy := vm.DeepCopy()
+		legacy.Spec.Server.Flavor = "2-1024-20"
+		params, err := vmtpl.BuildParameters(&legacy.Spec)
+		Expect(err).NotTo(HaveOccurred())
+		stackID, err := fakeHeat.StackCreate(ctx, vm.Spec.Project.ProjectID, &stacks.CreateOpts{
+			Name:       "legacy-stack",
+			Parameters: params.Heat,
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Eventually(func() string { return fakeHeat.Status("legacy-stack") }, timeout, interval).Should(Equal(openstack.S_CREATE_COMPLETE))
+
+		creates := fakeHeat.Calls("StackCreate")
+		vm.Annotations = map[string]string{vmv1.AdoptAnnotation: "legacy-stack"}
+		Expect(k8sClient.Create(ctx, vm)).To(Succeed())
+
+		stackAdopted := func() string {
+			latest := getVM(vm.Name)
+			if latest == nil {
+				return ""
+			}
+			for _, cond := range latest.Status.Conditions {
+				if cond.Type == vmv1.StackAdopted {
+					return string(cond.Status) + "/" + cond.Reason
+				}
+			}
+			return ""
+		}
+		Eventually(stackAdopted, timeout, interval).Should(Equal("True/StackAdopted"))
+		Eventually(phaseOf(vm.Name), timeout, interval).Should(Equal(vmv1.AssemblyPhaseType(vmv1.Succeeded)))
+
+		adopted := getVM(vm.Name)
+		Expect(adopted.Status.StackID).To(Equal(stackID))
+		Expect(adopted.Status.StackName).To(Equal("legacy-stack"))
+		Expect(adopted.Status.VmStatus).To(Equal(openstack.S_UPDATE_COMPLETE))
+		Expect(fakeHeat.Calls("StackCreate")).To(Equal(creates))
+		Expect(fakeHeat.Parameters("legacy-stack")).To(HaveKeyWithValue("flavor", "1-512-20"))
+		Expect(fakeHeat.Tags("legacy-stack")).To(ContainElement(openstack.StackTag))
+	})
+
+	It("should render a dry run into a ConfigMap without creating a stack", func() {
+		vm := newVM("vm-dry-run")
+		vm.Spec.Server.AdminPass = "secret"
+		vm.Spec.SoftwareConfig = []byte("echo secret-config")
+		vm.Spec.DryRun = &vmv1.DryRunSpec{Preview: true}
+		Expect(k8sClient.Create(ctx, vm)).To(Succeed())
+
+		dryRun := func() *vmv1.DryRunStatus {
+			latest := getVM(vm.Name)
+			if latest == nil {
+				return nil
+			}
+			return latest.Status.DryRun
+		}
+		Eventually(dryRun, timeout, interval).ShouldNot(BeNil())
+		status := dryRun()
+		Expect(status.ConfigMap).To(Equal("vm-dry-run-dry-run"))
+		Expect(status.Digest).To(HavePrefix("sha256:"))
+
+		cm := &corev1.ConfigMap{}
+		Expect(k8sClient.Get(ctx, types.NamespacedName{Namespace: "default", Name: status.ConfigMap}, cm)).To(Succeed())
+		Expect(cm.Data).To(HaveKey(vmtpl.RootTemplate))
+		Expect(cm.Data).To(HaveKeyWithValue("digest", status.Digest))
+		Expect(cm.Data["parameters"]).To(ContainSubstring("admin_pass: " + vmtpl.Redacted))
+		for _, content := range cm.Data {
+			Expect(content).NotTo(ContainSubstring("secret"))
+		}
+		Expect(cm.Data["preview"]).To(ContainSubstring("mixapp_nodes"))
+		Expect(fakeHeat.Status(vm.Name)).To(BeEmpty())
+
+		// turning the dry run off creates the stack
+		Eventually(func() error {
+			latest := getVM(vm.Name)
+			latest.Spec.DryRun = nil
+			return k8sClient.Update(ctx, latest)
+		}, timeout, interval).Should(Succeed())
+		Eventually(phaseOf(vm.Name), timeout, interval).Should(Equal(vmv1.AssemblyPhaseType(vmv1.Succeeded)))
+	})
+})
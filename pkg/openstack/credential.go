@@ -0,0 +1,183 @@
+package openstack
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/gophercloud/gophercloud"
+	"gopkg.in/yaml.v2"
+)
+
+// keys of the credentials secret referenced by a VirtualMachine
+const (
+	SecretKeyAppCredentialID     = "application_credential_id"
+	SecretKeyAppCredentialSecret = "application_credential_secret"
+	SecretKeyUsername            = "username"
+	SecretKeyPassword            = "password"
+	SecretKeyUserDomainName      = "user_domain_name"
+	SecretKeyAuthURL             = "auth_url"
+	SecretKeyRegionName          = "region_name"
+	SecretKeyCloudsYaml          = "clouds.yaml"
+	SecretKeyCloud               = "cloud"
+)
+
+const defaultRegion = "RegionOne"
+
+type credentialSourceKey struct{}
+
+// WithCredentialSource returns a copy of ctx naming where the credentials of its
+// calls come from, e.g. the secret of a VirtualMachine. Clients are cached by
+// project and source, so credentials of a namespace are never used for calls
+// made on behalf of another.
+func WithCredentialSource(ctx context.Context, source string) context.Context {
+	return context.WithValue(ctx, credentialSourceKey{}, source)
+}
+
+func credentialSource(ctx context.Context) string {
+	source, _ := ctx.Value(credentialSourceKey{}).(string)
+	return source
+}
+
+// cloudsYaml is the subset of clouds.yaml used to authenticate a project
+type cloudsYaml struct {
+	Clouds map[string]struct {
+		Auth struct {
+			AuthURL                     string `yaml:"auth_url"`
+			Username                    string `yaml:"username"`
+			Password                    string `yaml:"password"`
+			UserDomainName              string `yaml:"user_domain_name"`
+			ApplicationCredentialID     string `yaml:"application_credential_id"`
+			ApplicationCredentialSecret string `yaml:"application_credential_secret"`
+			Token                       string `yaml:"token"`
+		} `yaml:"auth"`
+		RegionName string `yaml:"region_name"`
+	} `yaml:"clouds"`
+}
+
+// CredentialFromSecretData builds a UserCredential from the data of a credentials
+// secret. The secret holds either an application credential, a username/password
+// pair or a clouds.yaml, whose entry is chosen by cloud or else the 'cloud' key.
+func CredentialFromSecretData(data map[string][]byte, cloud string) (*UserCredential, error) {
+	if raw, ok := data[SecretKeyCloudsYaml]; ok {
+		if cloud == "" {
+			cloud = string(data[SecretKeyCloud])
+		}
+		return credentialFromCloudsYaml(raw, cloud)
+	}
+
+	cred := &UserCredential{
+		ApplicationCredentialID:     string(data[SecretKeyAppCredentialID]),
+		ApplicationCredentialSecret: string(data[SecretKeyAppCredentialSecret]),
+		Username:                    string(data[SecretKeyUsername]),
+		Password:                    string(data[SecretKeyPassword]),
+		UserDomainName:              string(data[SecretKeyUserDomainName]),
+		AuthURL:                     string(data[SecretKeyAuthURL]),
+		RegionName:                  string(data[SecretKeyRegionName]),
+	}
+	if err := cred.validate(); err != nil {
+		return nil, err
+	}
+	return cred, nil
+}
+
+func credentialFromCloudsYaml(raw []byte, cloud string) (*UserCredential, error) {
+	var clouds cloudsYaml
+	if err := yaml.Unmarshal(raw, &clouds); err != nil {
+		return nil, fmt.Errorf("failed to parse clouds.yaml: %v", err)
+	}
+
+	if cloud == "" && len(clouds.Clouds) == 1 {
+		for name := range clouds.Clouds {
+			cloud = name
+		}
+	}
+	entry, ok := clouds.Clouds[cloud]
+	if !ok {
+		return nil, fmt.Errorf("cloud %q not found in clouds.yaml", cloud)
+	}
+
+	cred := &UserCredential{
+		ApplicationCredentialID:     entry.Auth.ApplicationCredentialID,
+		ApplicationCredentialSecret: entry.Auth.ApplicationCredentialSecret,
+		Username:                    entry.Auth.Username,
+		Password:                    entry.Auth.Password,
+		UserDomainName:              entry.Auth.UserDomainName,
+		Token:                       entry.Auth.Token,
+		AuthURL:                     entry.Auth.AuthURL,
+		RegionName:                  entry.RegionName,
+	}
+	if err := cred.validate(); err != nil {
+		return nil, err
+	}
+	return cred, nil
+}
+
+func (c *UserCredential) validate() error {
+	switch {
+	case c.ApplicationCredentialID != "":
+		if c.ApplicationCredentialSecret == "" {
+			return errors.New("application credential secret is missing")
+		}
+	case c.Username != "":
+		if c.Password == "" {
+			return errors.New("password is missing")
+		}
+	case c.Token == "":
+		return errors.New("no application credential, password or token found")
+	}
+	return nil
+}
+
+// authOptions returns the options to authenticate to projectID with the credential
+func (c *UserCredential) authOptions(identityEndpoint string, projectID string) gophercloud.AuthOptions {
+	if c.AuthURL != "" {
+		identityEndpoint = c.AuthURL
+	}
+	authOpt := gophercloud.AuthOptions{
+		IdentityEndpoint: identityEndpoint,
+		AllowReauth:      c.Renewable(),
+	}
+
+	switch {
+	case c.ApplicationCredentialID != "":
+		// application credential is always scoped to its own project
+		authOpt.ApplicationCredentialID = c.ApplicationCredentialID
+		authOpt.ApplicationCredentialSecret = c.ApplicationCredentialSecret
+	case c.Username != "":
+		authOpt.Username = c.Username
+		authOpt.Password = c.Password
+		authOpt.DomainName = c.UserDomainName
+		authOpt.TenantID = projectID
+	default:
+		authOpt.TokenID = c.Token
+	}
+
+	return authOpt
+}
+
+// Renewable reports whether a new token can be issued from the credential
+func (c *UserCredential) Renewable() bool {
+	return c.ApplicationCredentialID != "" || c.Username != ""
+}
+
+func (c *UserCredential) region() string {
+	if c.RegionName != "" {
+		return c.RegionName
+	}
+	return defaultRegion
+}
+
+// hash identifies the content of the credential, to tell a rotated credential
+// from the cached one
+func (c *UserCredential) hash() string {
+	sum := sha256.Sum256([]byte(strings.Join([]string{
+		c.ApplicationCredentialID, c.ApplicationCredentialSecret,
+		c.Username, c.Password, c.UserDomainName,
+		c.Token, c.AuthURL, c.RegionName,
+	}, "\x00")))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,82 @@
+package openstack
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/gophercloud/gophercloud"
+)
+
+// ErrAuthExpired is returned when keystone rejects the credential of a project,
+// the cached client of the project has been dropped when it's returned
+type ErrAuthExpired struct {
+	ProjectID string
+	// Renewable is false when the project only has a token, which can't be renewed
+	Renewable bool
+	Err       error
+}
+
+func (e ErrAuthExpired) Error() string {
+	return fmt.Sprintf("authentication of project %s expired: %v", e.ProjectID, e.Err)
+}
+
+func IsAuthExpired(err error) bool {
+	_, ok := err.(ErrAuthExpired)
+	return ok
+}
+
+func isUnauthorized(err error) bool {
+	switch err.(type) {
+	case gophercloud.ErrDefault401, *gophercloud.ErrDefault401, gophercloud.ErrUnableToReauthenticate, *gophercloud.ErrUnableToReauthenticate:
+		return true
+	}
+	return false
+}
+
+// checkAuthError expires the cached client of projectID for the calls of ctx
+// if err means the credential was rejected, and converts err to ErrAuthExpired
+func (oss *OSService) checkAuthError(ctx context.Context, projectID string, err error) error {
+	// cloud admin renews its token by itself and has no credential to rebuild from
+	if err == nil || projectID == CLOUDADMIN || !isUnauthorized(err) {
+		return err
+	}
+	cred := oss.ClientCache.expire(oss.clientKey(ctx, projectID))
+
+	renewable := cred != nil && cred.Renewable()
+	return ErrAuthExpired{ProjectID: projectID, Renewable: renewable, Err: err}
+}
+
+// IsNotFound reports whether err means the requested stack doesn't exist
+func IsNotFound(err error) bool {
+	switch err.(type) {
+	case gophercloud.ErrDefault404, *gophercloud.ErrDefault404:
+		return true
+	}
+	return false
+}
+
+// IsInvalid reports whether openstack rejected the request itself, e.g. a
+// template failing validation or an exceeded quota, sending it again unchanged
+// fails again. Authentication, conflicts and throttling aren't, they may pass
+// on a retry.
+func IsInvalid(err error) bool {
+	var code int
+	switch e := err.(type) {
+	case gophercloud.ErrDefault400, *gophercloud.ErrDefault400,
+		gophercloud.ErrDefault403, *gophercloud.ErrDefault403,
+		gophercloud.ErrDefault404, *gophercloud.ErrDefault404,
+		gophercloud.ErrDefault405, *gophercloud.ErrDefault405:
+		return true
+	case gophercloud.ErrUnexpectedResponseCode:
+		code = e.Actual
+	case *gophercloud.ErrUnexpectedResponseCode:
+		code = e.Actual
+	default:
+		return false
+	}
+	switch code {
+	case 401, 408, 409, 429:
+		return false
+	}
+	return code >= 400 && code < 500
+}
@@ -0,0 +1,21 @@
+package openstack
+
+import (
+	"strings"
+
+	"github.com/gophercloud/gophercloud/openstack/orchestration/v1/stackevents"
+)
+
+// FailedResourceEvents returns the events of the resources of the stack
+// stackID turning to a failed status, the events of the stack itself only
+// repeat the reason of the failing resource
+func FailedResourceEvents(stackID string, events []stackevents.Event) []stackevents.Event {
+	var failed []stackevents.Event
+	for _, e := range events {
+		if e.PhysicalResourceID == stackID || !strings.HasSuffix(e.ResourceStatus, "_FAILED") {
+			continue
+		}
+		failed = append(failed, e)
+	}
+	return failed
+}
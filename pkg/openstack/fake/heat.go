@@ -0,0 +1,678 @@
+// Package fake provides an in-process heat for testing the controller without
+// any cloud.
+package fake
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"easystack.io/vm-operator/pkg/openstack"
+	"github.com/gophercloud/gophercloud"
+	"github.com/gophercloud/gophercloud/openstack/orchestration/v1/stackevents"
+	"github.com/gophercloud/gophercloud/openstack/orchestration/v1/stacks"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	actionCreate = "CREATE"
+	actionUpdate = "UPDATE"
+	actionDelete = "DELETE"
+)
+
+type stack struct {
+	seq        int
+	id         string
+	name       string
+	projectID  string
+	tags       []string
+	params     map[string]interface{}
+	template   []byte
+	action     string
+	createdAt  time.Time
+	startedAt  time.Time
+	failReason string
+	events     []event
+}
+
+// event is an event of a stack, resource is empty for the events of the stack
+// itself. The only resource event is the failure of the server resource when
+// an operation fails.
+type event struct {
+	id       string
+	time     time.Time
+	resource string
+	status   string
+	reason   string
+}
+
+// failedResource is the resource failing when an operation fails
+const failedResource = "server"
+
+// names returns the resource name and physical id of e of the stack s
+func (e event) names(s *stack) (string, string) {
+	if e.resource == "" {
+		return s.name, s.id
+	}
+	return e.resource, ""
+}
+
+// Heat simulates heat stacks, a stack stays in <ACTION>_IN_PROGRESS for Delay
+// after each operation and then turns to <ACTION>_COMPLETE, or to
+// <ACTION>_FAILED if a failure was injected by FailNext. The servers of the
+// stacks are simulated as well, see outputs.
+type Heat struct {
+	mu sync.Mutex
+	// Delay is how long a stack stays in progress
+	Delay time.Duration
+
+	stacks   map[string]*stack
+	failures map[string]string
+	authErr  map[string]error
+	nextID   int
+	calls    map[string]int
+	// actions are the actions run on each server
+	actions map[string][]string
+}
+
+var _ openstack.Service = &Heat{}
+
+func NewHeat(delay time.Duration) *Heat {
+	return &Heat{
+		Delay:    delay,
+		stacks:   make(map[string]*stack),
+		failures: make(map[string]string),
+		authErr:  make(map[string]error),
+		calls:    make(map[string]int),
+		actions:  make(map[string][]string),
+	}
+}
+
+// FailNext makes the next operation of action ("CREATE", "UPDATE" or "DELETE")
+// on the stack named stackName end in <ACTION>_FAILED with reason. Like the
+// other lookups by name, stackName may be the name of the VirtualMachine in
+// the owner tags of the stack instead.
+func (h *Heat) FailNext(action string, stackName string, reason string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.failures[action+"/"+stackName] = reason
+}
+
+// RejectAuth makes every call of projectID fail as if keystone rejected its
+// credential, until it's called again with a nil err
+func (h *Heat) RejectAuth(projectID string, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err == nil {
+		delete(h.authErr, projectID)
+		return
+	}
+	h.authErr[projectID] = err
+}
+
+// Calls returns how many times the operation named op was called
+func (h *Heat) Calls(op string) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.calls[op]
+}
+
+// Status returns the current status of the stack named stackName, empty if
+// there is no such stack
+func (h *Heat) Status(stackName string) string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, s := range h.stacks {
+		if named(s, stackName) {
+			return h.status(s)
+		}
+	}
+	return ""
+}
+
+// Parameters returns the parameters of the stack named stackName, nil if
+// there is no such stack
+func (h *Heat) Parameters(stackName string) map[string]interface{} {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, s := range h.stacks {
+		if named(s, stackName) {
+			return copyParams(nil, s.params)
+		}
+	}
+	return nil
+}
+
+// Tags returns the tags of the stack named stackName
+func (h *Heat) Tags(stackName string) []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, s := range h.stacks {
+		if named(s, stackName) {
+			return append([]string(nil), s.tags...)
+		}
+	}
+	return nil
+}
+
+// ServerActions returns the actions run on the server serverID, oldest first
+func (h *Heat) ServerActions(serverID string) []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]string(nil), h.actions[serverID]...)
+}
+
+func (h *Heat) Authenticate(ctx context.Context, projectID string, cred *openstack.UserCredential) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.calls["Authenticate"]++
+	return h.checkAuth(projectID)
+}
+
+func (h *Heat) StackCreate(ctx context.Context, projectID string, createOpts *stacks.CreateOpts) (string, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.calls["StackCreate"]++
+	if err := h.checkAuth(projectID); err != nil {
+		return "", err
+	}
+
+	for _, s := range h.stacks {
+		if s.name == createOpts.Name && s.projectID == projectID {
+			return "", gophercloud.ErrDefault409{}
+		}
+	}
+
+	h.nextID++
+	s := &stack{
+		seq:       h.nextID,
+		id:        fmt.Sprintf("stack-%d", h.nextID),
+		name:      createOpts.Name,
+		projectID: projectID,
+		tags:      createOpts.Tags,
+		createdAt: time.Now(),
+		params:    copyParams(nil, createOpts.Parameters),
+		template:  templateBin(createOpts.TemplateOpts),
+	}
+	h.start(s, actionCreate)
+	h.stacks[s.id] = s
+	return s.id, nil
+}
+
+func (h *Heat) StackGet(ctx context.Context, projectID string, stackName string, stackID string) (*stacks.RetrievedStack, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.calls["StackGet"]++
+	if err := h.checkAuth(projectID); err != nil {
+		return nil, err
+	}
+
+	s, err := h.find(stackName, stackID)
+	if err != nil {
+		return nil, err
+	}
+	return h.retrieved(s), nil
+}
+
+func (h *Heat) StackFind(ctx context.Context, projectID string, stackIdentity string) (*stacks.RetrievedStack, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.calls["StackFind"]++
+	if err := h.checkAuth(projectID); err != nil {
+		return nil, err
+	}
+
+	s, ok := h.identify(projectID, stackIdentity)
+	if !ok {
+		return nil, gophercloud.ErrDefault404{}
+	}
+	return h.retrieved(s), nil
+}
+
+// retrieved returns s as returned by heat, h.mu must be held
+func (h *Heat) retrieved(s *stack) *stacks.RetrievedStack {
+	status := h.status(s)
+	retrieved := &stacks.RetrievedStack{
+		ID:           s.id,
+		Name:         s.name,
+		Status:       status,
+		StatusReason: s.failReason,
+		Tags:         s.tags,
+		Parameters:   make(map[string]string),
+	}
+	for k, v := range s.params {
+		retrieved.Parameters[k] = fmt.Sprintf("%v", v)
+	}
+	if strings.HasSuffix(status, "_COMPLETE") {
+		retrieved.Outputs = outputs(s)
+	}
+	return retrieved
+}
+
+func (h *Heat) StackUpdate(ctx context.Context, projectID string, stackName string, stackID string, updateOpts *stacks.UpdateOpts) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.calls["StackUpdate"]++
+	if err := h.checkAuth(projectID); err != nil {
+		return err
+	}
+
+	s, err := h.find(stackName, stackID)
+	if err != nil {
+		return err
+	}
+	if strings.HasSuffix(h.status(s), "_IN_PROGRESS") {
+		return gophercloud.ErrDefault409{}
+	}
+	if updateOpts.Tags != nil {
+		s.tags = updateOpts.Tags
+	}
+	// a PATCH without template keeps existing parameters
+	if updateOpts.TemplateOpts == nil {
+		s.params = copyParams(s.params, updateOpts.Parameters)
+	} else {
+		s.params = copyParams(nil, updateOpts.Parameters)
+		s.template = templateBin(updateOpts.TemplateOpts)
+	}
+	h.start(s, actionUpdate)
+	return nil
+}
+
+// StackPreview returns the resources of the template of previewOpts, child
+// templates are not expanded
+func (h *Heat) StackPreview(ctx context.Context, projectID string, previewOpts *stacks.PreviewOpts) (*stacks.PreviewedStack, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.calls["StackPreview"]++
+	if err := h.checkAuth(projectID); err != nil {
+		return nil, err
+	}
+
+	var parsed struct {
+		Resources map[string]struct {
+			Type string `yaml:"type"`
+		} `yaml:"resources"`
+	}
+	if previewOpts.TemplateOpts != nil {
+		if err := yaml.Unmarshal(previewOpts.TemplateOpts.Bin, &parsed); err != nil {
+			return nil, err
+		}
+	}
+	names := make([]string, 0, len(parsed.Resources))
+	for name := range parsed.Resources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	previewed := &stacks.PreviewedStack{
+		Name:       previewOpts.Name,
+		Timeout:    previewOpts.Timeout,
+		Parameters: make(map[string]string),
+		Resources:  make([]interface{}, 0, len(names)),
+	}
+	for k, v := range previewOpts.Parameters {
+		previewed.Parameters[k] = fmt.Sprintf("%v", v)
+	}
+	for _, name := range names {
+		previewed.Resources = append(previewed.Resources, map[string]interface{}{
+			"resource_name": name,
+			"resource_type": parsed.Resources[name].Type,
+		})
+	}
+	return previewed, nil
+}
+
+func (h *Heat) StackDelete(ctx context.Context, projectID string, stackName string, stackID string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.calls["StackDelete"]++
+	if err := h.checkAuth(projectID); err != nil {
+		return err
+	}
+
+	s, err := h.find(stackName, stackID)
+	if err != nil {
+		return err
+	}
+	h.start(s, actionDelete)
+	return nil
+}
+
+func (h *Heat) StackAdminDelete(ctx context.Context, projectID string, stackName string, stackID string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.calls["StackAdminDelete"]++
+
+	s, err := h.find(stackName, stackID)
+	if err != nil || s.projectID != projectID {
+		return gophercloud.ErrDefault404{}
+	}
+	h.start(s, actionDelete)
+	return nil
+}
+
+func (h *Heat) StackAdminGet(ctx context.Context, projectID string, stackName string, stackID string) (*stacks.RetrievedStack, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.calls["StackAdminGet"]++
+
+	s, err := h.find(stackName, stackID)
+	if err != nil || s.projectID != projectID {
+		return nil, gophercloud.ErrDefault404{}
+	}
+	return h.retrieved(s), nil
+}
+
+func (h *Heat) StackListAll(ctx context.Context) ([]stacks.ListedStack, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.calls["StackListAll"]++
+
+	list := make([]stacks.ListedStack, 0, len(h.stacks))
+	for _, s := range h.sorted() {
+		status := h.status(s)
+		if status == openstack.S_DELETE_COMPLETE {
+			continue
+		}
+		list = append(list, stacks.ListedStack{
+			ID:           s.id,
+			Name:         s.name,
+			Status:       status,
+			StatusReason: s.failReason,
+			Tags:         s.tags,
+			Links: []gophercloud.Link{{
+				Href: strings.Join([]string{"http://heat/v1", s.projectID, "stacks", s.name, s.id}, "/"),
+				Rel:  "self",
+			}},
+		})
+	}
+	return list, nil
+}
+
+func (h *Heat) StackEvents(ctx context.Context, projectID string, stackName string, stackID string) ([]stackevents.Event, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.calls["StackEvents"]++
+	if err := h.checkAuth(projectID); err != nil {
+		return nil, err
+	}
+
+	s, err := h.find(stackName, stackID)
+	if err != nil {
+		return nil, err
+	}
+	var events []stackevents.Event
+	for _, e := range h.stackEvents(s) {
+		name, physicalID := e.names(s)
+		events = append(events, stackevents.Event{
+			ID:                   e.id,
+			Time:                 e.time,
+			ResourceName:         name,
+			LogicalResourceID:    name,
+			PhysicalResourceID:   physicalID,
+			ResourceStatus:       e.status,
+			ResourceStatusReason: e.reason,
+		})
+	}
+	return events, nil
+}
+
+// StackTemplate returns the template of the stack converted to json like heat
+// does, {} if it was created without one
+func (h *Heat) StackTemplate(ctx context.Context, projectID string, stackName string, stackID string) ([]byte, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.calls["StackTemplate"]++
+	if err := h.checkAuth(projectID); err != nil {
+		return nil, err
+	}
+
+	s, err := h.find(stackName, stackID)
+	if err != nil {
+		return nil, err
+	}
+	return templateJSON(s.template)
+}
+
+func (h *Heat) ServerReboot(ctx context.Context, projectID string, serverID string, hard bool) error {
+	action := "reboot"
+	if hard {
+		action = "hard-reboot"
+	}
+	return h.serverAction(projectID, serverID, action)
+}
+
+// ServerRebuild records "rebuild <image>", or "reimage <image>" for a server
+// booting from a volume
+func (h *Heat) ServerRebuild(ctx context.Context, projectID string, serverID string, imageID string, bootVolume bool) error {
+	if bootVolume {
+		return h.serverAction(projectID, serverID, "reimage "+imageID)
+	}
+	return h.serverAction(projectID, serverID, "rebuild "+imageID)
+}
+
+// serverAction records action on serverID, which must be a server of a
+// complete stack of projectID
+func (h *Heat) serverAction(projectID string, serverID string, action string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.calls["ServerAction"]++
+	if err := h.checkAuth(projectID); err != nil {
+		return err
+	}
+
+	for _, s := range h.stacks {
+		if s.projectID != projectID || !strings.HasSuffix(h.status(s), "_COMPLETE") || h.status(s) == openstack.S_DELETE_COMPLETE {
+			continue
+		}
+		for _, id := range serverIDs(s) {
+			if id == serverID {
+				h.actions[serverID] = append(h.actions[serverID], action)
+				return nil
+			}
+		}
+	}
+	return gophercloud.ErrDefault404{}
+}
+
+// named reports whether s is named name or owned by the VirtualMachine named
+// name, whose stack names are generated
+func named(s *stack, name string) bool {
+	if s.name == name {
+		return true
+	}
+	owner, ok := openstack.StackOwnerOf(s.tags)
+	return ok && owner.Name == name
+}
+
+// sorted returns all stacks in the order they were created
+func (h *Heat) sorted() []*stack {
+	list := make([]*stack, 0, len(h.stacks))
+	for _, s := range h.stacks {
+		list = append(list, s)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].seq < list[j].seq
+	})
+	return list
+}
+
+func (h *Heat) checkAuth(projectID string) error {
+	if err, ok := h.authErr[projectID]; ok {
+		return err
+	}
+	return nil
+}
+
+func (h *Heat) find(stackName string, stackID string) (*stack, error) {
+	s, ok := h.stacks[stackID]
+	if !ok || s.name != stackName || h.status(s) == openstack.S_DELETE_COMPLETE {
+		return nil, gophercloud.ErrDefault404{}
+	}
+	return s, nil
+}
+
+// identify returns the stack of projectID whose name or id is identity,
+// h.mu must be held
+func (h *Heat) identify(projectID string, identity string) (*stack, bool) {
+	for _, s := range h.stacks {
+		if s.projectID == projectID && (s.id == identity || s.name == identity) && h.status(s) != openstack.S_DELETE_COMPLETE {
+			return s, true
+		}
+	}
+	return nil, false
+}
+
+func (h *Heat) start(s *stack, action string) {
+	s.events = append(s.events, h.endEvents(s)...)
+	s.action = action
+	s.startedAt = time.Now()
+	s.failReason = ""
+	for key, reason := range h.failures {
+		if strings.HasPrefix(key, action+"/") && named(s, strings.TrimPrefix(key, action+"/")) {
+			s.failReason = reason
+			delete(h.failures, key)
+			break
+		}
+	}
+	s.events = append(s.events, event{
+		id:     fmt.Sprintf("%s-event-%d", s.id, len(s.events)),
+		time:   s.startedAt,
+		status: action + "_IN_PROGRESS",
+		reason: fmt.Sprintf("Stack %s started", action),
+	})
+}
+
+// endEvents returns the events of the end of the last operation of s, if it's
+// over. A failed operation ends with the failure of failedResource before the
+// one of the stack.
+func (h *Heat) endEvents(s *stack) []event {
+	if s.action == "" {
+		return nil
+	}
+	status := h.status(s)
+	if strings.HasSuffix(status, "_IN_PROGRESS") {
+		return nil
+	}
+	end := s.startedAt.Add(h.Delay)
+	if s.failReason == "" {
+		return []event{{
+			id:     fmt.Sprintf("%s-event-%d", s.id, len(s.events)),
+			time:   end,
+			status: status,
+			reason: fmt.Sprintf("Stack %s completed successfully", s.action),
+		}}
+	}
+	return []event{{
+		id:       fmt.Sprintf("%s-event-%d", s.id, len(s.events)),
+		time:     end,
+		resource: failedResource,
+		status:   status,
+		reason:   s.failReason,
+	}, {
+		id:     fmt.Sprintf("%s-event-%d", s.id, len(s.events)+1),
+		time:   end,
+		status: status,
+		reason: s.failReason,
+	}}
+}
+
+// stackEvents returns the events of s, oldest first
+func (h *Heat) stackEvents(s *stack) []event {
+	return append(append([]event(nil), s.events...), h.endEvents(s)...)
+}
+
+func (h *Heat) status(s *stack) string {
+	if time.Since(s.startedAt) < h.Delay {
+		return s.action + "_IN_PROGRESS"
+	}
+	if s.failReason != "" {
+		return s.action + "_FAILED"
+	}
+	return s.action + "_COMPLETE"
+}
+
+func copyParams(dst map[string]interface{}, src map[string]interface{}) map[string]interface{} {
+	if dst == nil {
+		dst = make(map[string]interface{})
+	}
+	for k, v := range src {
+		dst[k] = v
+	}
+	return dst
+}
+
+func templateBin(template *stacks.Template) []byte {
+	if template == nil {
+		return nil
+	}
+	return template.Bin
+}
+
+// templateJSON converts a yaml template to json
+func templateJSON(template []byte) ([]byte, error) {
+	var parsed interface{}
+	if err := yaml.Unmarshal(template, &parsed); err != nil {
+		return nil, err
+	}
+	if parsed == nil {
+		return []byte("{}"), nil
+	}
+	return json.Marshal(jsonValue(parsed))
+}
+
+// jsonValue converts the maps decoded by yaml to maps json can encode
+func jsonValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, val := range v {
+			m[fmt.Sprintf("%v", k)] = jsonValue(val)
+		}
+		return m
+	case []interface{}:
+		for i := range v {
+			v[i] = jsonValue(v[i])
+		}
+	}
+	return v
+}
+
+// serverIDs returns the ids of the servers of s, one per replica
+func serverIDs(s *stack) []string {
+	replicas, _ := strconv.Atoi(fmt.Sprintf("%v", s.params["replicas"]))
+	ids := make([]string, 0, replicas)
+	for i := 0; i < replicas; i++ {
+		ids = append(ids, fmt.Sprintf("%s-server-%d", s.id, i))
+	}
+	return ids
+}
+
+// outputs mimics the outputs of vm_group.yaml, one server per replica
+func outputs(s *stack) []map[string]interface{} {
+	var ids, names, fixedIPs, floatingIPs, bootVolumeIDs, dataVolumeIDs []interface{}
+	for i, id := range serverIDs(s) {
+		ids = append(ids, id)
+		names = append(names, fmt.Sprintf("%v-%d", s.params["name_prefix"], i))
+		fixedIPs = append(fixedIPs, fmt.Sprintf("10.0.0.%d", i+10))
+		floatingIPs = append(floatingIPs, "")
+		bootVolumeIDs = append(bootVolumeIDs, fmt.Sprintf("%s-boot-volume-%d", s.id, i))
+		dataVolumeIDs = append(dataVolumeIDs, []interface{}{})
+	}
+
+	return []map[string]interface{}{
+		{"output_key": "network", "output_value": s.id + "-network"},
+		{"output_key": "subnet", "output_value": s.id + "-subnet"},
+		{"output_key": "server_ids", "output_value": ids},
+		{"output_key": "server_names", "output_value": names},
+		{"output_key": "server_fixed_ips", "output_value": fixedIPs},
+		{"output_key": "server_floating_ips", "output_value": floatingIPs},
+		{"output_key": "server_boot_volume_ids", "output_value": bootVolumeIDs},
+		{"output_key": "server_data_volume_ids", "output_value": dataVolumeIDs},
+	}
+}
@@ -0,0 +1,792 @@
+package fake
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"easystack.io/vm-operator/pkg/openstack"
+	"github.com/gophercloud/gophercloud"
+	"github.com/gophercloud/gophercloud/openstack/orchestration/v1/stacks"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// Region is the region of the heat endpoint in the catalog of Server
+	Region = "RegionOne"
+
+	timeFormat = "2006-01-02T15:04:05Z"
+)
+
+// Server serves the subset of the keystone v3, heat v1 and nova v2.1 APIs used
+// by OSService over HTTP, the stacks and their servers are kept in a Heat. Keystone issues tokens to
+// the users, application credentials and tokens added to it, a token is scoped
+// to a single project and only grants access to the stacks of the project,
+// unless the stacks of all tenants are listed or the token is of an admin.
+type Server struct {
+	*httptest.Server
+	// PageSize caps the number of stacks and events returned by one list
+	// request, 0 means no cap
+	PageSize int
+
+	heat *Heat
+
+	mu       sync.Mutex
+	users    map[string]string
+	appCreds map[string]appCredential
+	tokens   map[string]string
+	// admins are the admin users and their tokens
+	admins      map[string]bool
+	adminTokens map[string]bool
+	nextToken   int
+	requests    map[string]int
+}
+
+type appCredential struct {
+	secret    string
+	projectID string
+}
+
+// NewServer starts a Server keeping stacks in heat, it must be closed by the caller
+func NewServer(heat *Heat) *Server {
+	s := &Server{
+		heat:        heat,
+		users:       make(map[string]string),
+		appCreds:    make(map[string]appCredential),
+		tokens:      make(map[string]string),
+		admins:      make(map[string]bool),
+		adminTokens: make(map[string]bool),
+		requests:    make(map[string]int),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	return s
+}
+
+// IdentityEndpoint returns the keystone v3 endpoint to authenticate against
+func (s *Server) IdentityEndpoint() string {
+	return s.URL + "/v3/"
+}
+
+// AddUser allows name to get a token of any project with password
+func (s *Server) AddUser(name string, password string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.users[name] = password
+}
+
+// AddAdmin is AddUser for an admin, whose tokens grant access to the stacks
+// of all projects
+func (s *Server) AddAdmin(name string, password string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.users[name] = password
+	s.admins[name] = true
+}
+
+// AddApplicationCredential allows the application credential id to get a token
+// of projectID with secret
+func (s *Server) AddApplicationCredential(id string, secret string, projectID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.appCreds[id] = appCredential{secret: secret, projectID: projectID}
+}
+
+// RemoveApplicationCredential revokes the application credential id, tokens
+// issued to it stay valid until RevokeTokens is called
+func (s *Server) RemoveApplicationCredential(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.appCreds, id)
+}
+
+// AddToken makes token a valid token of projectID
+func (s *Server) AddToken(token string, projectID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tokens[token] = projectID
+}
+
+// RevokeTokens expires all tokens issued so far, as keystone does once they
+// reach their expiry
+func (s *Server) RevokeTokens() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tokens = make(map[string]string)
+	s.adminTokens = make(map[string]bool)
+}
+
+// Requests returns how many requests were served for the method and resource,
+// resource is one of "tokens", "stacks" (list and create), "stack" (find,
+// get, update and delete), "preview", "outputs", "events", "template" and
+// "server action"
+func (s *Server) Requests(method string, resource string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[method+" "+resource]
+}
+
+func (s *Server) count(r *http.Request, resource string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests[r.Method+" "+resource]++
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case len(parts) == 3 && parts[0] == "v3" && parts[1] == "auth" && parts[2] == "tokens":
+		s.count(r, "tokens")
+		if r.Method != http.MethodPost {
+			writeError(w, http.StatusMethodNotAllowed, "")
+			return
+		}
+		s.issueToken(w, r)
+	case len(parts) >= 3 && parts[0] == "v1" && parts[2] == "stacks":
+		s.serveHeat(w, r, parts[1], parts[3:])
+	case len(parts) == 5 && parts[0] == "v2.1" && parts[2] == "servers" && parts[4] == "action":
+		s.count(r, "server action")
+		if r.Method != http.MethodPost {
+			writeError(w, http.StatusMethodNotAllowed, "")
+			return
+		}
+		s.serverAction(w, r, parts[1], parts[3])
+	default:
+		writeError(w, http.StatusNotFound, "")
+	}
+}
+
+type authRequest struct {
+	Auth struct {
+		Identity struct {
+			Methods  []string `json:"methods"`
+			Password *struct {
+				User struct {
+					Name     string `json:"name"`
+					Password string `json:"password"`
+				} `json:"user"`
+			} `json:"password"`
+			ApplicationCredential *struct {
+				ID     string `json:"id"`
+				Secret string `json:"secret"`
+			} `json:"application_credential"`
+			Token *struct {
+				ID string `json:"id"`
+			} `json:"token"`
+		} `json:"identity"`
+		Scope *struct {
+			Project *struct {
+				ID string `json:"id"`
+			} `json:"project"`
+		} `json:"scope"`
+	} `json:"auth"`
+}
+
+func (s *Server) issueToken(w http.ResponseWriter, r *http.Request) {
+	var req authRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	identity := req.Auth.Identity
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var projectID string
+	switch {
+	case identity.Password != nil:
+		password, ok := s.users[identity.Password.User.Name]
+		if !ok || password != identity.Password.User.Password {
+			writeError(w, http.StatusUnauthorized, "The request you have made requires authentication.")
+			return
+		}
+		if req.Auth.Scope == nil || req.Auth.Scope.Project == nil {
+			writeError(w, http.StatusBadRequest, "a project scope is required")
+			return
+		}
+		projectID = req.Auth.Scope.Project.ID
+	case identity.ApplicationCredential != nil:
+		cred, ok := s.appCreds[identity.ApplicationCredential.ID]
+		if !ok || cred.secret != identity.ApplicationCredential.Secret {
+			writeError(w, http.StatusUnauthorized, "The request you have made requires authentication.")
+			return
+		}
+		projectID = cred.projectID
+	case identity.Token != nil:
+		project, ok := s.tokens[identity.Token.ID]
+		if !ok {
+			writeError(w, http.StatusUnauthorized, "The request you have made requires authentication.")
+			return
+		}
+		projectID = project
+	default:
+		writeError(w, http.StatusBadRequest, "unsupported auth method")
+		return
+	}
+
+	s.nextToken++
+	token := fmt.Sprintf("token-%d", s.nextToken)
+	s.tokens[token] = projectID
+	if identity.Password != nil && s.admins[identity.Password.User.Name] {
+		s.adminTokens[token] = true
+	}
+
+	now := time.Now().UTC()
+	body := map[string]interface{}{
+		"token": map[string]interface{}{
+			"methods":    identity.Methods,
+			"issued_at":  now.Format(timeFormat),
+			"expires_at": now.Add(time.Hour).Format(timeFormat),
+			"project":    map[string]interface{}{"id": projectID, "name": projectID},
+			"catalog": []interface{}{
+				catalogEntry("identity", "keystone", s.URL+"/v3/"),
+				catalogEntry("orchestration", "heat", s.URL+"/v1/"+projectID),
+				catalogEntry("compute", "nova", s.URL+"/v2.1/"+projectID),
+			},
+		},
+	}
+	w.Header().Set("X-Subject-Token", token)
+	writeJSON(w, http.StatusCreated, body)
+}
+
+func catalogEntry(serviceType string, name string, url string) map[string]interface{} {
+	return map[string]interface{}{
+		"type": serviceType,
+		"name": name,
+		"endpoints": []interface{}{
+			map[string]interface{}{
+				"id":        name + "-public",
+				"interface": "public",
+				"region":    Region,
+				"region_id": Region,
+				"url":       url,
+			},
+		},
+	}
+}
+
+// authorize checks the token of r grants access to projectID
+func (s *Server) authorize(w http.ResponseWriter, r *http.Request, projectID string) bool {
+	s.mu.Lock()
+	token := r.Header.Get("X-Auth-Token")
+	tokenProject, ok := s.tokens[token]
+	admin := s.adminTokens[token]
+	s.mu.Unlock()
+
+	if !ok {
+		writeError(w, http.StatusUnauthorized, "The request you have made requires authentication.")
+		return false
+	}
+	if tokenProject != projectID && !admin {
+		writeError(w, http.StatusForbidden, "You are not authorized to access this project.")
+		return false
+	}
+	return true
+}
+
+func (s *Server) serveHeat(w http.ResponseWriter, r *http.Request, projectID string, path []string) {
+	if !s.authorize(w, r, projectID) {
+		return
+	}
+	// credential rejected by RejectAuth of heat
+	s.heat.mu.Lock()
+	err := s.heat.checkAuth(projectID)
+	s.heat.mu.Unlock()
+	if err != nil {
+		writeError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	switch {
+	case len(path) == 0 && r.Method == http.MethodGet:
+		s.count(r, "stacks")
+		s.listStacks(w, r, projectID)
+	case len(path) == 0 && r.Method == http.MethodPost:
+		s.count(r, "stacks")
+		s.createStack(w, r, projectID)
+	case len(path) == 1 && path[0] == "preview" && r.Method == http.MethodPost:
+		s.count(r, "preview")
+		s.previewStack(w, r, projectID)
+	case len(path) == 1 && r.Method == http.MethodGet:
+		s.count(r, "stack")
+		s.findStack(w, r, projectID, path[0])
+	case len(path) == 2:
+		s.count(r, "stack")
+		switch r.Method {
+		case http.MethodGet:
+			s.getStack(w, projectID, path[0], path[1])
+		case http.MethodPut, http.MethodPatch:
+			s.updateStack(w, r, projectID, path[0], path[1])
+		case http.MethodDelete:
+			s.deleteStack(w, r, projectID, path[0], path[1])
+		default:
+			writeError(w, http.StatusMethodNotAllowed, "")
+		}
+	case len(path) == 3 && path[2] == "outputs" && r.Method == http.MethodGet:
+		s.count(r, "outputs")
+		s.listOutputs(w, projectID, path[0], path[1])
+	case len(path) == 3 && path[2] == "events" && r.Method == http.MethodGet:
+		s.count(r, "events")
+		s.listEvents(w, r, projectID, path[0], path[1])
+	case len(path) == 3 && path[2] == "template" && r.Method == http.MethodGet:
+		s.count(r, "template")
+		s.getTemplate(w, projectID, path[0], path[1])
+	default:
+		writeError(w, http.StatusNotFound, "")
+	}
+}
+
+func (s *Server) listStacks(w http.ResponseWriter, r *http.Request, projectID string) {
+	query := r.URL.Query()
+	allTenants, _ := strconv.ParseBool(query.Get("global_tenant"))
+	var tags []string
+	if query.Get("tags") != "" {
+		tags = strings.Split(query.Get("tags"), ",")
+	}
+
+	h := s.heat
+	h.mu.Lock()
+	var list []map[string]interface{}
+	for _, st := range h.sorted() {
+		status := h.status(st)
+		if status == openstack.S_DELETE_COMPLETE || (!allTenants && st.projectID != projectID) || !hasTags(st.tags, tags) {
+			continue
+		}
+		body := h.stackBody(st, status)
+		body["links"] = []interface{}{
+			map[string]interface{}{"href": s.stackURL(st.projectID, st.name, st.id), "rel": "self"},
+		}
+		list = append(list, body)
+	}
+	h.mu.Unlock()
+
+	list = page(list, query.Get("marker"), s.limit(query.Get("limit")))
+	writeJSON(w, http.StatusOK, map[string]interface{}{"stacks": list})
+}
+
+func (s *Server) createStack(w http.ResponseWriter, r *http.Request, projectID string) {
+	var req struct {
+		Name       string                 `json:"stack_name"`
+		Template   string                 `json:"template"`
+		Files      map[string]string      `json:"files"`
+		Parameters map[string]interface{} `json:"parameters"`
+		Tags       string                 `json:"tags"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := checkTemplate(req.Template, req.Files); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	opts := &stacks.CreateOpts{
+		Name:         req.Name,
+		TemplateOpts: &stacks.Template{TE: stacks.TE{Bin: []byte(req.Template), Files: req.Files}},
+		Parameters:   req.Parameters,
+	}
+	if req.Tags != "" {
+		opts.Tags = strings.Split(req.Tags, ",")
+	}
+
+	id, err := s.heat.StackCreate(r.Context(), projectID, opts)
+	if err != nil {
+		s.writeHeatError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, map[string]interface{}{
+		"stack": map[string]interface{}{
+			"id":    id,
+			"links": []interface{}{map[string]interface{}{"href": s.stackURL(projectID, req.Name, id), "rel": "self"}},
+		},
+	})
+}
+
+func (s *Server) previewStack(w http.ResponseWriter, r *http.Request, projectID string) {
+	var req struct {
+		Name       string                 `json:"stack_name"`
+		Timeout    int                    `json:"timeout_mins"`
+		Template   string                 `json:"template"`
+		Files      map[string]string      `json:"files"`
+		Parameters map[string]interface{} `json:"parameters"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := checkTemplate(req.Template, req.Files); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	opts := &stacks.PreviewOpts{
+		Name:         req.Name,
+		Timeout:      req.Timeout,
+		TemplateOpts: &stacks.Template{TE: stacks.TE{Bin: []byte(req.Template), Files: req.Files}},
+		Parameters:   req.Parameters,
+	}
+
+	previewed, err := s.heat.StackPreview(r.Context(), projectID, opts)
+	if err != nil {
+		s.writeHeatError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"stack": map[string]interface{}{
+			"stack_name":   previewed.Name,
+			"timeout_mins": previewed.Timeout,
+			"parameters":   previewed.Parameters,
+			"resources":    previewed.Resources,
+		},
+	})
+}
+
+func (s *Server) getStack(w http.ResponseWriter, projectID string, name string, id string) {
+	h := s.heat
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.calls["StackGet"]++
+
+	st, ok := s.find(projectID, name, id)
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("The Stack (%s) could not be found.", name))
+		return
+	}
+	status := h.status(st)
+	body := h.stackBody(st, status)
+	params := make(map[string]string)
+	for k, v := range st.params {
+		params[k] = fmt.Sprintf("%v", v)
+	}
+	body["parameters"] = params
+	if strings.HasSuffix(status, "_COMPLETE") {
+		body["outputs"] = outputs(st)
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"stack": body})
+}
+
+// findStack redirects to the stack named or with the id identity, like heat
+func (s *Server) findStack(w http.ResponseWriter, r *http.Request, projectID string, identity string) {
+	h := s.heat
+	h.mu.Lock()
+	st, ok := h.identify(projectID, identity)
+	var location string
+	if ok {
+		location = s.stackURL(projectID, st.name, st.id)
+	}
+	h.mu.Unlock()
+
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("The Stack (%s) could not be found.", identity))
+		return
+	}
+	http.Redirect(w, r, location, http.StatusFound)
+}
+
+func (s *Server) updateStack(w http.ResponseWriter, r *http.Request, projectID string, name string, id string) {
+	var req struct {
+		Parameters map[string]interface{} `json:"parameters"`
+		Template   *string                `json:"template"`
+		Files      map[string]string      `json:"files"`
+		Tags       *string                `json:"tags"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !s.owns(projectID, name, id) {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("The Stack (%s) could not be found.", name))
+		return
+	}
+
+	opts := &stacks.UpdateOpts{Parameters: req.Parameters}
+	if req.Tags != nil {
+		opts.Tags = strings.Split(*req.Tags, ",")
+	}
+	if r.Method == http.MethodPut {
+		if req.Template == nil {
+			writeError(w, http.StatusBadRequest, "a template is required")
+			return
+		}
+		if err := checkTemplate(*req.Template, req.Files); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		opts.TemplateOpts = &stacks.Template{TE: stacks.TE{Bin: []byte(*req.Template), Files: req.Files}}
+	}
+	if err := s.heat.StackUpdate(r.Context(), projectID, name, id, opts); err != nil {
+		s.writeHeatError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (s *Server) deleteStack(w http.ResponseWriter, r *http.Request, projectID string, name string, id string) {
+	if !s.owns(projectID, name, id) {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("The Stack (%s) could not be found.", name))
+		return
+	}
+	if err := s.heat.StackDelete(r.Context(), projectID, name, id); err != nil {
+		s.writeHeatError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Server) listOutputs(w http.ResponseWriter, projectID string, name string, id string) {
+	h := s.heat
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	st, ok := s.find(projectID, name, id)
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("The Stack (%s) could not be found.", name))
+		return
+	}
+	list := []map[string]interface{}{}
+	if strings.HasSuffix(h.status(st), "_COMPLETE") {
+		list = outputs(st)
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"outputs": list})
+}
+
+func (s *Server) listEvents(w http.ResponseWriter, r *http.Request, projectID string, name string, id string) {
+	h := s.heat
+	h.mu.Lock()
+	st, ok := s.find(projectID, name, id)
+	var list []map[string]interface{}
+	if ok {
+		for _, e := range h.stackEvents(st) {
+			name, physicalID := e.names(st)
+			list = append(list, map[string]interface{}{
+				"id":                     e.id,
+				"event_time":             e.time.UTC().Format(timeFormat),
+				"resource_name":          name,
+				"logical_resource_id":    name,
+				"physical_resource_id":   physicalID,
+				"resource_status":        e.status,
+				"resource_status_reason": e.reason,
+				"links":                  []interface{}{},
+			})
+		}
+	}
+	h.mu.Unlock()
+
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("The Stack (%s) could not be found.", name))
+		return
+	}
+	query := r.URL.Query()
+	list = page(list, query.Get("marker"), s.limit(query.Get("limit")))
+	writeJSON(w, http.StatusOK, map[string]interface{}{"events": list})
+}
+
+func (s *Server) getTemplate(w http.ResponseWriter, projectID string, name string, id string) {
+	h := s.heat
+	h.mu.Lock()
+	st, ok := s.find(projectID, name, id)
+	var template []byte
+	if ok {
+		template = st.template
+	}
+	h.mu.Unlock()
+
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("The Stack (%s) could not be found.", name))
+		return
+	}
+	body, err := templateJSON(template)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
+
+func (s *Server) serverAction(w http.ResponseWriter, r *http.Request, projectID string, serverID string) {
+	if !s.authorize(w, r, projectID) {
+		return
+	}
+	var req struct {
+		Reboot *struct {
+			Type string `json:"type"`
+		} `json:"reboot"`
+		Rebuild *struct {
+			ImageRef string `json:"imageRef"`
+		} `json:"rebuild"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	var err error
+	switch {
+	case req.Reboot != nil:
+		err = s.heat.ServerReboot(r.Context(), projectID, serverID, req.Reboot.Type == "HARD")
+	case req.Rebuild != nil:
+		// the microversion reimaging boot volumes
+		bootVolume := r.Header.Get("X-OpenStack-Nova-API-Version") == "2.93"
+		err = s.heat.ServerRebuild(r.Context(), projectID, serverID, req.Rebuild.ImageRef, bootVolume)
+	default:
+		writeError(w, http.StatusBadRequest, "unsupported server action")
+		return
+	}
+	if err != nil {
+		if _, ok := err.(gophercloud.ErrDefault404); ok {
+			writeError(w, http.StatusNotFound, fmt.Sprintf("Instance %s could not be found.", serverID))
+			return
+		}
+		writeError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	if req.Rebuild != nil {
+		writeJSON(w, http.StatusAccepted, map[string]interface{}{
+			"server": map[string]interface{}{"id": serverID, "status": "REBUILD"},
+		})
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// find returns the stack of projectID named name with id, heat.mu must be held
+func (s *Server) find(projectID string, name string, id string) (*stack, bool) {
+	st, err := s.heat.find(name, id)
+	if err != nil || st.projectID != projectID {
+		return nil, false
+	}
+	return st, true
+}
+
+func (s *Server) owns(projectID string, name string, id string) bool {
+	s.heat.mu.Lock()
+	defer s.heat.mu.Unlock()
+	_, ok := s.find(projectID, name, id)
+	return ok
+}
+
+func (s *Server) stackURL(projectID string, name string, id string) string {
+	return strings.Join([]string{s.URL, "v1", projectID, "stacks", name, id}, "/")
+}
+
+// stackBody returns the fields of st shared by list and get, heat.mu must be held
+func (h *Heat) stackBody(st *stack, status string) map[string]interface{} {
+	return map[string]interface{}{
+		"id":                  st.id,
+		"stack_name":          st.name,
+		"stack_status":        status,
+		"stack_status_reason": st.failReason,
+		"stack_owner":         st.projectID,
+		"tags":                st.tags,
+		"creation_time":       st.createdAt.UTC().Format(timeFormat),
+	}
+}
+
+func (s *Server) limit(value string) int {
+	limit, _ := strconv.Atoi(value)
+	if s.PageSize > 0 && (limit <= 0 || limit > s.PageSize) {
+		limit = s.PageSize
+	}
+	return limit
+}
+
+// page returns at most limit items following the one whose id is marker
+func page(items []map[string]interface{}, marker string, limit int) []map[string]interface{} {
+	if marker != "" {
+		i := len(items)
+		for j := range items {
+			if items[j]["id"] == marker {
+				i = j + 1
+				break
+			}
+		}
+		items = items[i:]
+	}
+	if limit > 0 && len(items) > limit {
+		items = items[:limit]
+	}
+	if items == nil {
+		items = []map[string]interface{}{}
+	}
+	return items
+}
+
+// checkTemplate fails like heat does when a resource type refers to a child
+// template missing from files, heat can't fetch local files
+func checkTemplate(template string, files map[string]string) error {
+	if template == "" {
+		return fmt.Errorf("a template is required")
+	}
+	templates := map[string]string{"template": template}
+	for name, content := range files {
+		templates[name] = content
+	}
+	for name, content := range templates {
+		var parsed struct {
+			Resources map[string]struct {
+				Type string `yaml:"type"`
+			} `yaml:"resources"`
+		}
+		if err := yaml.Unmarshal([]byte(content), &parsed); err != nil {
+			return fmt.Errorf("failed to parse %s: %v", name, err)
+		}
+		for resName, res := range parsed.Resources {
+			if !strings.HasSuffix(res.Type, ".yaml") && !strings.HasSuffix(res.Type, ".template") {
+				continue
+			}
+			if _, ok := files[res.Type]; !ok {
+				return fmt.Errorf("resource %s of %s: could not fetch remote template %q", resName, name, res.Type)
+			}
+		}
+	}
+	return nil
+}
+
+func hasTags(stackTags []string, tags []string) bool {
+	for _, tag := range tags {
+		found := false
+		for _, t := range stackTags {
+			if t == tag {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *Server) writeHeatError(w http.ResponseWriter, err error) {
+	switch e := err.(type) {
+	case gophercloud.ErrDefault404:
+		writeError(w, http.StatusNotFound, "The Stack could not be found.")
+	case gophercloud.ErrDefault409:
+		writeError(w, http.StatusConflict, "The Stack is in a conflicting state.")
+	default:
+		writeError(w, http.StatusInternalServerError, e.Error())
+	}
+}
+
+func writeError(w http.ResponseWriter, code int, message string) {
+	writeJSON(w, code, map[string]interface{}{
+		"error": map[string]interface{}{
+			"code":    code,
+			"title":   http.StatusText(code),
+			"message": message,
+		},
+	})
+}
+
+func writeJSON(w http.ResponseWriter, code int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(body)
+}
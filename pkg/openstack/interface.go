@@ -0,0 +1,65 @@
+package openstack
+
+import (
+	"context"
+
+	"github.com/gophercloud/gophercloud/openstack/orchestration/v1/stackevents"
+	"github.com/gophercloud/gophercloud/openstack/orchestration/v1/stacks"
+)
+
+// StackService is the set of heat operations the controller depends on. It's
+// implemented by OSService against a real cloud and by fake.Heat in tests.
+// OSService logs with the logger of ctx, which carries the project and the
+// stack id of the caller, see utils.GetLogger. Project clients are those of
+// the credential source of ctx, see WithCredentialSource.
+type StackService interface {
+	// Authenticate makes sure a client of projectID is available, building one
+	// from cred if none is cached or cred differs from the cached credential
+	Authenticate(ctx context.Context, projectID string, cred *UserCredential) error
+	// StackCreate creates a stack from the template of createOpts, child
+	// templates must be in its Files already, they're never fetched
+	StackCreate(ctx context.Context, projectID string, createOpts *stacks.CreateOpts) (string, error)
+	// StackGet returns the stack including its outputs, see StackOutputs
+	StackGet(ctx context.Context, projectID string, stackName string, stackID string) (*stacks.RetrievedStack, error)
+	// StackFind returns the stack of projectID whose name or id is
+	// stackIdentity, including its outputs
+	StackFind(ctx context.Context, projectID string, stackIdentity string) (*stacks.RetrievedStack, error)
+	StackUpdate(ctx context.Context, projectID string, stackName string, stackID string, updateOpts *stacks.UpdateOpts) error
+	// StackPreview validates the stack heat would create from previewOpts and
+	// returns its resources, nothing is created
+	StackPreview(ctx context.Context, projectID string, previewOpts *stacks.PreviewOpts) (*stacks.PreviewedStack, error)
+	StackDelete(ctx context.Context, projectID string, stackName string, stackID string) error
+	// StackAdminDelete deletes the stack of projectID as cloud admin, for
+	// stacks of projects whose credential may be gone
+	StackAdminDelete(ctx context.Context, projectID string, stackName string, stackID string) error
+	// StackAdminGet returns the stack of projectID as cloud admin, for
+	// stacks of projects whose credential may be gone
+	StackAdminGet(ctx context.Context, projectID string, stackName string, stackID string) (*stacks.RetrievedStack, error)
+	// StackListAll lists the stacks tagged StackTag of all projects, see
+	// ListedStackProjectID for the project of a stack
+	StackListAll(ctx context.Context) ([]stacks.ListedStack, error)
+	// StackEvents returns the events of the stack, oldest first
+	StackEvents(ctx context.Context, projectID string, stackName string, stackID string) ([]stackevents.Event, error)
+	// StackTemplate returns the root template the stack was created or last
+	// updated with, as json, the child templates are not included
+	StackTemplate(ctx context.Context, projectID string, stackName string, stackID string) ([]byte, error)
+}
+
+// ServerService is the set of nova operations on the servers of stacks, the
+// project must have been authenticated with StackService.Authenticate
+type ServerService interface {
+	// ServerReboot reboots the server, hard cuts its power instead of asking
+	// its OS to restart
+	ServerReboot(ctx context.Context, projectID string, serverID string, hard bool) error
+	// ServerRebuild reinstalls the server from the image, the boot volume of
+	// a server booting from a volume is reimaged, which needs nova 2.93
+	ServerRebuild(ctx context.Context, projectID string, serverID string, imageID string, bootVolume bool) error
+}
+
+// Service is every OpenStack operation the controller depends on
+type Service interface {
+	StackService
+	ServerService
+}
+
+var _ Service = &OSService{}
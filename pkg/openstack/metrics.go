@@ -0,0 +1,159 @@
+package openstack
+
+import (
+	"context"
+	"time"
+
+	"github.com/gophercloud/gophercloud"
+	"github.com/gophercloud/gophercloud/openstack/orchestration/v1/stackevents"
+	"github.com/gophercloud/gophercloud/openstack/orchestration/v1/stacks"
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+var (
+	requests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "vm_operator_openstack_requests_total",
+		Help: "Number of keystone, heat and nova calls by operation and outcome.",
+	}, []string{"operation", "outcome"})
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "vm_operator_openstack_request_duration_seconds",
+		Help:    "Duration of keystone, heat and nova calls by operation.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"operation"})
+)
+
+func init() {
+	metrics.Registry.MustRegister(requests, requestDuration)
+}
+
+// WithMetrics returns svc counting its calls and their duration in the
+// vm_operator_openstack_requests_total and
+// vm_operator_openstack_request_duration_seconds metrics. Authenticate is only
+// a call when no client is cached, OSService observes it when it authenticates.
+func WithMetrics(svc Service) Service {
+	return &instrumentedService{svc: svc}
+}
+
+type instrumentedService struct {
+	svc Service
+}
+
+// outcome classifies the error of a call, the outcomes are success,
+// not_found, conflict, auth_expired and error
+func outcome(err error) string {
+	switch {
+	case err == nil:
+		return "success"
+	case IsNotFound(err):
+		return "not_found"
+	case IsAuthExpired(err):
+		return "auth_expired"
+	}
+	switch err.(type) {
+	case gophercloud.ErrDefault409, *gophercloud.ErrDefault409:
+		return "conflict"
+	}
+	return "error"
+}
+
+// observe records the call of operation started at start
+func observe(operation string, start time.Time, err error) {
+	requestDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+	requests.WithLabelValues(operation, outcome(err)).Inc()
+}
+
+func (i *instrumentedService) Authenticate(ctx context.Context, projectID string, cred *UserCredential) error {
+	return i.svc.Authenticate(ctx, projectID, cred)
+}
+
+func (i *instrumentedService) StackCreate(ctx context.Context, projectID string, createOpts *stacks.CreateOpts) (string, error) {
+	start := time.Now()
+	id, err := i.svc.StackCreate(ctx, projectID, createOpts)
+	observe("StackCreate", start, err)
+	return id, err
+}
+
+func (i *instrumentedService) StackGet(ctx context.Context, projectID string, stackName string, stackID string) (*stacks.RetrievedStack, error) {
+	start := time.Now()
+	stack, err := i.svc.StackGet(ctx, projectID, stackName, stackID)
+	observe("StackGet", start, err)
+	return stack, err
+}
+
+func (i *instrumentedService) StackFind(ctx context.Context, projectID string, stackIdentity string) (*stacks.RetrievedStack, error) {
+	start := time.Now()
+	stack, err := i.svc.StackFind(ctx, projectID, stackIdentity)
+	observe("StackFind", start, err)
+	return stack, err
+}
+
+func (i *instrumentedService) StackUpdate(ctx context.Context, projectID string, stackName string, stackID string, updateOpts *stacks.UpdateOpts) error {
+	start := time.Now()
+	err := i.svc.StackUpdate(ctx, projectID, stackName, stackID, updateOpts)
+	observe("StackUpdate", start, err)
+	return err
+}
+
+func (i *instrumentedService) StackPreview(ctx context.Context, projectID string, previewOpts *stacks.PreviewOpts) (*stacks.PreviewedStack, error) {
+	start := time.Now()
+	stack, err := i.svc.StackPreview(ctx, projectID, previewOpts)
+	observe("StackPreview", start, err)
+	return stack, err
+}
+
+func (i *instrumentedService) StackDelete(ctx context.Context, projectID string, stackName string, stackID string) error {
+	start := time.Now()
+	err := i.svc.StackDelete(ctx, projectID, stackName, stackID)
+	observe("StackDelete", start, err)
+	return err
+}
+
+func (i *instrumentedService) StackAdminDelete(ctx context.Context, projectID string, stackName string, stackID string) error {
+	start := time.Now()
+	err := i.svc.StackAdminDelete(ctx, projectID, stackName, stackID)
+	observe("StackAdminDelete", start, err)
+	return err
+}
+
+func (i *instrumentedService) StackAdminGet(ctx context.Context, projectID string, stackName string, stackID string) (*stacks.RetrievedStack, error) {
+	start := time.Now()
+	stack, err := i.svc.StackAdminGet(ctx, projectID, stackName, stackID)
+	observe("StackAdminGet", start, err)
+	return stack, err
+}
+
+func (i *instrumentedService) StackListAll(ctx context.Context) ([]stacks.ListedStack, error) {
+	start := time.Now()
+	list, err := i.svc.StackListAll(ctx)
+	observe("StackListAll", start, err)
+	return list, err
+}
+
+func (i *instrumentedService) StackEvents(ctx context.Context, projectID string, stackName string, stackID string) ([]stackevents.Event, error) {
+	start := time.Now()
+	events, err := i.svc.StackEvents(ctx, projectID, stackName, stackID)
+	observe("StackEvents", start, err)
+	return events, err
+}
+
+func (i *instrumentedService) StackTemplate(ctx context.Context, projectID string, stackName string, stackID string) ([]byte, error) {
+	start := time.Now()
+	template, err := i.svc.StackTemplate(ctx, projectID, stackName, stackID)
+	observe("StackTemplate", start, err)
+	return template, err
+}
+
+func (i *instrumentedService) ServerReboot(ctx context.Context, projectID string, serverID string, hard bool) error {
+	start := time.Now()
+	err := i.svc.ServerReboot(ctx, projectID, serverID, hard)
+	observe("ServerReboot", start, err)
+	return err
+}
+
+func (i *instrumentedService) ServerRebuild(ctx context.Context, projectID string, serverID string, imageID string, bootVolume bool) error {
+	start := time.Now()
+	err := i.svc.ServerRebuild(ctx, projectID, serverID, imageID, bootVolume)
+	observe("ServerRebuild", start, err)
+	return err
+}
@@ -3,28 +3,37 @@ package openstack
 import (
 	"context"
 	"fmt"
+	"strings"
 	"sync"
+	"time"
 
 	"easystack.io/vm-operator/pkg/utils"
-	"errors"
 	"github.com/go-logr/logr"
 	"github.com/gophercloud/gophercloud"
 	"github.com/gophercloud/gophercloud/openstack"
+	"github.com/gophercloud/gophercloud/openstack/compute/v2/servers"
+	"github.com/gophercloud/gophercloud/openstack/orchestration/v1/stackevents"
 	"github.com/gophercloud/gophercloud/openstack/orchestration/v1/stacks"
+	"github.com/gophercloud/gophercloud/openstack/orchestration/v1/stacktemplates"
 )
 
 const (
 	CLOUDADMIN = "drone"
 	StackTag   = "ecns-mixapp"
+	// stackListPageSize is the number of stacks asked for by one list request
+	stackListPageSize = 100
 )
 
 const (
 	S_CREATE_FAILED      = "CREATE_FAILED"
 	S_CREATE_IN_PROGRESS = "CREATE_IN_PROGRESS"
-	S_CREATE_COMPLETE    = "CREATE_IN_PROGRESS"
+	S_CREATE_COMPLETE    = "CREATE_COMPLETE"
 	S_UPDATE_FAILED      = "UPDATE_FAILED"
 	S_UPDATE_IN_PROGRESS = "UPDATE_IN_PROGRESS"
-	S_UPDATE_COMPLETE    = "UPDATE_IN_PROGRESS"
+	S_UPDATE_COMPLETE    = "UPDATE_COMPLETE"
+	S_DELETE_FAILED      = "DELETE_FAILED"
+	S_DELETE_IN_PROGRESS = "DELETE_IN_PROGRESS"
+	S_DELETE_COMPLETE    = "DELETE_COMPLETE"
 )
 
 type OSService struct {
@@ -33,25 +42,48 @@ type OSService struct {
 	ConfigDir    string
 }
 
-// use projectID as key
+// ClientCache holds the heat clients by project and source of their
+// credential, see WithCredentialSource. A project named by VirtualMachines of
+// several namespaces has a client for each of their credentials.
 type ClientCache struct {
-	mu             sync.Mutex
-	clientMap      map[string]*gophercloud.ServiceClient
-	userCredential map[string]*UserCredential
+	mu      sync.Mutex
+	clients map[clientKey]*cachedClient
+}
+
+type clientKey struct {
+	projectID string
+	source    string
+}
+
+// cachedClient is the client authenticated with cred, client is nil once its
+// token expired, it's rebuilt from cred on the next call
+type cachedClient struct {
+	client *gophercloud.ServiceClient
+	cred   *UserCredential
+	hash   string
 }
 
 type UserCredential struct {
 	ApplicationCredentialID     string
 	ApplicationCredentialSecret string
+	Username                    string
+	Password                    string
+	UserDomainName              string
+	Token                       string
+	// empty means the identity endpoint of cloud admin and RegionOne
+	AuthURL    string
+	RegionName string
 }
 
 func NewOSService(configDir string, logger logr.Logger) (*OSService, error) {
 	// get ECS cloud admin credential info from env
 	adminAuthOpt, err := openstack.AuthOptionsFromEnv()
 	if err != nil {
-		fmt.Print(err)
+		logger.Error(err, "Failed to read cloud admin credential from environment")
 		return nil, err
 	}
+	// admin client lives as long as the operator, renew its token on expiry
+	adminAuthOpt.AllowReauth = true
 
 	provider, err := openstack.AuthenticatedClient(adminAuthOpt)
 	if err != nil {
@@ -66,10 +98,8 @@ func NewOSService(configDir string, logger logr.Logger) (*OSService, error) {
 	}
 
 	// It's safe for first insert
-	cc := new(ClientCache)
-	cc.clientMap = make(map[string]*gophercloud.ServiceClient)
-	cc.userCredential = make(map[string]*UserCredential)
-	cc.clientMap[CLOUDADMIN] = client
+	cc := newClientCache()
+	cc.set(clientKey{projectID: CLOUDADMIN}, &cachedClient{client: client})
 	// TODO: init cache for project credential by 'openstack application credential list'
 
 	return &OSService{
@@ -79,127 +109,470 @@ func NewOSService(configDir string, logger logr.Logger) (*OSService, error) {
 	}, nil
 }
 
-func (oss *OSService) NewHeatClient(ctx context.Context, projectID string, token string) error {
-	logger := utils.GetLoggerOrDie(ctx)
-
-	if projectID == CLOUDADMIN {
-		logger.Info("Already has cloudadmin client during initialization")
-		return nil
+// NewProjectOSService returns an OSService without a cloud admin client, for
+// clients like vmctl which only act on the projects they hold credentials of.
+// Credentials without an auth url authenticate against identityEndpoint.
+func NewProjectOSService(identityEndpoint string) *OSService {
+	return &OSService{
+		AdminAuthOpt: &gophercloud.AuthOptions{IdentityEndpoint: identityEndpoint},
+		ClientCache:  newClientCache(),
 	}
+}
+
+// NewHeatClient authenticates to projectID with cred and caches the client
+// for the credential source of ctx. The credential is only cached once it's
+// accepted, a rejected one leaves the cached client alone.
+func (oss *OSService) NewHeatClient(ctx context.Context, projectID string, cred *UserCredential) error {
+	_, err := oss.newHeatClient(ctx, projectID, cred)
+	return err
+}
 
-	authOpt := gophercloud.AuthOptions{
-		IdentityEndpoint: oss.AdminAuthOpt.IdentityEndpoint,
-		TokenID:          token,
+func (oss *OSService) newHeatClient(ctx context.Context, projectID string, cred *UserCredential) (*gophercloud.ServiceClient, error) {
+	logger := utils.GetLogger(ctx)
+
+	if projectID == CLOUDADMIN {
+		return nil, fmt.Errorf("cloud admin client is only built during initialization")
 	}
 
+	authOpt := cred.authOptions(oss.AdminAuthOpt.IdentityEndpoint, projectID)
+	start := time.Now()
 	provider, err := openstack.AuthenticatedClient(authOpt)
+	observe("Authenticate", start, err)
 	if err != nil {
 		logger.Error(err, "Failed to Authenticate to OpenStack")
-		return err
+		if isUnauthorized(err) {
+			return nil, ErrAuthExpired{ProjectID: projectID, Renewable: cred.Renewable(), Err: err}
+		}
+		return nil, err
 	}
 
-	client, err := openstack.NewOrchestrationV1(provider, gophercloud.EndpointOpts{Region: "RegionOne"})
+	client, err := openstack.NewOrchestrationV1(provider, gophercloud.EndpointOpts{Region: cred.region()})
 	if err != nil {
 		logger.Error(err, "Failed to init heat client")
-		return err
+		return nil, err
 	}
 
-	oss.ClientCache.setClient(projectID, client)
-
-	return nil
+	oss.ClientCache.set(oss.clientKey(ctx, projectID), &cachedClient{client: client, cred: cred, hash: cred.hash()})
+	return client, nil
 }
 
-func (oss *OSService) GetHeatClient(ctx context.Context, projectID string, token string) (*gophercloud.ServiceClient, error) {
-	defer oss.ClientCache.mu.Unlock()
-	oss.ClientCache.mu.Lock()
+// GetHeatClient returns the client of projectID for the credential source of
+// ctx. A cred differing from the cached credential, e.g. of a rotated secret,
+// replaces the cached client, a nil cred rebuilds an expired client from the
+// cached credential.
+func (oss *OSService) GetHeatClient(ctx context.Context, projectID string, cred *UserCredential) (*gophercloud.ServiceClient, error) {
+	cached, ok := oss.ClientCache.get(oss.clientKey(ctx, projectID))
+	if ok && cached.client != nil && (cred == nil || cached.hash == cred.hash()) {
+		return cached.client, nil
+	}
 
-	if client, ok := oss.ClientCache.clientMap[projectID]; ok {
-		return client, nil
+	if cred == nil {
+		if !ok || cached.cred == nil {
+			return nil, fmt.Errorf("no credential found for project %s", projectID)
+		}
+		cred = cached.cred
 	}
+	return oss.newHeatClient(ctx, projectID, cred)
+}
 
-	err := oss.NewHeatClient(ctx, projectID, token)
-	if err != nil {
-		return nil, err
+// clientKey returns the key of the client of projectID for the calls of ctx,
+// the cloud admin has a single client
+func (oss *OSService) clientKey(ctx context.Context, projectID string) clientKey {
+	if projectID == CLOUDADMIN {
+		return clientKey{projectID: CLOUDADMIN}
 	}
+	return clientKey{projectID: projectID, source: credentialSource(ctx)}
+}
 
-	return oss.ClientCache.clientMap[projectID], nil
+func (oss *OSService) Authenticate(ctx context.Context, projectID string, cred *UserCredential) error {
+	_, err := oss.GetHeatClient(ctx, projectID, cred)
+	return err
 }
 
 func (oss *OSService) StackListAll(ctx context.Context) ([]stacks.ListedStack, error) {
-	client, err := oss.GetHeatClient(ctx, CLOUDADMIN, "")
+	logger := utils.GetLogger(ctx)
+
+	client, err := oss.GetHeatClient(ctx, CLOUDADMIN, nil)
 	if err != nil {
-		fmt.Printf("Failed to get heat client for %s\n", CLOUDADMIN)
+		logger.Error(err, "Failed to get heat client of cloud admin")
 		return nil, err
 	}
 
 	listOpts := stacks.ListOpts{AllTenants: true, Tags: StackTag}
 
-	return doStackList(client, listOpts)
-}
-
-func doStackList(client *gophercloud.ServiceClient, listOpts stacks.ListOpts) ([]stacks.ListedStack, error) {
-	allStackPages, err := stacks.List(client, listOpts).AllPages()
+	stackList, err := doStackList(client, listOpts)
 	if err != nil {
+		logger.Error(err, "List stacks failed")
 		return nil, err
 	}
+	logger.V(1).Info("Listed stacks", "count", len(stackList))
+	return stackList, nil
+}
 
-	stackList, err := stacks.ExtractStacks(allStackPages)
-	if err != nil {
-		return nil, err
+// doStackList lists stacks page by page, heat returns a single page per request
+// which may be capped below the limit, so the marker is followed until a page
+// comes back empty.
+func doStackList(client *gophercloud.ServiceClient, listOpts stacks.ListOpts) ([]stacks.ListedStack, error) {
+	if listOpts.Limit == 0 {
+		listOpts.Limit = stackListPageSize
 	}
 
-	for _, stack := range stackList {
-		fmt.Printf("%+v\n", stack)
+	var stackList []stacks.ListedStack
+	for {
+		stackPage, err := stacks.List(client, listOpts).AllPages()
+		if err != nil {
+			return nil, err
+		}
+
+		pageStacks, err := stacks.ExtractStacks(stackPage)
+		if err != nil {
+			return nil, err
+		}
+		if len(pageStacks) == 0 {
+			break
+		}
+
+		stackList = append(stackList, pageStacks...)
+		listOpts.Marker = pageStacks[len(pageStacks)-1].ID
 	}
 
 	return stackList, nil
 }
 
 func (oss *OSService) StackCreate(ctx context.Context, projectID string, createOpts *stacks.CreateOpts) (string, error) {
-	// cloudadmin is just for testing
-	// TODO: use credential of request project to identify
-	// if no credential cache found, create one for request project
-	client, err := oss.ClientCache.getClient(projectID)
+	logger := utils.GetLogger(ctx)
+
+	client, err := oss.GetHeatClient(ctx, projectID, nil)
 	if err != nil {
-		fmt.Printf("Failed to get auth client from cache: %v\n", err)
+		logger.Error(err, "Failed to get heat client")
 		return "", err
 	}
 
-	r := stacks.Create(client, createOpts)
+	r := stacks.Create(client, inMemoryCreateOpts{createOpts})
 	if r.Err != nil {
-		fmt.Printf("Create stack failed with err: %v\n", r.Err)
-		return "", r.Err
+		logger.Error(r.Err, "Create stack failed", "stack", createOpts.Name)
+		return "", oss.checkAuthError(ctx, projectID, r.Err)
 	}
 
 	createdStack, err := r.Extract()
 	if err != nil {
-		fmt.Printf("failed to extract stack info\n")
+		logger.Error(err, "Failed to extract created stack", "stack", createOpts.Name)
 		return "", err
 	}
-	fmt.Printf("Created Stack: %v", createdStack.ID)
+	logger.Info("Created stack", "stack", createOpts.Name, "stackID", createdStack.ID)
 
 	return createdStack.ID, nil
 }
 
-func (c *ClientCache) getClient(key string) (*gophercloud.ServiceClient, error) {
+// StackUpdate updates an existing stack. If updateOpts carries no template, only
+// the given parameters are sent with PATCH and Heat keeps the existing values for
+// the rest; otherwise the whole template is replaced with PUT.
+func (oss *OSService) StackUpdate(ctx context.Context, projectID string, stackName string, stackID string, updateOpts *stacks.UpdateOpts) error {
+	logger := utils.GetLogger(ctx)
+
+	client, err := oss.GetHeatClient(ctx, projectID, nil)
+	if err != nil {
+		logger.Error(err, "Failed to get heat client")
+		return err
+	}
+
+	var r stacks.UpdateResult
+	if updateOpts.TemplateOpts == nil {
+		r = stacks.UpdatePatch(client, stackName, stackID, updateOpts)
+	} else {
+		r = stacks.Update(client, stackName, stackID, inMemoryUpdateOpts{updateOpts})
+	}
+	if r.Err != nil {
+		logger.Error(r.Err, "Update stack failed", "stack", stackName)
+		return oss.checkAuthError(ctx, projectID, r.Err)
+	}
+	logger.Info("Updating stack", "stack", stackName, "full", updateOpts.TemplateOpts != nil)
+
+	return nil
+}
+
+// StackPreview asks heat to validate the stack of previewOpts, the resources
+// of the returned stack are the ones heat would create
+func (oss *OSService) StackPreview(ctx context.Context, projectID string, previewOpts *stacks.PreviewOpts) (*stacks.PreviewedStack, error) {
+	logger := utils.GetLogger(ctx)
+
+	client, err := oss.GetHeatClient(ctx, projectID, nil)
+	if err != nil {
+		logger.Error(err, "Failed to get heat client")
+		return nil, err
+	}
+
+	previewed, err := stacks.Preview(client, inMemoryPreviewOpts{previewOpts}).Extract()
+	if err != nil {
+		logger.Error(err, "Preview stack failed", "stack", previewOpts.Name)
+		return nil, oss.checkAuthError(ctx, projectID, err)
+	}
+
+	return previewed, nil
+}
+
+func (oss *OSService) StackDelete(ctx context.Context, projectID string, stackName string, stackID string) error {
+	logger := utils.GetLogger(ctx)
+
+	client, err := oss.GetHeatClient(ctx, projectID, nil)
+	if err != nil {
+		logger.Error(err, "Failed to get heat client")
+		return err
+	}
+
+	r := stacks.Delete(client, stackName, stackID)
+	if r.Err != nil {
+		if _, ok := r.Err.(gophercloud.ErrDefault404); ok {
+			logger.Info("Stack already deleted", "stack", stackName)
+			return nil
+		}
+		logger.Error(r.Err, "Delete stack failed", "stack", stackName)
+		return oss.checkAuthError(ctx, projectID, r.Err)
+	}
+	logger.Info("Deleting stack", "stack", stackName)
+
+	return nil
+}
+
+func (oss *OSService) StackAdminDelete(ctx context.Context, projectID string, stackName string, stackID string) error {
+	logger := utils.GetLogger(ctx)
+
+	client, err := oss.adminProjectClient(ctx, projectID)
+	if err != nil {
+		logger.Error(err, "Failed to get heat client of cloud admin")
+		return err
+	}
+
+	r := stacks.Delete(client, stackName, stackID)
+	if r.Err != nil {
+		if _, ok := r.Err.(gophercloud.ErrDefault404); ok {
+			logger.Info("Stack already deleted", "stack", stackName)
+			return nil
+		}
+		logger.Error(r.Err, "Delete stack as cloud admin failed", "stack", stackName)
+		return r.Err
+	}
+	logger.Info("Deleting stack as cloud admin", "stack", stackName)
+
+	return nil
+}
+
+func (oss *OSService) StackAdminGet(ctx context.Context, projectID string, stackName string, stackID string) (*stacks.RetrievedStack, error) {
+	logger := utils.GetLogger(ctx)
+
+	client, err := oss.adminProjectClient(ctx, projectID)
+	if err != nil {
+		logger.Error(err, "Failed to get heat client of cloud admin")
+		return nil, err
+	}
+
+	stack, err := stacks.Get(client, stackName, stackID).Extract()
+	if err != nil {
+		logger.Error(err, "Get stack as cloud admin failed", "stack", stackName)
+		return nil, err
+	}
+	return stack, nil
+}
+
+// adminProjectClient returns the heat client of the cloud admin for the
+// stacks of projectID, heat lets admins reach the stacks of other projects by
+// their url
+func (oss *OSService) adminProjectClient(ctx context.Context, projectID string) (*gophercloud.ServiceClient, error) {
+	admin, err := oss.GetHeatClient(ctx, CLOUDADMIN, nil)
+	if err != nil {
+		return nil, err
+	}
+	client := *admin
+	client.Endpoint = projectEndpoint(admin.Endpoint, projectID)
+	client.ResourceBase = ""
+	return &client, nil
+}
+
+// projectEndpoint returns the heat endpoint of projectID from the one of
+// another project, heat endpoints end with the project
+func projectEndpoint(endpoint string, projectID string) string {
+	base := strings.TrimSuffix(endpoint, "/")
+	if i := strings.LastIndex(base, "/"); i >= 0 {
+		base = base[:i]
+	}
+	return base + "/" + projectID + "/"
+}
+
+func (oss *OSService) StackGet(ctx context.Context, projectID string, stackName string, stackID string) (*stacks.RetrievedStack, error) {
+	logger := utils.GetLogger(ctx)
+
+	client, err := oss.GetHeatClient(ctx, projectID, nil)
+	if err != nil {
+		logger.Error(err, "Failed to get heat client")
+		return nil, err
+	}
+
+	stack, err := stacks.Get(client, stackName, stackID).Extract()
+	if err != nil {
+		logger.Error(err, "Get stack failed", "stack", stackName)
+		return nil, oss.checkAuthError(ctx, projectID, err)
+	}
+
+	return stack, nil
+}
+
+func (oss *OSService) StackFind(ctx context.Context, projectID string, stackIdentity string) (*stacks.RetrievedStack, error) {
+	logger := utils.GetLogger(ctx)
+
+	client, err := oss.GetHeatClient(ctx, projectID, nil)
+	if err != nil {
+		logger.Error(err, "Failed to get heat client")
+		return nil, err
+	}
+
+	// heat redirects to the stack named or with the id stackIdentity
+	stack, err := stacks.Find(client, stackIdentity).Extract()
+	if err != nil {
+		logger.Error(err, "Find stack failed", "stack", stackIdentity)
+		return nil, oss.checkAuthError(ctx, projectID, err)
+	}
+
+	return stack, nil
+}
+
+func (oss *OSService) StackEvents(ctx context.Context, projectID string, stackName string, stackID string) ([]stackevents.Event, error) {
+	logger := utils.GetLogger(ctx)
+
+	client, err := oss.GetHeatClient(ctx, projectID, nil)
+	if err != nil {
+		logger.Error(err, "Failed to get heat client")
+		return nil, err
+	}
+
+	listOpts := stackevents.ListOpts{SortKey: stackevents.SortCreatedAt, SortDir: stackevents.SortAsc}
+	pages, err := stackevents.List(client, stackName, stackID, listOpts).AllPages()
+	if err != nil {
+		logger.Error(err, "List stack events failed", "stack", stackName)
+		return nil, oss.checkAuthError(ctx, projectID, err)
+	}
+	return stackevents.ExtractEvents(pages)
+}
+
+func (oss *OSService) StackTemplate(ctx context.Context, projectID string, stackName string, stackID string) ([]byte, error) {
+	logger := utils.GetLogger(ctx)
+
+	client, err := oss.GetHeatClient(ctx, projectID, nil)
+	if err != nil {
+		logger.Error(err, "Failed to get heat client")
+		return nil, err
+	}
+
+	template, err := stacktemplates.Get(client, stackName, stackID).Extract()
+	if err != nil {
+		logger.Error(err, "Get stack template failed", "stack", stackName)
+		return nil, oss.checkAuthError(ctx, projectID, err)
+	}
+	return template, nil
+}
+
+func (oss *OSService) ServerReboot(ctx context.Context, projectID string, serverID string, hard bool) error {
+	client, err := oss.getComputeClient(ctx, projectID)
+	if err != nil {
+		return err
+	}
+
+	method := servers.SoftReboot
+	if hard {
+		method = servers.HardReboot
+	}
+	if err := servers.Reboot(client, serverID, servers.RebootOpts{Type: method}).ExtractErr(); err != nil {
+		utils.GetLogger(ctx).Error(err, "Reboot server failed", "server", serverID)
+		return oss.checkAuthError(ctx, projectID, err)
+	}
+	return nil
+}
+
+func (oss *OSService) ServerRebuild(ctx context.Context, projectID string, serverID string, imageID string, bootVolume bool) error {
+	client, err := oss.getComputeClient(ctx, projectID)
+	if err != nil {
+		return err
+	}
+	if bootVolume {
+		client.Microversion = reimageMicroversion
+	}
+
+	if _, err := servers.Rebuild(client, serverID, servers.RebuildOpts{ImageID: imageID}).Extract(); err != nil {
+		utils.GetLogger(ctx).Error(err, "Rebuild server failed", "server", serverID)
+		return oss.checkAuthError(ctx, projectID, err)
+	}
+	return nil
+}
+
+// getComputeClient returns a nova client sharing the token of the heat client
+// of projectID
+// reimageMicroversion is the first nova microversion rebuilding servers booting
+// from a volume, older ones reject the rebuild
+const reimageMicroversion = "2.93"
+
+func (oss *OSService) getComputeClient(ctx context.Context, projectID string) (*gophercloud.ServiceClient, error) {
+	logger := utils.GetLogger(ctx)
+
+	heat, err := oss.GetHeatClient(ctx, projectID, nil)
+	if err != nil {
+		logger.Error(err, "Failed to get heat client")
+		return nil, err
+	}
+
+	region := defaultRegion
+	if cached, ok := oss.ClientCache.get(oss.clientKey(ctx, projectID)); ok && cached.cred != nil {
+		region = cached.cred.region()
+	}
+	client, err := openstack.NewComputeV2(heat.ProviderClient, gophercloud.EndpointOpts{Region: region})
+	if err != nil {
+		logger.Error(err, "Failed to init nova client")
+		return nil, err
+	}
+	return client, nil
+}
+
+// StackOutputs flattens the outputs of stack to a map of output key to value
+func StackOutputs(stack *stacks.RetrievedStack) map[string]interface{} {
+	outputs := make(map[string]interface{})
+	for _, o := range stack.Outputs {
+		key, ok := o["output_key"].(string)
+		if !ok {
+			continue
+		}
+		outputs[key] = o["output_value"]
+	}
+	return outputs
+}
+
+func newClientCache() *ClientCache {
+	return &ClientCache{clients: make(map[clientKey]*cachedClient)}
+}
+
+func (c *ClientCache) get(key clientKey) (*cachedClient, bool) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	cli, ok := c.clientMap[key]
+	cached, ok := c.clients[key]
 	if !ok {
-		err := errors.New("client not found")
-		return nil, err
+		return nil, false
 	}
-	return cli, nil
+	copied := *cached
+	return &copied, true
 }
 
-func (c *ClientCache) setClient(key string, client *gophercloud.ServiceClient) {
+func (c *ClientCache) set(key clientKey, cached *cachedClient) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	c.clientMap[key] = client
+	c.clients[key] = cached
 }
 
-func (c *ClientCache) delClient(key string) {
+// expire drops the client of key keeping its credential, it returns the
+// credential or nil if there is none
+func (c *ClientCache) expire(key clientKey) *UserCredential {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	delete(c.clientMap, key)
+	cached, ok := c.clients[key]
+	if !ok {
+		return nil
+	}
+	cached.client = nil
+	return cached.cred
 }
@@ -0,0 +1,806 @@
+package openstack_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"easystack.io/vm-operator/pkg/openstack"
+	"easystack.io/vm-operator/pkg/openstack/fake"
+	"easystack.io/vm-operator/pkg/utils"
+	"github.com/gophercloud/gophercloud"
+	"github.com/gophercloud/gophercloud/openstack/orchestration/v1/stackevents"
+	"github.com/gophercloud/gophercloud/openstack/orchestration/v1/stacks"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+const (
+	adminProject = "admin"
+	projectA     = "8e5eda4cac9f460ea2b471a357c42dd0"
+	projectB     = "0c5e04cbf8c145d5b1d4c6e0e1c0e7a2"
+)
+
+type testEnv struct {
+	heat   *fake.Heat
+	server *fake.Server
+	oss    *openstack.OSService
+	ctx    context.Context
+	env    map[string]string
+}
+
+// newTestEnv starts a fake keystone and heat, and an OSService whose cloud
+// admin authenticates against it from the environment like in production
+func newTestEnv(t *testing.T, delay time.Duration) *testEnv {
+	heat := fake.NewHeat(delay)
+	server := fake.NewServer(heat)
+	server.AddAdmin("admin", "admin-password")
+	env := &testEnv{
+		heat:   heat,
+		server: server,
+		ctx:    utils.WithLogger(context.Background(), log.NullLogger{}),
+		env:    make(map[string]string),
+	}
+
+	env.setenv("OS_AUTH_URL", server.IdentityEndpoint())
+	env.setenv("OS_USERNAME", "admin")
+	env.setenv("OS_PASSWORD", "admin-password")
+	env.setenv("OS_DOMAIN_NAME", "Default")
+	env.setenv("OS_PROJECT_ID", adminProject)
+
+	oss, err := openstack.NewOSService("", log.NullLogger{})
+	if err != nil {
+		env.close()
+		t.Fatalf("NewOSService failed: %v", err)
+	}
+	env.oss = oss
+	return env
+}
+
+func (e *testEnv) setenv(key string, value string) {
+	if _, ok := e.env[key]; !ok {
+		e.env[key] = os.Getenv(key)
+	}
+	os.Setenv(key, value)
+}
+
+func (e *testEnv) close() {
+	e.server.Close()
+	for key, value := range e.env {
+		os.Setenv(key, value)
+	}
+}
+
+func createOpts(name string) *stacks.CreateOpts {
+	return &stacks.CreateOpts{
+		Name: name,
+		TemplateOpts: &stacks.Template{TE: stacks.TE{
+			Bin: []byte("heat_template_version: 2016-10-14\n"),
+		}},
+		Parameters: map[string]interface{}{"replicas": 2, "name_prefix": name},
+		Tags:       []string{openstack.StackTag},
+	}
+}
+
+func TestNewOSServiceRejectedAdmin(t *testing.T) {
+	env := newTestEnv(t, 0)
+	defer env.close()
+	env.setenv("OS_PASSWORD", "wrong")
+
+	if _, err := openstack.NewOSService("", log.NullLogger{}); err == nil {
+		t.Fatal("expected NewOSService to fail with a wrong admin password")
+	}
+	if n := env.server.Requests("POST", "tokens"); n != 2 {
+		t.Errorf("expected 2 token requests, got %d", n)
+	}
+}
+
+func TestNewHeatClient(t *testing.T) {
+	cases := []struct {
+		name      string
+		projectID string
+		cred      *openstack.UserCredential
+		wantErr   bool
+	}{
+		{
+			name:      "application credential",
+			projectID: projectA,
+			cred:      &openstack.UserCredential{ApplicationCredentialID: "app-cred", ApplicationCredentialSecret: "app-secret"},
+		},
+		{
+			name:      "password",
+			projectID: projectB,
+			cred:      &openstack.UserCredential{Username: "demo", Password: "demo-password", UserDomainName: "Default"},
+		},
+		{
+			name:      "token",
+			projectID: projectB,
+			cred:      &openstack.UserCredential{Token: "project-b-token"},
+		},
+		{
+			name:      "wrong secret",
+			projectID: projectA,
+			cred:      &openstack.UserCredential{ApplicationCredentialID: "app-cred", ApplicationCredentialSecret: "wrong"},
+			wantErr:   true,
+		},
+		{
+			name:      "unknown region",
+			projectID: projectA,
+			cred:      &openstack.UserCredential{ApplicationCredentialID: "app-cred", ApplicationCredentialSecret: "app-secret", RegionName: "RegionTwo"},
+			wantErr:   true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			env := newTestEnv(t, 0)
+			defer env.close()
+			env.server.AddApplicationCredential("app-cred", "app-secret", projectA)
+			env.server.AddUser("demo", "demo-password")
+			env.server.AddToken("project-b-token", projectB)
+
+			err := env.oss.NewHeatClient(env.ctx, c.projectID, c.cred)
+			if c.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				if _, err := env.oss.GetHeatClient(env.ctx, c.projectID, nil); err == nil {
+					t.Error("expected no client to be cached")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			client, err := env.oss.GetHeatClient(env.ctx, c.projectID, nil)
+			if err != nil {
+				t.Fatalf("expected a cached client: %v", err)
+			}
+			want := env.server.URL + "/v1/" + c.projectID + "/"
+			if client.Endpoint != want {
+				t.Errorf("expected heat endpoint %s, got %s", want, client.Endpoint)
+			}
+		})
+	}
+}
+
+func TestHeatClientCredentialSource(t *testing.T) {
+	env := newTestEnv(t, 0)
+	defer env.close()
+	env.server.AddApplicationCredential("app-cred", "app-secret", projectA)
+	ctxA := openstack.WithCredentialSource(env.ctx, "secret ns-a/cred")
+	ctxB := openstack.WithCredentialSource(env.ctx, "secret ns-b/cred")
+
+	good := &openstack.UserCredential{ApplicationCredentialID: "app-cred", ApplicationCredentialSecret: "app-secret"}
+	if err := env.oss.Authenticate(ctxA, projectA, good); err != nil {
+		t.Fatalf("Authenticate failed: %v", err)
+	}
+	if _, err := env.oss.StackCreate(ctxA, projectA, createOpts("vm-a")); err != nil {
+		t.Fatalf("StackCreate failed: %v", err)
+	}
+
+	// another namespace naming the same project can't use the client of ns-a
+	if _, err := env.oss.StackCreate(ctxB, projectA, createOpts("vm-b")); err == nil {
+		t.Error("expected no client for another credential source")
+	}
+	wrong := &openstack.UserCredential{ApplicationCredentialID: "app-cred", ApplicationCredentialSecret: "wrong"}
+	if err := env.oss.Authenticate(ctxB, projectA, wrong); !openstack.IsAuthExpired(err) {
+		t.Fatalf("expected the wrong secret to be rejected, got %v", err)
+	}
+	if _, err := env.oss.GetHeatClient(ctxB, projectA, nil); err == nil {
+		t.Error("expected the rejected credential not to be cached")
+	}
+	if _, err := env.oss.GetHeatClient(ctxA, projectA, nil); err != nil {
+		t.Errorf("expected the client of ns-a to stay cached, got %v", err)
+	}
+}
+
+func TestHeatClientRotatedCredential(t *testing.T) {
+	env := newTestEnv(t, 0)
+	defer env.close()
+	env.server.AddApplicationCredential("old-cred", "old-secret", projectA)
+	env.server.AddApplicationCredential("new-cred", "new-secret", projectA)
+
+	old := &openstack.UserCredential{ApplicationCredentialID: "old-cred", ApplicationCredentialSecret: "old-secret"}
+	if err := env.oss.Authenticate(env.ctx, projectA, old); err != nil {
+		t.Fatalf("Authenticate failed: %v", err)
+	}
+	oldClient, err := env.oss.GetHeatClient(env.ctx, projectA, nil)
+	if err != nil {
+		t.Fatalf("GetHeatClient failed: %v", err)
+	}
+
+	// the same credential reuses the cached client
+	tokens := env.server.Requests("POST", "tokens")
+	authentications := gatherRequests(t, "Authenticate", "success")
+	if err := env.oss.Authenticate(env.ctx, projectA, old); err != nil {
+		t.Fatalf("Authenticate failed: %v", err)
+	}
+	if n := env.server.Requests("POST", "tokens"); n != tokens {
+		t.Errorf("expected no new token for the cached credential, got %d requests", n-tokens)
+	}
+	if n := gatherRequests(t, "Authenticate", "success"); n != authentications {
+		t.Errorf("expected a cached client not to count as authentication, got %v", n-authentications)
+	}
+
+	// the rotated secret is used while the old client is still valid
+	rotated := &openstack.UserCredential{ApplicationCredentialID: "new-cred", ApplicationCredentialSecret: "new-secret"}
+	if err := env.oss.Authenticate(env.ctx, projectA, rotated); err != nil {
+		t.Fatalf("Authenticate failed: %v", err)
+	}
+	newClient, err := env.oss.GetHeatClient(env.ctx, projectA, nil)
+	if err != nil {
+		t.Fatalf("GetHeatClient failed: %v", err)
+	}
+	if newClient == oldClient {
+		t.Error("expected the client to be rebuilt from the rotated credential")
+	}
+	env.server.RemoveApplicationCredential("old-cred")
+	env.server.RevokeTokens()
+	if _, err := env.oss.StackCreate(env.ctx, projectA, createOpts("vm-a")); err != nil {
+		t.Errorf("expected the rotated credential to reauthenticate, got %v", err)
+	}
+}
+
+func TestNewProjectOSService(t *testing.T) {
+	env := newTestEnv(t, 0)
+	defer env.close()
+	env.server.AddToken("token-a", projectA)
+	oss := openstack.NewProjectOSService(env.server.IdentityEndpoint())
+
+	if err := oss.Authenticate(env.ctx, projectA, &openstack.UserCredential{Token: "token-a"}); err != nil {
+		t.Fatalf("Authenticate failed: %v", err)
+	}
+	if _, err := oss.StackCreate(env.ctx, projectA, createOpts("vm-a")); err != nil {
+		t.Fatalf("StackCreate failed: %v", err)
+	}
+	if _, err := oss.StackListAll(env.ctx); err == nil {
+		t.Error("expected StackListAll to fail without a cloud admin")
+	}
+}
+
+func TestStackLifecycle(t *testing.T) {
+	env := newTestEnv(t, 100*time.Millisecond)
+	defer env.close()
+	env.server.AddApplicationCredential("app-cred", "app-secret", projectA)
+	cred := &openstack.UserCredential{ApplicationCredentialID: "app-cred", ApplicationCredentialSecret: "app-secret"}
+	if err := env.oss.Authenticate(env.ctx, projectA, cred); err != nil {
+		t.Fatalf("Authenticate failed: %v", err)
+	}
+
+	id, err := env.oss.StackCreate(env.ctx, projectA, createOpts("vm-a"))
+	if err != nil {
+		t.Fatalf("StackCreate failed: %v", err)
+	}
+	if _, err := env.oss.StackCreate(env.ctx, projectA, createOpts("vm-a")); err == nil || openstack.IsAuthExpired(err) {
+		t.Errorf("expected a conflict creating vm-a twice, got %v", err)
+	}
+
+	stack := waitStack(t, env, projectA, "vm-a", id, openstack.S_CREATE_COMPLETE)
+	outputs := openstack.StackOutputs(stack)
+	if ids, ok := outputs["server_ids"].([]interface{}); !ok || len(ids) != 2 {
+		t.Errorf("expected 2 server ids in outputs, got %v", outputs["server_ids"])
+	}
+
+	update := &stacks.UpdateOpts{Parameters: map[string]interface{}{"replicas": 3}}
+	if err := env.oss.StackUpdate(env.ctx, projectA, "vm-a", id, update); err != nil {
+		t.Fatalf("StackUpdate failed: %v", err)
+	}
+	if n := env.server.Requests("PATCH", "stack"); n != 1 {
+		t.Errorf("expected update without template to PATCH, got %d PATCH requests", n)
+	}
+	stack = waitStack(t, env, projectA, "vm-a", id, openstack.S_UPDATE_COMPLETE)
+	if stack.Parameters["name_prefix"] != "vm-a" || stack.Parameters["replicas"] != "3" {
+		t.Errorf("expected PATCH to keep other parameters, got %v", stack.Parameters)
+	}
+
+	client, err := env.oss.GetHeatClient(env.ctx, projectA, nil)
+	if err != nil {
+		t.Fatalf("GetHeatClient failed: %v", err)
+	}
+	pages, err := stackevents.List(client, "vm-a", id, nil).AllPages()
+	if err != nil {
+		t.Fatalf("listing events failed: %v", err)
+	}
+	events, _ := stackevents.ExtractEvents(pages)
+	if len(events) != 4 || events[3].ResourceStatus != openstack.S_UPDATE_COMPLETE {
+		t.Errorf("expected create and update events, got %+v", events)
+	}
+
+	if err := env.oss.StackDelete(env.ctx, projectA, "vm-a", id); err != nil {
+		t.Fatalf("StackDelete failed: %v", err)
+	}
+	time.Sleep(150 * time.Millisecond)
+	if _, err := env.oss.StackGet(env.ctx, projectA, "vm-a", id); !openstack.IsNotFound(err) {
+		t.Errorf("expected not found after deletion, got %v", err)
+	}
+	if err := env.oss.StackDelete(env.ctx, projectA, "vm-a", id); err != nil {
+		t.Errorf("expected deleting a deleted stack to succeed, got %v", err)
+	}
+}
+
+func TestStackChildTemplates(t *testing.T) {
+	env := newTestEnv(t, 0)
+	defer env.close()
+	env.server.AddToken("token-a", projectA)
+	if err := env.oss.Authenticate(env.ctx, projectA, &openstack.UserCredential{Token: "token-a"}); err != nil {
+		t.Fatalf("Authenticate failed: %v", err)
+	}
+
+	template := func(files map[string]string) *stacks.Template {
+		return &stacks.Template{TE: stacks.TE{
+			Bin:   []byte("heat_template_version: 2016-10-14\nresources:\n  group:\n    type: vm.yaml\n"),
+			Files: files,
+		}}
+	}
+	opts := createOpts("vm-a")
+	opts.TemplateOpts = template(nil)
+	if _, err := env.oss.StackCreate(env.ctx, projectA, opts); err == nil {
+		t.Fatal("expected heat to reject a child template missing from files")
+	}
+
+	opts.TemplateOpts = template(map[string]string{"vm.yaml": "heat_template_version: 2016-10-14\n"})
+	id, err := env.oss.StackCreate(env.ctx, projectA, opts)
+	if err != nil {
+		t.Fatalf("StackCreate failed: %v", err)
+	}
+	waitStack(t, env, projectA, "vm-a", id, openstack.S_CREATE_COMPLETE)
+
+	update := &stacks.UpdateOpts{
+		TemplateOpts: template(map[string]string{"vm.yaml": "heat_template_version: 2016-10-14\n"}),
+		Parameters:   map[string]interface{}{"replicas": 3},
+	}
+	if err := env.oss.StackUpdate(env.ctx, projectA, "vm-a", id, update); err != nil {
+		t.Fatalf("StackUpdate failed: %v", err)
+	}
+	if n := env.server.Requests("PUT", "stack"); n != 1 {
+		t.Errorf("expected update with template to PUT, got %d PUT requests", n)
+	}
+}
+
+func TestStackPreview(t *testing.T) {
+	env := newTestEnv(t, 0)
+	defer env.close()
+	env.server.AddToken("token-a", projectA)
+	if err := env.oss.Authenticate(env.ctx, projectA, &openstack.UserCredential{Token: "token-a"}); err != nil {
+		t.Fatalf("Authenticate failed: %v", err)
+	}
+
+	opts := &stacks.PreviewOpts{
+		Name:    "vm-a",
+		Timeout: 60,
+		TemplateOpts: &stacks.Template{TE: stacks.TE{
+			Bin: []byte("heat_template_version: 2016-10-14\nresources:\n  group:\n    type: vm.yaml\n  net:\n    type: OS::Neutron::Net\n"),
+		}},
+		Parameters: map[string]interface{}{"replicas": 2},
+	}
+	if _, err := env.oss.StackPreview(env.ctx, projectA, opts); err == nil {
+		t.Fatal("expected heat to reject a child template missing from files")
+	}
+
+	opts.TemplateOpts.Files = map[string]string{"vm.yaml": "heat_template_version: 2016-10-14\n"}
+	previewed, err := env.oss.StackPreview(env.ctx, projectA, opts)
+	if err != nil {
+		t.Fatalf("StackPreview failed: %v", err)
+	}
+	if previewed.Name != "vm-a" || previewed.Parameters["replicas"] != "2" {
+		t.Errorf("unexpected previewed stack %+v", previewed)
+	}
+	if len(previewed.Resources) != 2 {
+		t.Errorf("expected 2 resources, got %v", previewed.Resources)
+	}
+	if n := env.server.Requests("POST", "preview"); n != 2 {
+		t.Errorf("expected 2 preview requests, got %d", n)
+	}
+
+	list, err := env.oss.StackListAll(env.ctx)
+	if err != nil {
+		t.Fatalf("StackListAll failed: %v", err)
+	}
+	if len(list) != 0 {
+		t.Errorf("expected preview to create no stack, got %v", list)
+	}
+}
+
+func TestStackTemplateAndEvents(t *testing.T) {
+	env := newTestEnv(t, 0)
+	defer env.close()
+	env.server.AddToken("token-a", projectA)
+	if err := env.oss.Authenticate(env.ctx, projectA, &openstack.UserCredential{Token: "token-a"}); err != nil {
+		t.Fatalf("Authenticate failed: %v", err)
+	}
+
+	id, err := env.oss.StackCreate(env.ctx, projectA, createOpts("vm-a"))
+	if err != nil {
+		t.Fatalf("StackCreate failed: %v", err)
+	}
+	waitStack(t, env, projectA, "vm-a", id, openstack.S_CREATE_COMPLETE)
+
+	template, err := env.oss.StackTemplate(env.ctx, projectA, "vm-a", id)
+	if err != nil {
+		t.Fatalf("StackTemplate failed: %v", err)
+	}
+	var parsed map[string]interface{}
+	if err := json.Unmarshal(template, &parsed); err != nil || parsed["heat_template_version"] != "2016-10-14" {
+		t.Errorf("unexpected template %s: %v", template, err)
+	}
+
+	events, err := env.oss.StackEvents(env.ctx, projectA, "vm-a", id)
+	if err != nil {
+		t.Fatalf("StackEvents failed: %v", err)
+	}
+	if len(events) != 2 || events[0].ResourceStatus != openstack.S_CREATE_IN_PROGRESS || events[1].ResourceStatus != openstack.S_CREATE_COMPLETE {
+		t.Errorf("expected create events, got %+v", events)
+	}
+
+	if _, err := env.oss.StackTemplate(env.ctx, projectA, "vm-a", "missing"); !openstack.IsNotFound(err) {
+		t.Errorf("expected not found, got %v", err)
+	}
+
+	// a failed stack has the event of its failed resource
+	env.heat.FailNext("CREATE", "vm-b", "No valid host was found")
+	id, err = env.oss.StackCreate(env.ctx, projectA, createOpts("vm-b"))
+	if err != nil {
+		t.Fatalf("StackCreate failed: %v", err)
+	}
+	waitStack(t, env, projectA, "vm-b", id, openstack.S_CREATE_FAILED)
+	events, err = env.oss.StackEvents(env.ctx, projectA, "vm-b", id)
+	if err != nil {
+		t.Fatalf("StackEvents failed: %v", err)
+	}
+	failed := openstack.FailedResourceEvents(id, events)
+	if len(failed) != 1 || failed[0].ResourceName != "server" || failed[0].ResourceStatusReason != "No valid host was found" {
+		t.Errorf("expected the failure of the server, got %+v", failed)
+	}
+}
+
+func TestStackFind(t *testing.T) {
+	env := newTestEnv(t, 0)
+	defer env.close()
+	env.server.AddToken("token-a", projectA)
+	env.server.AddToken("token-b", projectB)
+	for projectID, token := range map[string]string{projectA: "token-a", projectB: "token-b"} {
+		if err := env.oss.Authenticate(env.ctx, projectID, &openstack.UserCredential{Token: token}); err != nil {
+			t.Fatalf("Authenticate failed: %v", err)
+		}
+	}
+
+	id, err := env.oss.StackCreate(env.ctx, projectA, createOpts("vm-a"))
+	if err != nil {
+		t.Fatalf("StackCreate failed: %v", err)
+	}
+	waitStack(t, env, projectA, "vm-a", id, openstack.S_CREATE_COMPLETE)
+
+	for _, identity := range []string{"vm-a", id} {
+		stack, err := env.oss.StackFind(env.ctx, projectA, identity)
+		if err != nil {
+			t.Fatalf("StackFind %s failed: %v", identity, err)
+		}
+		if stack.ID != id || stack.Name != "vm-a" || stack.Parameters["name_prefix"] != "vm-a" {
+			t.Errorf("unexpected stack found by %s: %+v", identity, stack)
+		}
+		if _, ok := openstack.StackOutputs(stack)["server_ids"]; !ok {
+			t.Errorf("expected outputs of the stack found by %s", identity)
+		}
+	}
+
+	if _, err := env.oss.StackFind(env.ctx, projectB, id); !openstack.IsNotFound(err) {
+		t.Errorf("expected the stack of another project not to be found, got %v", err)
+	}
+}
+
+func TestServerActions(t *testing.T) {
+	env := newTestEnv(t, 0)
+	defer env.close()
+	env.server.AddToken("token-a", projectA)
+	if err := env.oss.Authenticate(env.ctx, projectA, &openstack.UserCredential{Token: "token-a"}); err != nil {
+		t.Fatalf("Authenticate failed: %v", err)
+	}
+
+	id, err := env.oss.StackCreate(env.ctx, projectA, createOpts("vm-a"))
+	if err != nil {
+		t.Fatalf("StackCreate failed: %v", err)
+	}
+	stack := waitStack(t, env, projectA, "vm-a", id, openstack.S_CREATE_COMPLETE)
+	serverIDs := openstack.StackOutputs(stack)["server_ids"].([]interface{})
+	server := serverIDs[1].(string)
+
+	if err := env.oss.ServerReboot(env.ctx, projectA, server, false); err != nil {
+		t.Fatalf("ServerReboot failed: %v", err)
+	}
+	if err := env.oss.ServerReboot(env.ctx, projectA, server, true); err != nil {
+		t.Fatalf("ServerReboot failed: %v", err)
+	}
+	if err := env.oss.ServerRebuild(env.ctx, projectA, server, "cirros", false); err != nil {
+		t.Fatalf("ServerRebuild failed: %v", err)
+	}
+	if err := env.oss.ServerRebuild(env.ctx, projectA, server, "cirros", true); err != nil {
+		t.Fatalf("ServerRebuild failed: %v", err)
+	}
+	actions := env.heat.ServerActions(server)
+	if fmt.Sprint(actions) != "[reboot hard-reboot rebuild cirros reimage cirros]" {
+		t.Errorf("unexpected actions %v", actions)
+	}
+	if n := env.server.Requests("POST", "server action"); n != 4 {
+		t.Errorf("expected 4 server action requests, got %d", n)
+	}
+
+	if err := env.oss.ServerReboot(env.ctx, projectA, "missing", false); !openstack.IsNotFound(err) {
+		t.Errorf("expected not found, got %v", err)
+	}
+}
+
+func waitStack(t *testing.T, env *testEnv, projectID string, name string, id string, status string) *stacks.RetrievedStack {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		stack, err := env.oss.StackGet(env.ctx, projectID, name, id)
+		if err != nil {
+			t.Fatalf("StackGet failed: %v", err)
+		}
+		if stack.Status == status {
+			return stack
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("stack %s is %s, expected %s", name, stack.Status, status)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestStackListAllPagination(t *testing.T) {
+	env := newTestEnv(t, 0)
+	defer env.close()
+	env.server.PageSize = 3
+	env.server.AddApplicationCredential("cred-a", "secret-a", projectA)
+	env.server.AddApplicationCredential("cred-b", "secret-b", projectB)
+	for projectID, cred := range map[string]*openstack.UserCredential{
+		projectA: {ApplicationCredentialID: "cred-a", ApplicationCredentialSecret: "secret-a"},
+		projectB: {ApplicationCredentialID: "cred-b", ApplicationCredentialSecret: "secret-b"},
+	} {
+		if err := env.oss.Authenticate(env.ctx, projectID, cred); err != nil {
+			t.Fatalf("Authenticate failed: %v", err)
+		}
+	}
+
+	for i := 0; i < 8; i++ {
+		projectID := projectA
+		if i%2 == 1 {
+			projectID = projectB
+		}
+		if _, err := env.oss.StackCreate(env.ctx, projectID, createOpts(fmt.Sprintf("vm-%d", i))); err != nil {
+			t.Fatalf("StackCreate failed: %v", err)
+		}
+	}
+	// stacks not created by the operator are not listed
+	untagged := createOpts("not-mine")
+	untagged.Tags = nil
+	if _, err := env.oss.StackCreate(env.ctx, projectA, untagged); err != nil {
+		t.Fatalf("StackCreate failed: %v", err)
+	}
+
+	list, err := env.oss.StackListAll(env.ctx)
+	if err != nil {
+		t.Fatalf("StackListAll failed: %v", err)
+	}
+	if len(list) != 8 {
+		t.Fatalf("expected 8 stacks of all projects, got %d", len(list))
+	}
+	seen := make(map[string]bool)
+	for _, s := range list {
+		if seen[s.ID] {
+			t.Errorf("stack %s listed twice", s.ID)
+		}
+		seen[s.ID] = true
+	}
+	// 3 full pages and the empty one ending the list
+	if n := env.server.Requests("GET", "stacks"); n != 4 {
+		t.Errorf("expected 4 list requests, got %d", n)
+	}
+}
+
+func TestStackAdminDelete(t *testing.T) {
+	env := newTestEnv(t, 0)
+	defer env.close()
+	env.server.AddToken("token-a", projectA)
+	if err := env.oss.Authenticate(env.ctx, projectA, &openstack.UserCredential{Token: "token-a"}); err != nil {
+		t.Fatalf("Authenticate failed: %v", err)
+	}
+
+	owner := openstack.StackOwner{Namespace: "default", Name: "vm-a", UID: "uid-a", Cluster: "cluster-a"}
+	opts := createOpts("vm-a")
+	opts.Tags = openstack.StackTags(owner)
+	id, err := env.oss.StackCreate(env.ctx, projectA, opts)
+	if err != nil {
+		t.Fatalf("StackCreate failed: %v", err)
+	}
+
+	list, err := env.oss.StackListAll(env.ctx)
+	if err != nil || len(list) != 1 {
+		t.Fatalf("expected the stack to be listed, got %v: %v", list, err)
+	}
+	if got := openstack.ListedStackProjectID(&list[0]); got != projectA {
+		t.Errorf("expected project %s, got %s", projectA, got)
+	}
+	if got, ok := openstack.StackOwnerOf(list[0].Tags); !ok || got != owner {
+		t.Errorf("expected owner %+v, got %+v", owner, got)
+	}
+
+	// the admin gets and deletes the stack of another project
+	stack, err := env.oss.StackAdminGet(env.ctx, projectA, "vm-a", id)
+	if err != nil {
+		t.Fatalf("StackAdminGet failed: %v", err)
+	}
+	if stack.ID != id {
+		t.Errorf("expected stack %s, got %s", id, stack.ID)
+	}
+	if err := env.oss.StackAdminDelete(env.ctx, projectA, "vm-a", id); err != nil {
+		t.Fatalf("StackAdminDelete failed: %v", err)
+	}
+	if status := env.heat.Status("vm-a"); status != openstack.S_DELETE_COMPLETE {
+		t.Errorf("expected the stack to be deleted, got %s", status)
+	}
+	if err := env.oss.StackAdminDelete(env.ctx, projectB, "vm-b", "missing"); err != nil {
+		t.Errorf("expected deleting a missing stack to succeed, got %v", err)
+	}
+}
+
+func TestAuthExpired(t *testing.T) {
+	env := newTestEnv(t, 0)
+	defer env.close()
+	env.server.AddApplicationCredential("app-cred", "app-secret", projectA)
+	env.server.AddToken("project-b-token", projectB)
+	appCred := &openstack.UserCredential{ApplicationCredentialID: "app-cred", ApplicationCredentialSecret: "app-secret"}
+	token := &openstack.UserCredential{Token: "project-b-token"}
+	if err := env.oss.Authenticate(env.ctx, projectA, appCred); err != nil {
+		t.Fatalf("Authenticate failed: %v", err)
+	}
+	if err := env.oss.Authenticate(env.ctx, projectB, token); err != nil {
+		t.Fatalf("Authenticate failed: %v", err)
+	}
+	idA, err := env.oss.StackCreate(env.ctx, projectA, createOpts("vm-a"))
+	if err != nil {
+		t.Fatalf("StackCreate failed: %v", err)
+	}
+	idB, err := env.oss.StackCreate(env.ctx, projectB, createOpts("vm-b"))
+	if err != nil {
+		t.Fatalf("StackCreate failed: %v", err)
+	}
+
+	env.server.RevokeTokens()
+
+	// the application credential and the cloud admin get a new token by themselves
+	if _, err := env.oss.StackGet(env.ctx, projectA, "vm-a", idA); err != nil {
+		t.Errorf("expected project with application credential to reauthenticate, got %v", err)
+	}
+	if _, err := env.oss.StackListAll(env.ctx); err != nil {
+		t.Errorf("expected cloud admin to reauthenticate, got %v", err)
+	}
+
+	// a token can't be renewed
+	_, err = env.oss.StackGet(env.ctx, projectB, "vm-b", idB)
+	expired, ok := err.(openstack.ErrAuthExpired)
+	if !ok {
+		t.Fatalf("expected ErrAuthExpired, got %v", err)
+	}
+	if expired.ProjectID != projectB || expired.Renewable {
+		t.Errorf("expected unrenewable expiry of %s, got %+v", projectB, expired)
+	}
+	if _, err := env.oss.StackGet(env.ctx, projectB, "vm-b", idB); !openstack.IsAuthExpired(err) {
+		t.Errorf("expected the client of the expired token to be dropped, got %v", err)
+	}
+
+	// a removed application credential fails to reauthenticate
+	env.server.RemoveApplicationCredential("app-cred")
+	env.server.RevokeTokens()
+	_, err = env.oss.StackGet(env.ctx, projectA, "vm-a", idA)
+	expired, ok = err.(openstack.ErrAuthExpired)
+	if !ok {
+		t.Fatalf("expected ErrAuthExpired, got %v", err)
+	}
+	if !expired.Renewable {
+		t.Errorf("expected renewable expiry, got %+v", expired)
+	}
+
+	// a project never authenticated has no client
+	if _, err := env.oss.StackGet(env.ctx, "unknown", "vm", "id"); err == nil || openstack.IsAuthExpired(err) {
+		t.Errorf("expected a missing credential error, got %v", err)
+	}
+}
+
+// gatherRequests returns the number of calls of operation with outcome, or
+// the number of their durations observed if outcome is empty
+func gatherRequests(t *testing.T, operation string, outcome string) float64 {
+	families, err := metrics.Registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := "vm_operator_openstack_requests_total"
+	if outcome == "" {
+		name = "vm_operator_openstack_request_duration_seconds"
+	}
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+	metric:
+		for _, m := range family.GetMetric() {
+			for _, label := range m.GetLabel() {
+				if (label.GetName() == "operation" && label.GetValue() != operation) ||
+					(label.GetName() == "outcome" && label.GetValue() != outcome) {
+					continue metric
+				}
+			}
+			if outcome == "" {
+				return float64(m.GetHistogram().GetSampleCount())
+			}
+			return m.GetCounter().GetValue()
+		}
+	}
+	return 0
+}
+
+func TestWithMetrics(t *testing.T) {
+	ctx := utils.WithLogger(context.Background(), log.NullLogger{})
+	heat := fake.NewHeat(0)
+	oss := openstack.WithMetrics(heat)
+	durations := gatherRequests(t, "StackCreate", "")
+
+	id, err := oss.StackCreate(ctx, projectA, createOpts("vm-a"))
+	if err != nil {
+		t.Fatalf("StackCreate failed: %v", err)
+	}
+	if _, err := oss.StackGet(ctx, projectA, "vm-a", id); err != nil {
+		t.Fatalf("StackGet failed: %v", err)
+	}
+	if _, err := oss.StackGet(ctx, projectA, "vm-b", "missing"); !openstack.IsNotFound(err) {
+		t.Fatalf("expected not found, got %v", err)
+	}
+	heat.RejectAuth(projectA, openstack.ErrAuthExpired{ProjectID: projectA})
+	if _, err := oss.StackGet(ctx, projectA, "vm-a", id); !openstack.IsAuthExpired(err) {
+		t.Fatalf("expected auth expired, got %v", err)
+	}
+
+	if n := gatherRequests(t, "StackCreate", "") - durations; n != 1 {
+		t.Errorf("expected the duration of 1 StackCreate call, got %v", n)
+	}
+	for _, c := range []struct {
+		operation string
+		outcome   string
+		want      float64
+	}{
+		{"StackCreate", "success", 1},
+		{"StackGet", "success", 1},
+		{"StackGet", "not_found", 1},
+		{"StackGet", "auth_expired", 1},
+		{"StackDelete", "success", 0},
+	} {
+		if got := gatherRequests(t, c.operation, c.outcome); got != c.want {
+			t.Errorf("expected %v %s calls with outcome %s, got %v", c.want, c.operation, c.outcome, got)
+		}
+	}
+}
+
+func TestIsInvalid(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"bad request", gophercloud.ErrDefault400{}, true},
+		{"forbidden", &gophercloud.ErrDefault403{}, true},
+		{"quota exceeded", gophercloud.ErrUnexpectedResponseCode{Actual: 413}, true},
+		{"unauthorized", gophercloud.ErrDefault401{}, false},
+		{"conflict", gophercloud.ErrDefault409{}, false},
+		{"throttled", gophercloud.ErrUnexpectedResponseCode{Actual: 429}, false},
+		{"server error", gophercloud.ErrDefault500{}, false},
+		{"unavailable", gophercloud.ErrDefault503{}, false},
+		{"timeout", fmt.Errorf("net/http: request canceled"), false},
+	} {
+		if got := openstack.IsInvalid(c.err); got != c.want {
+			t.Errorf("%s: expected IsInvalid %v, got %v", c.name, c.want, got)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package openstack
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/gophercloud/gophercloud"
+	"github.com/gophercloud/gophercloud/openstack/orchestration/v1/stacks"
+)
+
+// stacks.CreateOpts, stacks.UpdateOpts and stacks.PreviewOpts always fetch the child templates
+// referenced by the template, from its URL or relative to the working
+// directory. The templates of a stack are rendered in memory, with the child
+// templates in TemplateOpts.Files, so these builders send them as they are.
+
+type inMemoryCreateOpts struct {
+	*stacks.CreateOpts
+}
+
+func (opts inMemoryCreateOpts) ToStackCreateMap() (map[string]interface{}, error) {
+	b, err := gophercloud.BuildRequestBody(opts.CreateOpts, "")
+	if err != nil {
+		return nil, err
+	}
+	if err := addTemplate(b, opts.TemplateOpts, opts.EnvironmentOpts, opts.Tags); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+type inMemoryUpdateOpts struct {
+	*stacks.UpdateOpts
+}
+
+func (opts inMemoryUpdateOpts) ToStackUpdateMap() (map[string]interface{}, error) {
+	if opts.TemplateOpts == nil {
+		return nil, stacks.ErrTemplateRequired{}
+	}
+	b, err := gophercloud.BuildRequestBody(opts.UpdateOpts, "")
+	if err != nil {
+		return nil, err
+	}
+	if err := addTemplate(b, opts.TemplateOpts, opts.EnvironmentOpts, opts.Tags); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+type inMemoryPreviewOpts struct {
+	*stacks.PreviewOpts
+}
+
+func (opts inMemoryPreviewOpts) ToStackPreviewMap() (map[string]interface{}, error) {
+	b, err := gophercloud.BuildRequestBody(opts.PreviewOpts, "")
+	if err != nil {
+		return nil, err
+	}
+	if err := addTemplate(b, opts.TemplateOpts, opts.EnvironmentOpts, nil); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func addTemplate(b map[string]interface{}, template *stacks.Template, env *stacks.Environment, tags []string) error {
+	if template == nil || len(template.Bin) == 0 {
+		return stacks.ErrTemplateRequired{}
+	}
+	if env != nil {
+		return errors.New("stack environments are not supported")
+	}
+
+	b["template"] = string(template.Bin)
+	if len(template.Files) > 0 {
+		files := make(map[string]string, len(template.Files))
+		for k, v := range template.Files {
+			files[k] = v
+		}
+		b["files"] = files
+	}
+	if tags != nil {
+		b["tags"] = strings.Join(tags, ",")
+	}
+	return nil
+}
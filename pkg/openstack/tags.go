@@ -0,0 +1,96 @@
+package openstack
+
+import (
+	"strings"
+
+	"github.com/gophercloud/gophercloud/openstack/orchestration/v1/stacks"
+)
+
+// prefixes of the tags recording the VirtualMachine owning a stack, heat tags
+// are plain strings without commas
+const (
+	ownerNamespaceTag = "mixapp-namespace="
+	ownerNameTag      = "mixapp-name="
+	ownerUIDTag       = "mixapp-uid="
+	ownerClusterTag   = "mixapp-cluster="
+)
+
+// StackOwner identifies the VirtualMachine owning a stack
+type StackOwner struct {
+	Namespace string
+	Name      string
+	UID       string
+	// Cluster is the id of the cluster of the VirtualMachine, empty when the
+	// operator isn't given one
+	Cluster string
+}
+
+// StackTags returns the tags of the stacks of owner, StackTag and the tags
+// recording owner
+func StackTags(owner StackOwner) []string {
+	tags := []string{
+		StackTag,
+		ownerNamespaceTag + owner.Namespace,
+		ownerNameTag + owner.Name,
+		ownerUIDTag + owner.UID,
+	}
+	if owner.Cluster != "" {
+		tags = append(tags, ownerClusterTag+owner.Cluster)
+	}
+	return tags
+}
+
+// MergeStackTags returns tags with the tags of StackTags(owner) in place of
+// the StackTag and owner tags it has, other tags are kept
+func MergeStackTags(tags []string, owner StackOwner) []string {
+	merged := make([]string, 0, len(tags)+5)
+	for _, tag := range tags {
+		if tag == StackTag || isOwnerTag(tag) {
+			continue
+		}
+		merged = append(merged, tag)
+	}
+	return append(merged, StackTags(owner)...)
+}
+
+// StackOwnerOf returns the owner recorded in tags, false if there is none as
+// for stacks tagged before owners were recorded
+func StackOwnerOf(tags []string) (StackOwner, bool) {
+	var owner StackOwner
+	for _, tag := range tags {
+		switch {
+		case strings.HasPrefix(tag, ownerNamespaceTag):
+			owner.Namespace = strings.TrimPrefix(tag, ownerNamespaceTag)
+		case strings.HasPrefix(tag, ownerNameTag):
+			owner.Name = strings.TrimPrefix(tag, ownerNameTag)
+		case strings.HasPrefix(tag, ownerUIDTag):
+			owner.UID = strings.TrimPrefix(tag, ownerUIDTag)
+		case strings.HasPrefix(tag, ownerClusterTag):
+			owner.Cluster = strings.TrimPrefix(tag, ownerClusterTag)
+		}
+	}
+	return owner, owner.UID != ""
+}
+
+func isOwnerTag(tag string) bool {
+	return strings.HasPrefix(tag, ownerNamespaceTag) || strings.HasPrefix(tag, ownerNameTag) ||
+		strings.HasPrefix(tag, ownerUIDTag) || strings.HasPrefix(tag, ownerClusterTag)
+}
+
+// ListedStackProjectID returns the project of a stack listed by StackListAll,
+// which heat only gives in the self link of the stack
+func ListedStackProjectID(stack *stacks.ListedStack) string {
+	for _, link := range stack.Links {
+		if link.Rel != "self" {
+			continue
+		}
+		// .../v1/<project>/stacks/<name>/<id>
+		parts := strings.Split(strings.TrimSuffix(link.Href, "/"), "/")
+		for i := len(parts) - 3; i > 0; i-- {
+			if parts[i] == "stacks" {
+				return parts[i-1]
+			}
+		}
+	}
+	return ""
+}
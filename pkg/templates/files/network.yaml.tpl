@@ -33,6 +33,7 @@ parameters:
   neutron_az:
     type: comma_delimited_list
     description: neutron availability zone
+    default: ""
 
 resources:
 
@@ -47,8 +48,7 @@ resources:
     type: OS::Neutron::Subnet
     properties:
       cidr: {get_param: private_network_cidr}
-      network: {get_resource: private_network}
-      dns_nameservers: {get_param: dns_nameserver}
+      network: {get_resource: fixed_network}
 {% endif %}
 
 {% if floating_ip == "enable" %}
@@ -63,7 +63,7 @@ resources:
     properties:
       router_id: {get_resource: extrouter}
     {% if existing_subnet %}
-      subnet: {get_resource: existing_subnet}
+      subnet: {get_param: existing_subnet}
     {% else %}
       subnet: {get_resource: fixed_subnet}
     {% endif %}
@@ -7,81 +7,78 @@ parameters:
 
   name:
     type: string
-    description:
+    description: name of the server
 
   image:
     type: string
-    description:
+    description: image of the boot volume
 
   flavor:
     type: string
-    description:
+    description: flavor of the server
 
   availability_zone:
     type: string
-    description:
-    default: nova
+    description: nova availability zone of the server
+    default: ""
 
   key_name:
     type: string
-    description:
-    default: default
+    description: ssh key pair of the server
+    default: ""
 
   admin_pass:
     type: string
-    description:
+    description: admin password of the server
+    hidden: true
+    default: ""
 
   boot_volume_type:
     type: string
-    description:
+    description: volume type of the boot volume
+    default: ""
 
   boot_volume_size:
     type: string
-    description:
+    description: size in GB of the boot volume
 
   security_group:
     type: string
-    description:
+    description: security group of the server
+    default: ""
 
   fixed_network:
     type: string
-    description:
+    description: network of the server
 
   fixed_subnet:
     type: string
-    description:
-
-  neutron_az:
-    type: string
-    description:
-    default: []
+    description: subnet of the server
 
 {% if floating_ip == "enable" %}
   external_network:
     type: string
-    description:
-    default: public
+    description: network of the floating ip
 
   floating_ip_bandwidth:
     type: string
-    description:
+    description: bandwidth limit in kbps of the floating ip
 {% endif %}
 
-{% if volume %}
 {% for v in volume %}
   volume_{{ forloop.Counter }}_name:
     type: string
-    description:
+    description: name of data volume {{ forloop.Counter }}
 
   volume_{{ forloop.Counter }}_type:
     type: string
-    description:
+    description: volume type of data volume {{ forloop.Counter }}
+    default: ""
 
   volume_{{ forloop.Counter }}_size:
     type: string
-    description:
+    description: size in GB of data volume {{ forloop.Counter }}
 {% endfor %}
-{% endif %}
 
 resources:
 
@@ -96,7 +93,7 @@ resources:
     properties:
       group: ungrouped
       config: |
-        {{ softwareConfig }}
+        {{ softwareConfig|indent:8 }}
 
   node_bootstrap:
     type: OS::Heat::MultipartMime
@@ -110,36 +107,45 @@ resources:
     properties:
       image: {get_param: image}
       size: {get_param: boot_volume_size}
+    {% if boot_volume_type %}
       volume_type: {get_param: boot_volume_type}
+    {% endif %}
 
   mixapp_node:
     type: OS::Nova::Server
     properties:
       name: {get_param: name}
-      flavor: {get_param: minion_flavor}
-      key_name: {get_param: ssh_key_name}
+      flavor: {get_param: flavor}
+    {% if key_name %}
+      key_name: {get_param: key_name}
+    {% endif %}
+    {% if admin_pass %}
       admin_pass: {get_param: admin_pass}
-      user_data_format: RAW
-      user_data: {get_resource: kube_minion_init}
-      networks:
-        - port: {get_resource: kube_minion_eth0}
-      scheduler_hints: { group: { get_param: nodes_server_group_id }}
+    {% endif %}
+    {% if availability_zone %}
       availability_zone: {get_param: availability_zone}
+    {% endif %}
+    {% if softwareConfig %}
+      user_data_format: SOFTWARE_CONFIG
+      user_data: {get_resource: node_bootstrap}
+    {% endif %}
+      networks:
+        - port: {get_resource: node_eth0}
       block_device_mapping_v2:
         - boot_index: 0
-          volume_id: {get_resource: kube_node_volume}
+          volume_id: {get_resource: node_boot_volume}
           delete_on_termination: true
 
   node_eth0:
     type: OS::Neutron::Port
     properties:
       network: {get_param: fixed_network}
+    {% if security_group %}
       security_groups:
         - get_param: security_group
+    {% endif %}
       fixed_ips:
         - subnet: {get_param: fixed_subnet}
-      allowed_address_pairs:
-        - ip_address: {get_param: pods_network_cidr}
       replacement_policy: AUTO
 
   ######################################################################
@@ -171,20 +177,63 @@ resources:
   # data volumes
   #
 
-  {% if volume %}
   {% for v in volume %}
   data_volume_{{ forloop.Counter }}:
     type: OS::Cinder::Volume
     properties:
       name: {get_param: volume_{{ forloop.Counter }}_name}
       size: {get_param: volume_{{ forloop.Counter }}_size}
+    {% if v.type %}
       volume_type: {get_param: volume_{{ forloop.Counter }}_type}
+    {% endif %}
 
   data_volume_attach_{{ forloop.Counter }}:
     type: OS::Cinder::VolumeAttachment
     properties:
       instance_uuid: {get_resource: mixapp_node}
       volume_id: {get_resource: data_volume_{{ forloop.Counter }}}
-      mountpoint: /dev/vd{{ loop.cycle('b','c','d','e','f','h','i','j','k','l','m','n','o','p','q','r','s','t','u','v','w','x','y','z') }}
+      mountpoint: /dev/vd{% cycle 'b' 'c' 'd' 'e' 'f' 'g' 'h' 'i' 'j' 'k' 'l' 'm' 'n' 'o' 'p' 'q' 'r' 's' 't' 'u' 'v' 'w' 'x' 'y' 'z' %}
   {% endfor %}
-  {% endif %}
\ No newline at end of file
+
+outputs:
+
+  server_id:
+    value: {get_resource: mixapp_node}
+    description: >
+      This is the id of the server.
+
+  name:
+    value: {get_attr: [mixapp_node, name]}
+    description: >
+      This is the name of the server.
+
+  fixed_ip:
+    value: {get_attr: [node_eth0, fixed_ips, 0, ip_address]}
+    description: >
+      This is the fixed ip of the server.
+
+  floating_ip:
+{% if floating_ip == "enable" %}
+    value: {get_attr: [node_floating, floating_ip_address]}
+{% else %}
+    value: ""
+{% endif %}
+    description: >
+      This is the floating ip of the server.
+
+  boot_volume_id:
+    value: {get_resource: node_boot_volume}
+    description: >
+      This is the id of the boot volume of the server.
+
+  data_volume_ids:
+{% if volume %}
+    value:
+{% for v in volume %}
+      - {get_resource: data_volume_{{ forloop.Counter }}}
+{% endfor %}
+{% else %}
+    value: []
+{% endif %}
+    description: >
+      This is the list of data volume ids attached to the server.
\ No newline at end of file
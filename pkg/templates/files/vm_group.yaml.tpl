@@ -6,102 +6,110 @@ description: >
 
 parameters:
 
+  # every field of the VirtualMachine spec is passed as a parameter, so all of
+  # them are declared whether the templates use them or not
+
   replicas:
     type: number
-    description:
+    description: number of servers
     default: 1
 
   name_prefix:
     type: string
-    description:
+    description: prefix of the server names
 
   image:
     type: string
-    description:
+    description: image of the boot volumes
 
   flavor:
     type: string
-    description:
+    description: flavor of the servers
 
   availability_zone:
     type: string
-    description:
-    default: nova
+    description: nova availability zone of the servers
+    default: ""
 
   key_name:
     type: string
-    description:
-    default: default
+    description: ssh key pair of the servers
+    default: ""
 
   admin_pass:
     type: string
-    description:
+    description: admin password of the servers
+    hidden: true
+    default: ""
 
   boot_volume_type:
     type: string
-    description:
+    description: volume type of the boot volumes
+    default: ""
 
   boot_volume_size:
     type: string
-    description:
+    description: size in GB of the boot volumes
 
   security_group:
     type: string
-    description:
+    description: security group of the servers
+    default: ""
 
-{% if existing_subnet %}
   existing_network:
     type: string
-    description
+    description: network of the servers when existing_subnet is set
+    default: ""
 
   existing_subnet:
     type: string
-    description:
-{% else %}
+    description: subnet of the servers, a private network is created when it's empty
+    default: ""
+
   private_network_cidr:
     type: string
-    description:
+    description: cidr of the private network
+    default: ""
 
   private_network_name:
     type: string
-    description:
-{% endif %}
+    description: name of the private network
+    default: ""
 
   neutron_az:
-    type: string
-    description:
-    default: []
+    type: comma_delimited_list
+    description: neutron availability zones of the private network
+    default: ""
 
-{% if floating_ip == "enable" %}
   external_network:
     type: string
-    description:
-    default: public
+    description: network of the floating ips
+    default: ""
 
   floating_ip:
     type: string
-    description:
+    description: floating ips are allocated when it's "enable"
+    default: ""
 
   floating_ip_bandwidth:
     type: string
-    description:
-{% endif %}
+    description: bandwidth limit in kbps of the floating ips
+    default: ""
 
-{% if volume %}
 {% for v in volume %}
-  volume_{{ forloop.counter }}_name:
+  volume_{{ forloop.Counter }}_name:
     type: string
-    description:
+    description: name of data volume {{ forloop.Counter }}
 
-  volume_{{ forloop.counter }}_type:
+  volume_{{ forloop.Counter }}_type:
     type: string
-    description:
+    description: volume type of data volume {{ forloop.Counter }}
+    default: ""
 
-  volume_{{ forloop.counter }}_size:
+  volume_{{ forloop.Counter }}_size:
     type: string
-    description:
+    description: size in GB of data volume {{ forloop.Counter }}
 {% endfor %}
-{% endif %}
 
 resources:
 
@@ -114,8 +122,8 @@ resources:
     type: network.yaml
     properties:
     {% if existing_subnet %}
-      existing_network: {get_param: fixed_network}
-      existing_subnet: {get_param: fixed_subnet}
+      existing_network: {get_param: existing_network}
+      existing_subnet: {get_param: existing_subnet}
     {% else %}
       private_network_name: {get_param: private_network_name}
       private_network_cidr: {get_param: private_network_cidr}
@@ -124,7 +132,6 @@ resources:
       external_network: {get_param: external_network}
     {% endif %}
       neutron_az: {get_param: neutron_az}
-      private_network_name: ecns-private
 
 
   ######################################################################
@@ -151,7 +158,7 @@ resources:
           name:
             list_join:
               - '-'
-              - [{ get_param: namePrefix }, '%index%']
+              - [{ get_param: name_prefix }, '%index%']
           image: {get_param: image}
           flavor: {get_param: flavor}
           availability_zone: {get_param: availability_zone}
@@ -161,18 +168,16 @@ resources:
           boot_volume_size: {get_param: boot_volume_size}
           security_group: {get_param: security_group}
           fixed_network: {get_attr: [network, fixed_network]}
-          fixed_subnet: {get_attr: [network, fixed_network]}
+          fixed_subnet: {get_attr: [network, fixed_subnet]}
         {% if floating_ip == "enable" %}
           external_network: {get_param: external_network}
           floating_ip_bandwidth: {get_param: floating_ip_bandwidth}
         {% endif %}
-        {% if volume %}
         {% for v in volume %}
           volume_{{ forloop.Counter }}_name: {get_param: volume_{{ forloop.Counter }}_name}
           volume_{{ forloop.Counter }}_type: {get_param: volume_{{ forloop.Counter }}_type}
           volume_{{ forloop.Counter }}_size: {get_param: volume_{{ forloop.Counter }}_size}
         {% endfor %}
-        {% endif %}
 
 outputs:
 
@@ -186,5 +191,35 @@ outputs:
     description: >
       This is the network of this kube cluster used.
 
+  server_ids:
+    value: {get_attr: [mixapp_nodes, server_id]}
+    description: >
+      This is the list of server ids, ordered by group index.
+
+  server_names:
+    value: {get_attr: [mixapp_nodes, name]}
+    description: >
+      This is the list of server names, ordered by group index.
+
+  server_fixed_ips:
+    value: {get_attr: [mixapp_nodes, fixed_ip]}
+    description: >
+      This is the list of server fixed ips, ordered by group index.
+
+  server_floating_ips:
+    value: {get_attr: [mixapp_nodes, floating_ip]}
+    description: >
+      This is the list of server floating ips, ordered by group index.
+
+  server_boot_volume_ids:
+    value: {get_attr: [mixapp_nodes, boot_volume_id]}
+    description: >
+      This is the list of server boot volume ids, ordered by group index.
+
+  server_data_volume_ids:
+    value: {get_attr: [mixapp_nodes, data_volume_ids]}
+    description: >
+      This is the list of data volume id lists of servers, ordered by group index.
+
 
 
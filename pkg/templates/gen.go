@@ -0,0 +1,68 @@
+//go:build ignore
+// +build ignore
+
+// gen compiles the templates of files/ into zz_generated.templates.go, run it
+// with go generate after changing them.
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	srcDir    = "files"
+	output    = "zz_generated.templates.go"
+	tplSuffix = ".tpl"
+)
+
+func main() {
+	files, err := ioutil.ReadDir(srcDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var names []string
+	for _, f := range files {
+		if !f.IsDir() && strings.HasSuffix(f.Name(), tplSuffix) {
+			names = append(names, f.Name())
+		}
+	}
+	sort.Strings(names)
+
+	boilerplate, err := ioutil.ReadFile(filepath.Join("..", "..", "hack", "boilerplate.go.txt"))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	buf.Write(boilerplate)
+	buf.WriteString("\n\n// Code generated by gen.go. DO NOT EDIT.\n\n")
+	buf.WriteString("package templates\n\n")
+	buf.WriteString("// defaultTemplates are the templates of files/ compiled into the binary\n")
+	buf.WriteString("var defaultTemplates = map[string]string{\n")
+	for _, name := range names {
+		content, err := ioutil.ReadFile(filepath.Join(srcDir, name))
+		if err != nil {
+			log.Fatal(err)
+		}
+		if bytes.ContainsRune(content, '`') {
+			log.Fatalf("%s: templates can't contain backquotes", name)
+		}
+		fmt.Fprintf(&buf, "\t%q: `%s`,\n", name, content)
+	}
+	buf.WriteString("}\n")
+
+	src, err := format.Source(buf.Bytes())
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := ioutil.WriteFile(output, src, 0644); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,315 @@
+package templates
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// pseudoParameters are the parameters heat declares in every template
+var pseudoParameters = map[string]bool{
+	"OS::stack_name": true,
+	"OS::stack_id":   true,
+	"OS::project_id": true,
+}
+
+// LintError is a part of a rendered template heat would reject
+type LintError struct {
+	Template string
+	Path     string
+	Message  string
+}
+
+func (e LintError) Error() string {
+	if e.Path == "" {
+		return fmt.Sprintf("%s: %s", e.Template, e.Message)
+	}
+	return fmt.Sprintf("%s: %s: %s", e.Template, e.Path, e.Message)
+}
+
+// LintErrors are all the errors found by Lint
+type LintErrors []LintError
+
+func (e LintErrors) Error() string {
+	msgs := make([]string, 0, len(e))
+	for _, err := range e {
+		msgs = append(msgs, err.Error())
+	}
+	return strings.Join(msgs, "; ")
+}
+
+type heatTemplate struct {
+	name string
+	// parameters tells whether each declared parameter has a default
+	parameters map[string]bool
+	resources  map[string]interface{}
+	outputs    map[string]interface{}
+}
+
+// Lint parses the rendered templates and checks their get_param, get_resource
+// and get_attr references against the parameters and resources they declare,
+// the properties of resources of child templates against the parameters of
+// the child, and params, the parameters of the stack if not nil, against the
+// parameters of the root template.
+func Lint(rendered map[string]string, params map[string]interface{}) error {
+	names := make([]string, 0, len(rendered))
+	for name := range rendered {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var errs LintErrors
+	if _, ok := rendered[RootTemplate]; !ok {
+		errs = append(errs, LintError{Template: RootTemplate, Message: "root template not found"})
+	}
+	templates := make(map[string]*heatTemplate, len(rendered))
+	for _, name := range names {
+		// a template which can't be parsed is kept as nil, it's only reported once
+		tpl, err := parseTemplate(name, rendered[name])
+		if err != nil {
+			errs = append(errs, *err)
+		}
+		templates[name] = tpl
+	}
+
+	for _, name := range names {
+		if tpl := templates[name]; tpl != nil {
+			errs = append(errs, tpl.lint(templates)...)
+		}
+	}
+	if root := templates[RootTemplate]; root != nil && params != nil {
+		errs = append(errs, checkProperties(root, params, RootTemplate, "parameters")...)
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func parseTemplate(name string, content string) (*heatTemplate, *LintError) {
+	var raw map[string]interface{}
+	if err := yaml.Unmarshal([]byte(content), &raw); err != nil {
+		return nil, &LintError{Template: name, Message: fmt.Sprintf("invalid yaml: %v", err)}
+	}
+	if _, ok := raw["heat_template_version"]; !ok {
+		return nil, &LintError{Template: name, Path: "heat_template_version", Message: "not set"}
+	}
+
+	tpl := &heatTemplate{
+		name:       name,
+		parameters: make(map[string]bool),
+		resources:  make(map[string]interface{}),
+	}
+	params, ok := toStringMap(raw["parameters"])
+	if !ok {
+		return nil, &LintError{Template: name, Path: "parameters", Message: "not a map"}
+	}
+	for p, decl := range params {
+		declMap, _ := toStringMap(decl)
+		_, hasDefault := declMap["default"]
+		tpl.parameters[p] = hasDefault
+	}
+	resources, ok := toStringMap(raw["resources"])
+	if !ok {
+		return nil, &LintError{Template: name, Path: "resources", Message: "not a map"}
+	}
+	for r, def := range resources {
+		defMap, ok := toStringMap(def)
+		if !ok || defMap == nil {
+			return nil, &LintError{Template: name, Path: "resources." + r, Message: "not a map"}
+		}
+		tpl.resources[r] = defMap
+	}
+	outputs, ok := toStringMap(raw["outputs"])
+	if !ok {
+		return nil, &LintError{Template: name, Path: "outputs", Message: "not a map"}
+	}
+	tpl.outputs = outputs
+	return tpl, nil
+}
+
+func (t *heatTemplate) lint(templates map[string]*heatTemplate) []LintError {
+	var errs []LintError
+	for _, r := range sortedKeys(t.resources) {
+		def, _ := toStringMap(t.resources[r])
+		path := "resources." + r
+		errs = append(errs, t.checkRefs(def["properties"], path+".properties")...)
+		errs = append(errs, t.checkDependsOn(def["depends_on"], path+".depends_on")...)
+
+		resType, _ := def["type"].(string)
+		if resType == "" {
+			errs = append(errs, LintError{Template: t.name, Path: path + ".type", Message: "not set"})
+			continue
+		}
+		errs = append(errs, t.checkChild(resType, def["properties"], templates, path)...)
+		if resType == "OS::Heat::ResourceGroup" {
+			props, _ := toStringMap(def["properties"])
+			resDef, _ := toStringMap(props["resource_def"])
+			if defType, ok := resDef["type"].(string); ok {
+				errs = append(errs, t.checkChild(defType, resDef["properties"], templates, path+".properties.resource_def")...)
+			}
+		}
+	}
+	errs = append(errs, t.checkRefs(t.outputs, "outputs")...)
+	return errs
+}
+
+// checkRefs walks value for references to undeclared parameters and resources
+func (t *heatTemplate) checkRefs(value interface{}, path string) []LintError {
+	var errs []LintError
+	switch v := value.(type) {
+	case map[string]interface{}, map[interface{}]interface{}:
+		m, _ := toStringMap(v)
+		if len(m) == 1 {
+			for fn, arg := range m {
+				if err := t.checkIntrinsic(fn, arg, path); err != nil {
+					errs = append(errs, *err)
+				}
+			}
+		}
+		for _, k := range sortedKeys(m) {
+			errs = append(errs, t.checkRefs(m[k], path+"."+k)...)
+		}
+	case []interface{}:
+		for i := range v {
+			errs = append(errs, t.checkRefs(v[i], fmt.Sprintf("%s[%d]", path, i))...)
+		}
+	}
+	return errs
+}
+
+func (t *heatTemplate) checkIntrinsic(fn string, arg interface{}, path string) *LintError {
+	var name string
+	switch fn {
+	case "get_param":
+		name = firstString(arg)
+		if name == "" || pseudoParameters[name] {
+			return nil
+		}
+		if _, ok := t.parameters[name]; !ok {
+			return &LintError{Template: t.name, Path: path, Message: fmt.Sprintf("get_param of undeclared parameter %s", name)}
+		}
+	case "get_resource", "get_attr":
+		name = firstString(arg)
+		if name == "" {
+			return &LintError{Template: t.name, Path: path, Message: fmt.Sprintf("%s without resource name", fn)}
+		}
+		if _, ok := t.resources[name]; !ok {
+			return &LintError{Template: t.name, Path: path, Message: fmt.Sprintf("%s of undeclared resource %s", fn, name)}
+		}
+	}
+	return nil
+}
+
+func (t *heatTemplate) checkDependsOn(value interface{}, path string) []LintError {
+	var deps []string
+	switch v := value.(type) {
+	case string:
+		deps = []string{v}
+	case []interface{}:
+		for _, d := range v {
+			if s, ok := d.(string); ok {
+				deps = append(deps, s)
+			}
+		}
+	}
+
+	var errs []LintError
+	for _, d := range deps {
+		if _, ok := t.resources[d]; !ok {
+			errs = append(errs, LintError{Template: t.name, Path: path, Message: fmt.Sprintf("depends on undeclared resource %s", d)})
+		}
+	}
+	return errs
+}
+
+// checkChild checks the properties of a resource of a child template type
+func (t *heatTemplate) checkChild(resType string, props interface{}, templates map[string]*heatTemplate, path string) []LintError {
+	if !strings.HasSuffix(resType, ".yaml") && !strings.HasSuffix(resType, ".template") {
+		return nil
+	}
+	child, ok := templates[resType]
+	if !ok {
+		return []LintError{{Template: t.name, Path: path + ".type", Message: fmt.Sprintf("child template %s not found", resType)}}
+	}
+	if child == nil {
+		return nil
+	}
+	propMap, _ := toStringMap(props)
+	return checkProperties(child, propMap, t.name, path+".properties")
+}
+
+// checkProperties checks the values passed to the parameters of tpl by the
+// template from
+func checkProperties(tpl *heatTemplate, values map[string]interface{}, from string, path string) []LintError {
+	var errs []LintError
+	for _, name := range sortedKeys(values) {
+		if _, ok := tpl.parameters[name]; !ok {
+			errs = append(errs, LintError{Template: from, Path: path + "." + name, Message: fmt.Sprintf("parameter not declared by %s", tpl.name)})
+		}
+	}
+	required := make([]string, 0, len(tpl.parameters))
+	for name, hasDefault := range tpl.parameters {
+		if !hasDefault {
+			required = append(required, name)
+		}
+	}
+	sort.Strings(required)
+	for _, name := range required {
+		if _, ok := values[name]; !ok {
+			errs = append(errs, LintError{Template: from, Path: path, Message: fmt.Sprintf("parameter %s of %s without default not set", name, tpl.name)})
+		}
+	}
+	return errs
+}
+
+func firstString(arg interface{}) string {
+	switch v := arg.(type) {
+	case string:
+		return v
+	case []interface{}:
+		if len(v) > 0 {
+			s, _ := v[0].(string)
+			return s
+		}
+	}
+	return ""
+}
+
+// toStringMap converts a yaml map, a nil value is an empty map
+func toStringMap(value interface{}) (map[string]interface{}, bool) {
+	switch v := value.(type) {
+	case nil:
+		return map[string]interface{}{}, true
+	case map[string]interface{}:
+		return v, true
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, val := range v {
+			m[fmt.Sprintf("%v", k)] = val
+		}
+		return m, true
+	}
+	return nil, false
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Lint renders the templates of the set with params and lints them
+func (s *Set) Lint(params *Parameters) error {
+	rendered, err := New(s, params.Context).Render()
+	if err != nil {
+		return err
+	}
+	return Lint(rendered, params.Heat)
+}
@@ -0,0 +1,214 @@
+package templates
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	vmv1 "easystack.io/vm-operator/pkg/api/v1"
+)
+
+// lintSpecs covers the branches of the templates
+func lintSpecs() map[string]*vmv1.VirtualMachineSpec {
+	specs := make(map[string]*vmv1.VirtualMachineSpec)
+	for _, existing := range []bool{false, true} {
+		for _, floating := range []bool{false, true} {
+			for _, volumes := range []int{0, 2} {
+				for _, config := range []bool{false, true} {
+					spec := &vmv1.VirtualMachineSpec{
+						Server: vmv1.ServerSpec{
+							Replicas:       2,
+							NamePrefix:     "app",
+							Image:          "image",
+							Flavor:         "flavor",
+							BootVolumeSize: "20",
+						},
+					}
+					if existing {
+						spec.Network.ExistingNetwork = "net"
+						spec.Network.ExistingSubnet = "subnet"
+					} else {
+						spec.Network.PrivateNetworkCidr = "192.168.0.0/24"
+					}
+					if floating {
+						spec.Network.FloatingIp = vmv1.FloatingIpEnable
+						spec.Network.ExternalNetwork = "public"
+						spec.Network.FloatingIpBandwidth = "1024"
+					}
+					for i := 0; i < volumes; i++ {
+						spec.Volume = append(spec.Volume, vmv1.VolumeSpec{VolumeName: fmt.Sprintf("data-%d", i), VolumeSize: "10"})
+					}
+					if config {
+						spec.SoftwareConfig = []byte("#!/bin/sh\necho hello")
+					}
+					name := fmt.Sprintf("existing=%v,floating=%v,volumes=%d,config=%v", existing, floating, volumes, config)
+					specs[name] = spec
+				}
+			}
+		}
+	}
+	return specs
+}
+
+func lintSet(t *testing.T, set *Set) {
+	for name, spec := range lintSpecs() {
+		t.Run(name, func(t *testing.T) {
+			params, err := BuildParameters(spec)
+			if err != nil {
+				t.Fatalf("BuildParameters failed: %v", err)
+			}
+			if err := set.Lint(params); err != nil {
+				for _, e := range err.(LintErrors) {
+					t.Error(e)
+				}
+			}
+		})
+	}
+}
+
+func TestLintEmbeddedTemplates(t *testing.T) {
+	set, err := Load("")
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	lintSet(t, set)
+}
+
+const lintRoot = `heat_template_version: 2016-10-14
+parameters:
+  name: {type: string}
+  size: {type: number, default: 1}
+resources:
+  server:
+    type: OS::Nova::Server
+    properties:
+      name: {get_param: name}
+outputs:
+  id:
+    value: {get_resource: server}
+`
+
+func TestLint(t *testing.T) {
+	child := `heat_template_version: 2016-10-14
+parameters:
+  name: {type: string}
+  zone: {type: string, default: ""}
+resources: {}
+`
+	tests := []struct {
+		name      string
+		rendered  map[string]string
+		params    map[string]interface{}
+		wantError []string
+	}{
+		{
+			name:     "valid",
+			rendered: map[string]string{RootTemplate: lintRoot},
+			params:   map[string]interface{}{"name": "vm"},
+		},
+		{
+			name:     "pseudo parameter",
+			rendered: map[string]string{RootTemplate: strings.Replace(lintRoot, "{get_param: name}", "{get_param: OS::stack_name}", 1)},
+		},
+		{
+			name:      "root template not found",
+			rendered:  map[string]string{"vm.yaml": child},
+			wantError: []string{"vm_group.yaml: root template not found"},
+		},
+		{
+			name:      "invalid yaml",
+			rendered:  map[string]string{RootTemplate: "heat_template_version: [\n"},
+			wantError: []string{"vm_group.yaml: invalid yaml"},
+		},
+		{
+			name:      "version not set",
+			rendered:  map[string]string{RootTemplate: strings.Replace(lintRoot, "heat_template_version", "version", 1)},
+			wantError: []string{"vm_group.yaml: heat_template_version: not set"},
+		},
+		{
+			name:      "undeclared parameter",
+			rendered:  map[string]string{RootTemplate: strings.Replace(lintRoot, "{get_param: name}", "{get_param: [names, 0]}", 1)},
+			wantError: []string{"vm_group.yaml: resources.server.properties.name: get_param of undeclared parameter names"},
+		},
+		{
+			name:      "undeclared resource",
+			rendered:  map[string]string{RootTemplate: strings.Replace(lintRoot, "{get_resource: server}", "{get_attr: [servers, name]}", 1)},
+			wantError: []string{"vm_group.yaml: outputs.id.value: get_attr of undeclared resource servers"},
+		},
+		{
+			name:      "undeclared dependency",
+			rendered:  map[string]string{RootTemplate: strings.Replace(lintRoot, "    type: OS::Nova::Server\n", "    type: OS::Nova::Server\n    depends_on: network\n", 1)},
+			wantError: []string{"vm_group.yaml: resources.server.depends_on: depends on undeclared resource network"},
+		},
+		{
+			name:      "child template not found",
+			rendered:  map[string]string{RootTemplate: strings.Replace(lintRoot, "OS::Nova::Server", "vm.yaml", 1)},
+			wantError: []string{"vm_group.yaml: resources.server.type: child template vm.yaml not found"},
+		},
+		{
+			name: "child template",
+			rendered: map[string]string{
+				RootTemplate: strings.Replace(lintRoot, "OS::Nova::Server", "vm.yaml", 1),
+				"vm.yaml":    child,
+			},
+		},
+		{
+			name: "property not declared by child template",
+			rendered: map[string]string{
+				RootTemplate: strings.NewReplacer("OS::Nova::Server", "vm.yaml", "name: {get_param: name}", "hostname: {get_param: name}").Replace(lintRoot),
+				"vm.yaml":    child,
+			},
+			wantError: []string{
+				"vm_group.yaml: resources.server.properties.hostname: parameter not declared by vm.yaml",
+				"vm_group.yaml: resources.server.properties: parameter name of vm.yaml without default not set",
+			},
+		},
+		{
+			name: "resource group of child template",
+			rendered: map[string]string{
+				RootTemplate: strings.Replace(lintRoot, "    type: OS::Nova::Server\n    properties:\n      name: {get_param: name}\n",
+					"    type: OS::Heat::ResourceGroup\n    properties:\n      resource_def:\n        type: vm.yaml\n        properties: {zone: a}\n", 1),
+				"vm.yaml": child,
+			},
+			wantError: []string{"vm_group.yaml: resources.server.properties.resource_def.properties: parameter name of vm.yaml without default not set"},
+		},
+		{
+			name:     "parameter not declared by root template",
+			rendered: map[string]string{RootTemplate: lintRoot},
+			params:   map[string]interface{}{"name": "vm", "image": "cirros"},
+			wantError: []string{
+				"vm_group.yaml: parameters.image: parameter not declared by vm_group.yaml",
+			},
+		},
+		{
+			name:      "required parameter of root template not set",
+			rendered:  map[string]string{RootTemplate: lintRoot},
+			params:    map[string]interface{}{"size": 2},
+			wantError: []string{"vm_group.yaml: parameters: parameter name of vm_group.yaml without default not set"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Lint(tt.rendered, tt.params)
+			if len(tt.wantError) == 0 {
+				if err != nil {
+					t.Fatalf("expected no error, got %v", err)
+				}
+				return
+			}
+			errs, ok := err.(LintErrors)
+			if !ok {
+				t.Fatalf("expected LintErrors, got %v", err)
+			}
+			if len(errs) != len(tt.wantError) {
+				t.Fatalf("expected %d errors, got %v", len(tt.wantError), errs)
+			}
+			for i, want := range tt.wantError {
+				if !strings.HasPrefix(errs[i].Error(), want) {
+					t.Errorf("expected error %q, got %q", want, errs[i].Error())
+				}
+			}
+		})
+	}
+}
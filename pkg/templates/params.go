@@ -0,0 +1,186 @@
+package templates
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/flosch/pongo2"
+)
+
+// Parameters are the parameters of a stack built from a spec by BuildParameters
+type Parameters struct {
+	// Heat are the parameters sent to heat
+	Heat map[string]interface{}
+	// Context renders the templates, it holds the parameters sent to heat and
+	// the values only used while rendering, like the volume list
+	Context pongo2.Context
+}
+
+// BuildParameters maps the fields of spec, a struct or a pointer to one, by
+// their "heat" tag:
+//
+//	heat:"name"          the field is the parameter name
+//	heat:"name,context"  the field only renders the templates as name
+//	heat:",inline"       the fields of the struct are mapped at the same level
+//	heat:"name,list"     the slice of structs renders the templates as name, a
+//	                     list of maps, and the field f of its i-th element,
+//	                     counted from 1, is the parameter name_i_f
+//	heat:"-"             the field is not a parameter
+//
+// A field without tag or of an unsupported type is an error, new spec fields
+// must be mapped explicitly.
+func BuildParameters(spec interface{}) (*Parameters, error) {
+	v := reflect.ValueOf(spec)
+	if v.Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("can't build parameters from %s", v.Type())
+	}
+
+	p := &Parameters{
+		Heat:    make(map[string]interface{}),
+		Context: make(pongo2.Context),
+	}
+	if err := p.addStruct(v); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+type heatTag struct {
+	name    string
+	inline  bool
+	list    bool
+	context bool
+}
+
+func parseHeatTag(field reflect.StructField) (heatTag, bool, error) {
+	tag, ok := field.Tag.Lookup("heat")
+	if !ok {
+		return heatTag{}, false, fmt.Errorf("field %s has no heat tag", field.Name)
+	}
+	if tag == "-" {
+		return heatTag{}, false, nil
+	}
+
+	parts := strings.Split(tag, ",")
+	t := heatTag{name: parts[0]}
+	for _, opt := range parts[1:] {
+		switch opt {
+		case "inline":
+			t.inline = true
+		case "list":
+			t.list = true
+		case "context":
+			t.context = true
+		default:
+			return heatTag{}, false, fmt.Errorf("field %s has unknown heat tag option %q", field.Name, opt)
+		}
+	}
+	if t.name == "" && !t.inline {
+		return heatTag{}, false, fmt.Errorf("field %s has no parameter name", field.Name)
+	}
+	return t, true, nil
+}
+
+func (p *Parameters) addStruct(v reflect.Value) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag, mapped, err := parseHeatTag(field)
+		if err != nil {
+			return fmt.Errorf("%s: %v", t.Name(), err)
+		}
+		if !mapped {
+			continue
+		}
+
+		fv := v.Field(i)
+		switch {
+		case tag.inline:
+			if fv.Kind() != reflect.Struct {
+				return fmt.Errorf("%s: inline field %s is not a struct", t.Name(), field.Name)
+			}
+			if err := p.addStruct(fv); err != nil {
+				return err
+			}
+		case tag.list:
+			if err := p.addList(tag.name, fv); err != nil {
+				return fmt.Errorf("%s: %v", t.Name(), err)
+			}
+		default:
+			value, err := scalar(fv)
+			if err != nil {
+				return fmt.Errorf("%s: field %s: %v", t.Name(), field.Name, err)
+			}
+			if err := p.add(tag.name, value, !tag.context); err != nil {
+				return fmt.Errorf("%s: %v", t.Name(), err)
+			}
+		}
+	}
+	return nil
+}
+
+func (p *Parameters) addList(name string, v reflect.Value) error {
+	if v.Kind() != reflect.Slice || v.Type().Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("list field %s is not a slice of structs", name)
+	}
+
+	list := make([]map[string]interface{}, 0, v.Len())
+	for i := 0; i < v.Len(); i++ {
+		elem := v.Index(i)
+		values := make(map[string]interface{})
+		for j := 0; j < elem.NumField(); j++ {
+			field := elem.Type().Field(j)
+			tag, mapped, err := parseHeatTag(field)
+			if err != nil {
+				return fmt.Errorf("%s: %v", elem.Type().Name(), err)
+			}
+			if !mapped {
+				continue
+			}
+			if tag.inline || tag.list || tag.context {
+				return fmt.Errorf("%s: field %s of a list element must be a plain parameter", elem.Type().Name(), field.Name)
+			}
+			value, err := scalar(elem.Field(j))
+			if err != nil {
+				return fmt.Errorf("%s: field %s: %v", elem.Type().Name(), field.Name, err)
+			}
+			values[tag.name] = value
+			if err := p.add(fmt.Sprintf("%s_%d_%s", name, i+1, tag.name), value, true); err != nil {
+				return err
+			}
+		}
+		list = append(list, values)
+	}
+	return p.add(name, list, false)
+}
+
+func (p *Parameters) add(name string, value interface{}, heat bool) error {
+	if _, ok := p.Context[name]; ok {
+		return fmt.Errorf("parameter %s is mapped twice", name)
+	}
+	p.Context[name] = value
+	if heat {
+		p.Heat[name] = value
+	}
+	return nil
+}
+
+// scalar returns the value of a parameter, bytes are passed as a string
+func scalar(v reflect.Value) (interface{}, error) {
+	switch v.Kind() {
+	case reflect.String, reflect.Bool,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return v.Interface(), nil
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return string(v.Bytes()), nil
+		}
+	}
+	return nil, fmt.Errorf("unsupported type %s", v.Type())
+}
@@ -0,0 +1,235 @@
+package templates
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	vmv1 "easystack.io/vm-operator/pkg/api/v1"
+)
+
+func TestBuildParameters(t *testing.T) {
+	spec := &vmv1.VirtualMachineSpec{
+		Project: vmv1.ProjectSpec{ProjectID: "project", Token: "token"},
+		Server: vmv1.ServerSpec{
+			Replicas:       3,
+			NamePrefix:     "app",
+			Image:          "image",
+			Flavor:         "flavor",
+			AvailableZone:  "az",
+			KeyName:        "key",
+			AdminPass:      "pass",
+			BootVolumeType: "ssd",
+			BootVolumeSize: "20",
+			SecurityGroup:  "sg",
+		},
+		Network: vmv1.NetworkSpec{
+			ExternalNetwork:     "public",
+			ExistingNetwork:     "net",
+			ExistingSubnet:      "subnet",
+			PrivateNetworkCidr:  "192.168.0.0/24",
+			PrivateNetworkName:  "private",
+			NeutronAz:           "neutron-az",
+			FloatingIp:          "enable",
+			FloatingIpBandwidth: "10",
+		},
+		Volume: []vmv1.VolumeSpec{
+			{VolumeName: "data", VolumeType: "hdd", VolumeSize: "100"},
+			{VolumeName: "log", VolumeType: "ssd", VolumeSize: "10"},
+		},
+		SoftwareConfig: []byte("#!/bin/sh"),
+		StackID:        "stack",
+		HeatEvent:      []string{"event"},
+		Template:       &vmv1.TemplateReference{Name: "template"},
+	}
+
+	p, err := BuildParameters(spec)
+	if err != nil {
+		t.Fatalf("BuildParameters failed: %v", err)
+	}
+
+	heat := map[string]interface{}{
+		"replicas":              int32(3),
+		"name_prefix":           "app",
+		"image":                 "image",
+		"flavor":                "flavor",
+		"availability_zone":     "az",
+		"key_name":              "key",
+		"admin_pass":            "pass",
+		"boot_volume_type":      "ssd",
+		"boot_volume_size":      "20",
+		"security_group":        "sg",
+		"external_network":      "public",
+		"existing_network":      "net",
+		"existing_subnet":       "subnet",
+		"private_network_cidr":  "192.168.0.0/24",
+		"private_network_name":  "private",
+		"neutron_az":            "neutron-az",
+		"floating_ip":           "enable",
+		"floating_ip_bandwidth": "10",
+		"volume_1_name":         "data",
+		"volume_1_type":         "hdd",
+		"volume_1_size":         "100",
+		"volume_2_name":         "log",
+		"volume_2_type":         "ssd",
+		"volume_2_size":         "10",
+	}
+	if !reflect.DeepEqual(p.Heat, heat) {
+		t.Errorf("expected heat parameters\n%v\ngot\n%v", heat, p.Heat)
+	}
+
+	context := map[string]interface{}{
+		"volume": []map[string]interface{}{
+			{"name": "data", "type": "hdd", "size": "100"},
+			{"name": "log", "type": "ssd", "size": "10"},
+		},
+		"softwareConfig": "#!/bin/sh",
+	}
+	for k, v := range heat {
+		context[k] = v
+	}
+	if !reflect.DeepEqual(map[string]interface{}(p.Context), context) {
+		t.Errorf("expected template context\n%v\ngot\n%v", context, p.Context)
+	}
+}
+
+func TestBuildParametersEmptySpec(t *testing.T) {
+	p, err := BuildParameters(vmv1.VirtualMachineSpec{})
+	if err != nil {
+		t.Fatalf("BuildParameters failed: %v", err)
+	}
+	if p.Heat["replicas"] != int32(0) || p.Heat["name_prefix"] != "" {
+		t.Errorf("expected zero values of the spec to be passed, got %v", p.Heat)
+	}
+	if volume, ok := p.Context["volume"].([]map[string]interface{}); !ok || len(volume) != 0 {
+		t.Errorf("expected an empty volume list, got %v", p.Context["volume"])
+	}
+	if _, ok := p.Heat["volume_1_name"]; ok {
+		t.Errorf("expected no volume parameters, got %v", p.Heat)
+	}
+}
+
+func TestBuildParametersRendersVolumes(t *testing.T) {
+	set, err := NewSet("test", "v1", map[string]string{
+		RootTemplate: "{% for v in volume %}{{ forloop.Counter }}:{{ v.name }} {% endfor %}{{ softwareConfig }}",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := BuildParameters(&vmv1.VirtualMachineSpec{
+		Volume:         []vmv1.VolumeSpec{{VolumeName: "data"}, {VolumeName: "log"}},
+		SoftwareConfig: []byte("config"),
+	})
+	if err != nil {
+		t.Fatalf("BuildParameters failed: %v", err)
+	}
+	rendered, err := New(set, p.Context).Render()
+	if err != nil {
+		t.Fatalf("Render failed: %v", err)
+	}
+	if rendered[RootTemplate] != "1:data 2:log config" {
+		t.Errorf("expected volumes and software config to be rendered, got %q", rendered[RootTemplate])
+	}
+}
+
+func TestBuildParametersErrors(t *testing.T) {
+	type element struct {
+		Name string `heat:"name"`
+	}
+	type nested struct {
+		Flavor string `heat:"flavor"`
+	}
+
+	cases := []struct {
+		name string
+		spec interface{}
+		err  string
+	}{
+		{
+			name: "not a struct",
+			spec: "spec",
+			err:  "can't build parameters",
+		},
+		{
+			name: "untagged field",
+			spec: &struct {
+				Image string `json:"image"`
+			}{},
+			err: "field Image has no heat tag",
+		},
+		{
+			name: "untagged field of list element",
+			spec: &struct {
+				Volume []struct{ Size string } `heat:"volume,list"`
+			}{Volume: []struct{ Size string }{{}}},
+			err: "field Size has no heat tag",
+		},
+		{
+			name: "unknown option",
+			spec: &struct {
+				Image string `heat:"image,secret"`
+			}{},
+			err: "unknown heat tag option",
+		},
+		{
+			name: "no name",
+			spec: &struct {
+				Image string `heat:",context"`
+			}{},
+			err: "has no parameter name",
+		},
+		{
+			name: "unsupported type",
+			spec: &struct {
+				Labels map[string]string `heat:"labels"`
+			}{},
+			err: "unsupported type",
+		},
+		{
+			name: "struct not inline",
+			spec: &struct {
+				Server nested `heat:"server"`
+			}{},
+			err: "unsupported type",
+		},
+		{
+			name: "inline not a struct",
+			spec: &struct {
+				Image string `heat:",inline"`
+			}{},
+			err: "is not a struct",
+		},
+		{
+			name: "list not of structs",
+			spec: &struct {
+				Names []string `heat:"names,list"`
+			}{},
+			err: "is not a slice of structs",
+		},
+		{
+			name: "mapped twice",
+			spec: &struct {
+				Flavor string `heat:"flavor"`
+				Server nested `heat:",inline"`
+			}{},
+			err: "parameter flavor is mapped twice",
+		},
+		{
+			name: "list parameter mapped twice",
+			spec: &struct {
+				Volume1Name string    `heat:"volume_1_name"`
+				Volume      []element `heat:"volume,list"`
+			}{Volume: []element{{Name: "data"}}},
+			err: "parameter volume_1_name is mapped twice",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := BuildParameters(c.spec)
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Errorf("expected error containing %q, got %v", c.err, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,87 @@
+package templates
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Redacted replaces the values of hidden parameters in a Preview
+const Redacted = "<redacted>"
+
+// Preview is what heat receives for a stack, for reviewing it before the stack
+// is created
+type Preview struct {
+	// Templates are the rendered templates keyed by name, the root template
+	// included
+	Templates map[string]string
+	// Parameters are the parameters of the stack, the values of the parameters
+	// the root template declares hidden are Redacted
+	Parameters map[string]interface{}
+	// Digest is the sha256 of the templates and the parameters, hidden values
+	// excluded, so it can't be used to guess them. It changes whenever heat
+	// would receive something else apart from hidden values.
+	Digest string
+}
+
+// NewPreview builds the Preview of the stack of the rendered templates and params
+func NewPreview(rendered map[string]string, params map[string]interface{}) (*Preview, error) {
+	names := make([]string, 0, len(rendered))
+	for name := range rendered {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	hidden, err := hiddenParameters(rendered[RootTemplate])
+	if err != nil {
+		return nil, err
+	}
+	preview := &Preview{
+		Templates:  make(map[string]string, len(rendered)),
+		Parameters: make(map[string]interface{}, len(params)),
+	}
+	for name, content := range rendered {
+		preview.Templates[name] = content
+	}
+	for k, v := range params {
+		if hidden[k] {
+			v = Redacted
+		}
+		preview.Parameters[k] = v
+	}
+
+	h := sha256.New()
+	for _, name := range names {
+		fmt.Fprintf(h, "%s\x00%s\x00", name, rendered[name])
+	}
+	// maps are marshaled with sorted keys
+	b, err := json.Marshal(preview.Parameters)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal parameters: %v", err)
+	}
+	h.Write(b)
+	preview.Digest = fmt.Sprintf("sha256:%x", h.Sum(nil))
+	return preview, nil
+}
+
+// hiddenParameters returns the parameters template declares hidden
+func hiddenParameters(template string) (map[string]bool, error) {
+	var parsed struct {
+		Parameters map[string]struct {
+			Hidden bool `yaml:"hidden"`
+		} `yaml:"parameters"`
+	}
+	if err := yaml.Unmarshal([]byte(template), &parsed); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", RootTemplate, err)
+	}
+	hidden := make(map[string]bool)
+	for name, p := range parsed.Parameters {
+		if p.Hidden {
+			hidden[name] = true
+		}
+	}
+	return hidden, nil
+}
@@ -0,0 +1,57 @@
+package templates
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNewPreview(t *testing.T) {
+	rendered := map[string]string{
+		RootTemplate: "heat_template_version: 2016-10-14\nparameters:\n  name: {type: string}\n  admin_pass: {type: string, hidden: true}\n",
+		"vm.yaml":    "heat_template_version: 2016-10-14\n",
+	}
+	params := map[string]interface{}{"name": "vm", "admin_pass": "secret"}
+
+	preview, err := NewPreview(rendered, params)
+	if err != nil {
+		t.Fatalf("NewPreview failed: %v", err)
+	}
+	if preview.Parameters["admin_pass"] != Redacted {
+		t.Errorf("expected hidden parameter to be redacted, got %v", preview.Parameters["admin_pass"])
+	}
+	if preview.Parameters["name"] != "vm" {
+		t.Errorf("expected name to be kept, got %v", preview.Parameters["name"])
+	}
+	if params["admin_pass"] != "secret" {
+		t.Error("expected params to be left unchanged")
+	}
+	if len(preview.Templates) != 2 {
+		t.Errorf("expected 2 templates, got %d", len(preview.Templates))
+	}
+	if !strings.HasPrefix(preview.Digest, "sha256:") {
+		t.Errorf("unexpected digest %s", preview.Digest)
+	}
+
+	again, err := NewPreview(rendered, map[string]interface{}{"admin_pass": "secret", "name": "vm"})
+	if err != nil {
+		t.Fatalf("NewPreview failed: %v", err)
+	}
+	if again.Digest != preview.Digest {
+		t.Errorf("expected the same digest, got %s and %s", preview.Digest, again.Digest)
+	}
+	// a hidden value is left out of the digest, which would tell it otherwise
+	changed, err := NewPreview(rendered, map[string]interface{}{"name": "vm", "admin_pass": "other"})
+	if err != nil {
+		t.Fatalf("NewPreview failed: %v", err)
+	}
+	if changed.Digest != preview.Digest {
+		t.Error("expected the digest not to depend on a hidden parameter")
+	}
+	changed, err = NewPreview(rendered, map[string]interface{}{"name": "other", "admin_pass": "secret"})
+	if err != nil {
+		t.Fatalf("NewPreview failed: %v", err)
+	}
+	if changed.Digest == preview.Digest {
+		t.Error("expected the digest to change with a parameter")
+	}
+}
@@ -1,70 +1,55 @@
 package templates
 
 import (
-	"fmt"
-	"github.com/flosch/pongo2"
-	"io/ioutil"
-	"os"
 	"strings"
+
+	"github.com/flosch/pongo2"
 )
 
+func init() {
+	pongo2.RegisterFilter("indent", filterIndent)
+}
+
+// filterIndent indents every line but the first of a multi-line value by
+// param spaces, so it can be put into a yaml block scalar. The value is
+// returned unescaped.
+func filterIndent(in *pongo2.Value, param *pongo2.Value) (*pongo2.Value, *pongo2.Error) {
+	pad := "\n" + strings.Repeat(" ", param.Integer())
+	return pongo2.AsSafeValue(strings.Replace(in.String(), "\n", pad, -1)), nil
+}
+
+// RootTemplate is the template the stack is created from, the other rendered
+// templates are its child templates
+const RootTemplate = "vm_group.yaml"
+
 type VmTemplate struct {
-	SrcTplDir string
-	DstTplDir string
+	Templates *Set
 	TplCtx    pongo2.Context
 }
 
-func New(srcTplDir string, dstTplDir string, tplCtx pongo2.Context) *VmTemplate {
+func New(templates *Set, tplCtx pongo2.Context) *VmTemplate {
 	return &VmTemplate{
-		SrcTplDir: srcTplDir,
-		DstTplDir: dstTplDir,
+		Templates: templates,
 		TplCtx:    tplCtx,
 	}
 }
 
-func (vt *VmTemplate) RenderToFile() error {
-	tf, err := vt.getRawTemplateFiles()
-	if err != nil {
-		fmt.Println("Fail to get vm django template files")
-		return err
-	}
-	for _, fName := range tf {
-		rawTpl := strings.Join([]string{vt.SrcTplDir, fName}, "/")
-		tpl, err := pongo2.FromFile(rawTpl)
+// Render renders every template of the set, the result is keyed by the name
+// templates refer to each other with
+func (vt *VmTemplate) Render() (map[string]string, error) {
+	rendered := make(map[string]string, len(vt.Templates.templates))
+	for fName, raw := range vt.Templates.templates {
+		tpl, err := pongo2.FromString(raw)
 		if err != nil {
-			return err
+			return nil, err
 		}
 
 		out, err := tpl.Execute(vt.TplCtx)
 		if err != nil {
-			return err
+			return nil, err
 		}
-
-		// write render result to template file
-		err = os.MkdirAll(vt.DstTplDir, 0755)
-		if err != nil {
-			fmt.Printf("mkdir failed: %s\n", vt.DstTplDir)
-			return err
-		}
-		cookedTpl := strings.Join([]string{vt.DstTplDir, strings.TrimSuffix(fName, ".tpl")}, "/")
-		err = ioutil.WriteFile(cookedTpl, []byte(out), 0644)
-		if err != nil {
-			return err
-		}
-	}
-
-	return nil
-}
-
-func (vt *VmTemplate) getRawTemplateFiles() ([]string, error) {
-	tf := make([]string, 0, 10)
-	files, err := ioutil.ReadDir(vt.SrcTplDir)
-	if err != nil {
-		return nil, err
-	}
-	for _, f := range files {
-		tf = append(tf, f.Name())
+		rendered[fName] = out
 	}
 
-	return tf, nil
+	return rendered, nil
 }
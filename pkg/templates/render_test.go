@@ -0,0 +1,155 @@
+package templates
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/flosch/pongo2"
+)
+
+func TestRender(t *testing.T) {
+	set, err := Load("")
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	rendered, err := New(set, pongo2.Context{"replicas": 2}).Render()
+	if err != nil {
+		t.Fatalf("Render failed: %v", err)
+	}
+
+	for _, name := range []string{RootTemplate, "network.yaml", "vm.yaml"} {
+		content, ok := rendered[name]
+		if !ok {
+			t.Errorf("expected %s to be rendered, got %d templates", name, len(rendered))
+			continue
+		}
+		if !strings.HasPrefix(content, "heat_template_version") {
+			t.Errorf("expected %s to be a heat template, got %q", name, content)
+		}
+	}
+	if len(rendered) != 3 {
+		t.Errorf("expected 3 templates, got %d", len(rendered))
+	}
+}
+
+// TestEmbeddedTemplates fails when files/ changed without running go generate
+func TestEmbeddedTemplates(t *testing.T) {
+	files, err := ioutil.ReadDir("files")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != len(defaultTemplates) {
+		t.Errorf("expected %d embedded templates, got %d", len(files), len(defaultTemplates))
+	}
+	for _, f := range files {
+		content, err := ioutil.ReadFile(filepath.Join("files", f.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if defaultTemplates[f.Name()] != string(content) {
+			t.Errorf("embedded %s is out of date, run go generate ./pkg/templates", f.Name())
+		}
+	}
+}
+
+func TestLoad(t *testing.T) {
+	embedded, err := Load("/nonexistent")
+	if err != nil {
+		t.Fatalf("expected a missing overlay dir to be ignored, got %v", err)
+	}
+	if embedded.Source != SourceEmbedded || len(embedded.Overridden) != 0 || embedded.Version == "" {
+		t.Errorf("expected the embedded templates, got %+v", embedded)
+	}
+
+	dir, err := ioutil.TempDir("", "templates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	write := func(name string, content string) {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// other files of the config dir are not templates
+	write("clouds.yaml", "clouds: {}\n")
+	set, err := Load(dir)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if set.Source != SourceEmbedded || set.Version != embedded.Version {
+		t.Errorf("expected the embedded templates without overlay templates, got %+v", set)
+	}
+
+	write("vm.yaml.tpl", "heat_template_version: 2018-08-31\n")
+	set, err = Load(dir)
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	if set.Source != dir || len(set.Overridden) != 1 || set.Overridden[0] != "vm.yaml.tpl" {
+		t.Errorf("expected vm.yaml.tpl to be overridden by %s, got %+v", dir, set)
+	}
+	if set.Version == embedded.Version {
+		t.Error("expected the version to change with the overridden template")
+	}
+	rendered, err := New(set, nil).Render()
+	if err != nil {
+		t.Fatalf("Render failed: %v", err)
+	}
+	if rendered["vm.yaml"] != "heat_template_version: 2018-08-31\n" || rendered["network.yaml"] == "" {
+		t.Errorf("expected the overridden vm.yaml and the embedded network.yaml, got %v", rendered)
+	}
+
+	write("vm.yaml.tpl", "{% if replicas %}\n")
+	if _, err := Load(dir); err == nil {
+		t.Error("expected a broken template to be rejected")
+	}
+}
+
+func TestNewSet(t *testing.T) {
+	set, err := NewSet("lb", "v1", map[string]string{
+		RootTemplate: "heat_template_version: 2016-10-14\n{% if lb_port %}# port {{ lb_port }}\n{% endif %}",
+		"lb.yaml":    "heat_template_version: 2016-10-14\n",
+	})
+	if err != nil {
+		t.Fatalf("NewSet failed: %v", err)
+	}
+	if set.Source != "lb" || set.Version != "v1" {
+		t.Errorf("expected the declared source and version, got %+v", set)
+	}
+	rendered, err := New(set, pongo2.Context{"lb_port": 80}).Render()
+	if err != nil {
+		t.Fatalf("Render failed: %v", err)
+	}
+	if !strings.Contains(rendered[RootTemplate], "# port 80") || len(rendered) != 2 {
+		t.Errorf("expected the root template rendered with lb_port, got %v", rendered)
+	}
+
+	if _, err := NewSet("lb", "v1", map[string]string{"lb.yaml": ""}); err == nil {
+		t.Error("expected templates without root template to be rejected")
+	}
+	if _, err := NewSet("lb", "v1", map[string]string{RootTemplate: "{% for %}"}); err == nil {
+		t.Error("expected a broken template to be rejected")
+	}
+}
+
+func TestRenderIndent(t *testing.T) {
+	set, err := NewSet("test", "1", map[string]string{
+		RootTemplate: "config: |\n  {{ config|indent:2 }}\n",
+	})
+	if err != nil {
+		t.Fatalf("NewSet failed: %v", err)
+	}
+	rendered, err := New(set, pongo2.Context{"config": "#!/bin/sh\necho <hello> & done"}).Render()
+	if err != nil {
+		t.Fatalf("Render failed: %v", err)
+	}
+	want := "config: |\n  #!/bin/sh\n  echo <hello> & done\n"
+	if rendered[RootTemplate] != want {
+		t.Errorf("expected %q, got %q", want, rendered[RootTemplate])
+	}
+}
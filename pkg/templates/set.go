@@ -0,0 +1,134 @@
+package templates
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/flosch/pongo2"
+)
+
+//go:generate go run gen.go
+
+const (
+	// SourceEmbedded is the source of a Set made of the embedded templates only
+	SourceEmbedded = "embedded"
+
+	tplSuffix = ".tpl"
+)
+
+// Set is the set of raw templates the templates of a stack are rendered from,
+// keyed by the name of the rendered template
+type Set struct {
+	// Source is SourceEmbedded, the overlay dir if it overrides templates, or
+	// the VirtualMachineTemplate the templates come from
+	Source string
+	// Version identifies the contents of the templates
+	Version string
+	// Overridden lists the templates read from the overlay dir
+	Overridden []string
+
+	templates map[string]string
+}
+
+// Load returns the embedded templates overridden by the "*.tpl" files of
+// overlayDir, a missing overlayDir leaves the embedded templates. Every
+// template is parsed, so a broken template is reported at startup rather than
+// by the first stack.
+func Load(overlayDir string) (*Set, error) {
+	set := &Set{
+		Source:    SourceEmbedded,
+		templates: make(map[string]string, len(defaultTemplates)),
+	}
+	for name, content := range defaultTemplates {
+		set.templates[strings.TrimSuffix(name, tplSuffix)] = content
+	}
+
+	if overlayDir != "" {
+		if err := set.overlay(overlayDir); err != nil {
+			return nil, err
+		}
+	}
+	if err := set.check(); err != nil {
+		return nil, err
+	}
+
+	set.Version = version(set.templates)
+	return set, nil
+}
+
+// NewSet returns the set of templates, keyed by the name of the rendered
+// template, from source. Unlike Load, version is the one declared by source.
+func NewSet(source string, version string, templates map[string]string) (*Set, error) {
+	set := &Set{
+		Source:    source,
+		Version:   version,
+		templates: make(map[string]string, len(templates)),
+	}
+	for name, content := range templates {
+		set.templates[name] = content
+	}
+
+	if err := set.check(); err != nil {
+		return nil, err
+	}
+	return set, nil
+}
+
+func (s *Set) check() error {
+	if _, ok := s.templates[RootTemplate]; !ok {
+		return fmt.Errorf("root template %s not found in templates of %s", RootTemplate, s.Source)
+	}
+	for name, content := range s.templates {
+		if _, err := pongo2.FromString(content); err != nil {
+			return fmt.Errorf("failed to parse template %s of %s: %v", name, s.Source, err)
+		}
+	}
+	return nil
+}
+
+func (s *Set) overlay(dir string) error {
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), tplSuffix) {
+			continue
+		}
+		content, err := ioutil.ReadFile(filepath.Join(dir, f.Name()))
+		if err != nil {
+			return err
+		}
+		s.templates[strings.TrimSuffix(f.Name(), tplSuffix)] = string(content)
+		s.Overridden = append(s.Overridden, f.Name())
+	}
+	if len(s.Overridden) > 0 {
+		s.Source = dir
+	}
+	return nil
+}
+
+// version hashes the templates in name order
+func version(templates map[string]string) string {
+	names := make([]string, 0, len(templates))
+	for name := range templates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	h := sha256.New()
+	for _, name := range names {
+		fmt.Fprintf(h, "%s\x00%s\x00", name, templates[name])
+	}
+	return hex.EncodeToString(h.Sum(nil))[:12]
+}
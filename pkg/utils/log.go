@@ -2,17 +2,25 @@ package utils
 
 import (
 	"context"
+
 	"github.com/go-logr/logr"
+	"sigs.k8s.io/controller-runtime/pkg/log"
 )
 
 const (
 	loggerCtxKey = "logger"
 )
 
-func GetLoggerOrDie(ctx context.Context) logr.Logger {
-	logger, ok := ctx.Value(loggerCtxKey).(logr.Logger)
-	if !ok {
-		panic("context didn't contain logger")
+// GetLogger returns the logger of ctx, or the logger of the controller
+// runtime if ctx has none, a missing logger mustn't crash the operator
+func GetLogger(ctx context.Context) logr.Logger {
+	if logger, ok := ctx.Value(loggerCtxKey).(logr.Logger); ok {
+		return logger
 	}
-	return logger
+	return log.Log
+}
+
+// WithLogger returns ctx carrying logger, which GetLogger returns
+func WithLogger(ctx context.Context, logger logr.Logger) context.Context {
+	return context.WithValue(ctx, loggerCtxKey, logger)
 }